@@ -0,0 +1,50 @@
+package tinybox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// execAuthzTimeout is how long the exec authorization hook has to decide,
+// an exec is refused if it takes longer.
+const execAuthzTimeout = time.Second * 10
+
+// execAuthzRequest is written to the stdin of the hook as json.
+type execAuthzRequest struct {
+	Name string   `json:"name"`
+	Argv []string `json:"argv"`
+}
+
+// authorizeExec runs c.ExecAuthzCmd for the exec of argv, which is refused
+// unless the hook exits with 0. The hook is set when the container is run,
+// so an exec can't skip it.
+func (c *Container) authorizeExec(argv []string) error {
+	if c.ExecAuthzCmd == "" {
+		return nil
+	}
+
+	req, err := json.Marshal(&execAuthzRequest{Name: c.Name, Argv: argv})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execAuthzTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.ExecAuthzCmd, c.Name)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s didn't decide in %s", ErrExecDenied, c.ExecAuthzCmd, execAuthzTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s %v: %v", ErrExecDenied, c.ExecAuthzCmd, argv, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package tinybox
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorizeExec(t *testing.T) {
+	// The hook only allows ls -l.
+	hook := filepath.Join(t.TempDir(), "authz")
+	script := "#!/bin/sh\ngrep -q '\"argv\":\\[\"/bin/ls\",\"-l\"\\]'\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{Name: "c", ExecAuthzCmd: hook}
+
+	tests := []struct {
+		cmd     string
+		allowed bool
+	}{
+		{"/bin/ls -l", true},
+		{"/bin/ls   -l", true},
+		{"/bin/ls", false},
+		{"/bin/sh -c id", false},
+		{"/bin/ls -l /root", false},
+	}
+	for _, tt := range tests {
+		err := c.authorizeExec(execArgv(tt.cmd))
+		if tt.allowed && err != nil {
+			t.Errorf("exec %q refused: %v", tt.cmd, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrExecDenied) {
+			t.Errorf("exec %q = %v, want %v", tt.cmd, err, ErrExecDenied)
+		}
+	}
+
+	// Without a hook every exec is allowed.
+	if err := (&Container{Name: "c"}).authorizeExec(execArgv("/bin/sh")); err != nil {
+		t.Errorf("exec without a hook refused: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package tinybox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// capabilities are the capability numbers by name, without the CAP_ prefix.
+var capabilities = map[string]uint{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// capProfiles are the named capability sets of --cap-profile, "all" is
+// every capability known.
+var capProfiles = map[string][]string{
+	"none": {},
+	"default": {
+		"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL",
+		"SETGID", "SETUID", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT",
+	},
+	"docker-default": {
+		"CHOWN", "DAC_OVERRIDE", "FSETID", "FOWNER", "MKNOD",
+		"NET_RAW", "SETGID", "SETUID", "SETFCAP", "SETPCAP",
+		"NET_BIND_SERVICE", "SYS_CHROOT", "KILL", "AUDIT_WRITE",
+	},
+	"all": nil,
+}
+
+// capName returns the name of a capability like CAP_CHOWN or chown, "ALL"
+// is kept for all capabilities.
+func capName(s string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(s), "CAP_")
+	if _, ok := capabilities[name]; !ok && name != "ALL" {
+		return "", fmt.Errorf("Unknown capability %s", s)
+	}
+	return name, nil
+}
+
+// resolveCaps returns the sorted capabilities of profile modified by add
+// and drop, a drop wins over an add of the same capability. The profile
+// defaults to all.
+func resolveCaps(profile string, add, drop []string) ([]string, error) {
+	if profile == "" {
+		profile = "all"
+	}
+	base, ok := capProfiles[profile]
+	if !ok {
+		return nil, fmt.Errorf("Unknown capability profile %s", profile)
+	}
+	if profile == "all" {
+		base = []string{"ALL"}
+	}
+
+	set := make(map[string]bool, len(capabilities))
+	update := func(names []string, v bool) error {
+		for _, s := range names {
+			name, err := capName(s)
+			if err != nil {
+				return err
+			}
+			if name != "ALL" {
+				set[name] = v
+				continue
+			}
+			for name := range capabilities {
+				set[name] = v
+			}
+		}
+		return nil
+	}
+
+	if err := update(base, true); err != nil {
+		return nil, err
+	}
+	if err := update(add, true); err != nil {
+		return nil, err
+	}
+	if err := update(drop, false); err != nil {
+		return nil, err
+	}
+
+	caps := make([]string, 0, len(set))
+	for name, v := range set {
+		if v {
+			caps = append(caps, name)
+		}
+	}
+	sort.Slice(caps, func(i, j int) bool {
+		return capabilities[caps[i]] < capabilities[caps[j]]
+	})
+	return caps, nil
+}
+
+const (
+	prCapbsetDrop = 24
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// setCaps limits the init process to the capabilities of the container,
+// they're dropped from the bounding set so the exec can't regain them.
+// It must be the last setup step, the ones before need the capabilities.
+func setCaps(c *Container) error {
+	if c.CapProfile == "" && len(c.CapAdd) == 0 && len(c.CapDrop) == 0 {
+		return nil
+	}
+
+	caps, err := resolveCaps(c.CapProfile, c.CapAdd, c.CapDrop)
+	if err != nil {
+		return err
+	}
+
+	// The capabilities newer than the kernel are ignored.
+	last := lastCap()
+	keep := make(map[uint]bool, len(caps))
+	var data [2]capData
+	for _, name := range caps {
+		if n := capabilities[name]; n <= last {
+			keep[n] = true
+			data[n/32].effective |= 1 << (n % 32)
+		}
+	}
+
+	for n := uint(0); n <= last; n++ {
+		if keep[n] {
+			continue
+		}
+		if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(n), 0); e != 0 {
+			return fmt.Errorf("Drop capability %d from the bounding set: %v", n, e)
+		}
+	}
+
+	for i := range data {
+		data[i].permitted = data[i].effective
+		data[i].inheritable = data[i].effective
+	}
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	if _, _, e := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e != 0 {
+		return fmt.Errorf("Set capabilities: %v", e)
+	}
+	return nil
+}
+
+// lastCap returns the highest capability of the kernel.
+func lastCap() uint {
+	last := uint(len(capabilities) - 1)
+	b, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return last
+	}
+	if n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32); err == nil {
+		return uint(n)
+	}
+	return last
+}
@@ -0,0 +1,132 @@
+package tinybox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestResolveCaps(t *testing.T) {
+	all := make([]string, 0, len(capabilities))
+	for name := range capabilities {
+		all = append(all, name)
+	}
+	// Sorted by number by resolveCaps.
+	sortCaps := func(caps []string) []string {
+		sort.Slice(caps, func(i, j int) bool { return capabilities[caps[i]] < capabilities[caps[j]] })
+		return caps
+	}
+
+	tests := []struct {
+		name    string
+		profile string
+		add     []string
+		drop    []string
+		want    []string // nil for an error
+	}{
+		{"none", "none", nil, nil, []string{}},
+		{"default", "default", nil, nil, []string{
+			"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT",
+		}},
+		{"docker default", "docker-default", nil, nil, []string{
+			"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID", "SETPCAP", "NET_BIND_SERVICE",
+			"NET_RAW", "SYS_CHROOT", "MKNOD", "AUDIT_WRITE", "SETFCAP",
+		}},
+		{"all", "all", nil, nil, sortCaps(all)},
+		{"no profile is all", "", nil, nil, sortCaps(all)},
+		{"add to none", "none", []string{"cap_net_admin", "KILL"}, nil, []string{"KILL", "NET_ADMIN"}},
+		{"drop from default", "default", nil, []string{"CAP_SETUID", "setgid"},
+			[]string{"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "SETPCAP", "NET_BIND_SERVICE", "SYS_CHROOT"}},
+		{"add and drop", "docker-default", []string{"SYS_ADMIN"}, []string{"MKNOD", "NET_RAW"},
+			[]string{"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID", "SETPCAP", "NET_BIND_SERVICE",
+				"SYS_CHROOT", "SYS_ADMIN", "AUDIT_WRITE", "SETFCAP"}},
+		{"drop wins over add", "none", []string{"KILL"}, []string{"KILL"}, []string{}},
+		{"drop all", "all", []string{"CHOWN"}, []string{"ALL"}, []string{}},
+		{"add all", "none", []string{"ALL"}, []string{"SYS_ADMIN"}, sortCaps(removeCaps(all, "SYS_ADMIN"))},
+		{"unknown profile", "privileged", nil, nil, nil},
+		{"unknown capability", "none", []string{"CAP_FLY"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveCaps(tt.profile, tt.add, tt.drop)
+			if (err == nil) != (tt.want != nil) {
+				t.Fatalf("resolveCaps = %v, want ok %v", err, tt.want != nil)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveCaps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func removeCaps(caps []string, names ...string) []string {
+	var result []string
+	for _, name := range caps {
+		keep := true
+		for _, n := range names {
+			keep = keep && name != n
+		}
+		if keep {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// TestSetCaps sets the capabilities of a profile with modifiers in a child
+// of the test like the init process, the program it execs must have the
+// same bounding and effective sets.
+func TestSetCaps(t *testing.T) {
+	profile, add, drop := "docker-default", []string{"NET_ADMIN"}, []string{"MKNOD"}
+	if os.Getenv("TINYBOX_TEST_CAPS") != "" {
+		runtime.LockOSThread()
+		c := &Container{CapProfile: profile, CapAdd: add, CapDrop: drop}
+		if err := setCaps(c); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err := syscall.Exec("/bin/grep", []string{"grep", "^Cap", "/proc/self/status"}, os.Environ())
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to have all capabilities")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSetCaps$")
+	cmd.Env = append(os.Environ(), "TINYBOX_TEST_CAPS=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	caps, err := resolveCaps(profile, add, drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want uint64
+	for _, name := range caps {
+		want |= 1 << capabilities[name]
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] == "CapAmb:" {
+			continue
+		}
+		got, err := strconv.ParseUint(fields[1], 16, 64)
+		if err != nil {
+			t.Fatalf("child printed %q", out)
+		}
+		if got != want {
+			t.Errorf("%s %#x, want %#x", fields[0], got, want)
+		}
+	}
+}
@@ -10,7 +10,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -41,6 +44,60 @@ type CGroupOptions struct {
 	CpuCfsquota  string `json:"cpuquota"`
 	CpusetCpus   string `json:"cpusetcpus"`
 	CpusetMems   string `json:"cpusetmems"`
+	CpuRtRuntime string `json:"cpurtruntime"`
+	CpuRtPeriod  string `json:"cpurtperiod"`
+
+	Memory            string `json:"memory,omitempty"`            // hard limit, e.g. 512m
+	MemoryReservation string `json:"memoryreservation,omitempty"` // soft limit, can't exceed Memory
+
+	Devices []Device `json:"devices,omitempty"`
+
+	Blkio BlkioOptions `json:"blkio"`
+
+	// Raw is written after the structured limits of each subsystem.
+	Raw []CGroupRaw `json:"raw,omitempty"`
+
+	// Root is the dir holding the hierarchies, they're found in mountinfo
+	// if it's not set.
+	Root string `json:"root,omitempty"`
+
+	// Parent is the cgroup the container is placed under, either a path
+	// or a systemd "slice:prefix:name".
+	Parent string `json:"parent,omitempty"`
+	// Existing is a cgroup made by others which the container joins, in
+	// each hierarchy. It's never created or removed by tinybox.
+	Existing string `json:"existing,omitempty"`
+
+	// Reuse is the policy for a cgroup left with tasks by a previous run:
+	// fail, reuse or clean.
+	Reuse string `json:"reuse,omitempty"`
+
+	// Strict makes a failed write of an optional limit fatal.
+	Strict bool `json:"strict"`
+	// StrictLimits rejects the limits beyond the host's capacity, instead
+	// of clamping them to it.
+	StrictLimits bool `json:"strictlimits,omitempty"`
+	// Applied is the cgroup files written successfully.
+	Applied []string `json:"applied,omitempty"`
+}
+
+// writeLimit writes v into the cgroup file and records it as applied, it
+// panics on error like WriteFileWithPanic. If the limit is optional and
+// the file is missing or not writable, it's skipped with a warning in
+// non-strict mode.
+func writeLimit(opt *CGroupOptions, dir, file, v string, optional bool) {
+	err := ioutil.WriteFile(filepath.Join(dir, file), []byte(v), 0)
+	trace("write", err, filepath.Join(dir, file), v)
+	if err == nil {
+		opt.Applied = append(opt.Applied, file)
+		return
+	}
+
+	if optional && !opt.Strict && (os.IsNotExist(err) || os.IsPermission(err)) {
+		log.Printf("Warning: skip optional cgroup limit %s: %v \n", file, err)
+		return
+	}
+	panic(err)
 }
 
 type CGroupSetter interface {
@@ -66,7 +123,7 @@ func (ss SetterSlice) Write(typ, dir string, opt *CGroupOptions) error {
 			return err
 		}
 	}
-	return nil
+	return writeRaw(opt, typ, dir)
 }
 
 type CGroup struct {
@@ -75,33 +132,70 @@ type CGroup struct {
 	paths  map[string]string
 }
 
-func newCGroup() (*CGroup, error) {
-	check := func(str string, path string, tab map[string]string) {
-		for _, name := range subs {
-			ix := strings.Index(str, name)
-			if ix >= 0 {
-				last := ix + len(name)
+// hasSubsys reports whether the comma separated list has subsystem name.
+func hasSubsys(list, name string) bool {
+	for _, s := range strings.Split(list, ",") {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
 
-				if last == len(str) {
-					tab[name] = path
-					continue
-				}
-				if str[last] == ',' {
-					tab[name] = path
-					continue
-				}
-			}
+// newCGroup finds the hierarchies of the subsystems, either the cgroup
+// mounts in /proc/self/mountinfo, or the dirs under root if it's set, for
+// a layout mountinfo doesn't show. A dir of several subsystems is named
+// like cpu,cpuacct.
+func newCGroup(root string) (*CGroup, error) {
+	procs, err := readProcCgroup("/proc/1/cgroup")
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts, mountRoots map[string]string
+	if root != "" {
+		mounts, err = scanCgroupRoot(root)
+	} else {
+		var file *os.File
+		if file, err = os.Open("/proc/self/mountinfo"); err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		mounts, mountRoots, err = parseMountinfo(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The cgroup of init is relative to the root of the hierarchy, while
+	// a mount in a nested environment may have a cgroup as its root.
+	roots := make(map[string]string, len(procs))
+	for name, p := range procs {
+		if mr := mountRoots[name]; mr != "" && mr != "/" && (p == mr || strings.HasPrefix(p, mr+"/")) {
+			p = "/" + strings.TrimPrefix(p[len(mr):], "/")
 		}
+		roots[name] = p
 	}
 
-	file, err := os.Open("/proc/1/cgroup")
+	cg := new(CGroup)
+	cg.roots = roots
+	cg.mounts = mounts
+	cg.paths = make(map[string]string, len(subs))
+
+	return cg, nil
+}
+
+// readProcCgroup reads the cgroup of each subsystem from a
+// /proc/<pid>/cgroup file.
+func readProcCgroup(file string) (map[string]string, error) {
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	defer f.Close()
 
 	roots := make(map[string]string, len(subs))
-	br := bufio.NewReader(file)
+	br := bufio.NewReader(f)
 	for {
 		line, _, err := br.ReadLine()
 		if err != nil {
@@ -115,44 +209,73 @@ func newCGroup() (*CGroup, error) {
 		if len(fields) != 3 {
 			continue
 		}
-
-		check(fields[1], fields[2], roots)
-	}
-
-	file2, err := os.Open("/proc/mounts")
-	if err != nil {
-		return nil, err
+		for _, name := range subs {
+			if hasSubsys(fields[1], name) {
+				roots[name] = fields[2]
+			}
+		}
 	}
-	defer file2.Close()
+	return roots, nil
+}
 
+// parseMountinfo returns the mount point and the root of the cgroup v1
+// mount of each subsystem in mountinfo r.
+func parseMountinfo(r io.Reader) (map[string]string, map[string]string, error) {
 	mounts := make(map[string]string, len(subs))
-	br = bufio.NewReader(file2)
+	roots := make(map[string]string, len(subs))
+
+	br := bufio.NewReader(r)
 	for {
 		line, _, err := br.ReadLine()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			return nil, nil, err
 		}
 
+		// id parent dev root point options [optional...] - type source super
 		fields := strings.Fields(string(line))
-		if len(fields) != 6 {
-			continue
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
 		}
-		if typ := fields[2]; typ != "cgroup" {
+		if sep < 5 || sep+3 >= len(fields) || fields[sep+1] != "cgroup" {
 			continue
 		}
 
-		check(filepath.Base(fields[1]), fields[1], mounts)
+		for _, name := range subs {
+			if hasSubsys(fields[sep+3], name) {
+				mounts[name] = unescapeMount(fields[4])
+				roots[name] = unescapeMount(fields[3])
+			}
+		}
 	}
+	return mounts, roots, nil
+}
 
-	cg := new(CGroup)
-	cg.roots = roots
-	cg.mounts = mounts
-	cg.paths = make(map[string]string, len(subs))
+// scanCgroupRoot returns the hierarchy of each subsystem under root.
+func scanCgroupRoot(root string) (map[string]string, error) {
+	names, err := readDirNames(root)
+	if err != nil {
+		return nil, fmt.Errorf("Read cgroup root %s: %v", root, err)
+	}
 
-	return cg, nil
+	mounts := make(map[string]string, len(subs))
+	for _, dir := range names {
+		if info, err := os.Stat(filepath.Join(root, dir)); err != nil || !info.IsDir() {
+			continue
+		}
+		for _, name := range subs {
+			if hasSubsys(dir, name) {
+				mounts[name] = filepath.Join(root, dir)
+			}
+		}
+	}
+	return mounts, nil
 }
 
 func (cg *CGroup) Paths() map[string]string {
@@ -174,7 +297,7 @@ func (cg *CGroup) Memory(c *Container) error {
 		return err
 	}
 
-	if err := WriteFileInt(filepath.Join(group, "cgroup.procs"), c.Pid); err != nil {
+	if err := joinCgroup(group, c.Pid); err != nil {
 		return err
 	}
 
@@ -188,7 +311,7 @@ func (cg *CGroup) CPU(c *Container) error {
 		return err
 	}
 
-	if err := WriteFileInt(filepath.Join(group, "cgroup.procs"), c.Pid); err != nil {
+	if err := joinCgroup(group, c.Pid); err != nil {
 		return err
 	}
 
@@ -202,7 +325,7 @@ func (cg *CGroup) CpuAcct(c *Container) error {
 		return err
 	}
 
-	if err := WriteFileInt(filepath.Join(group, "cgroup.procs"), c.Pid); err != nil {
+	if err := joinCgroup(group, c.Pid); err != nil {
 		return err
 	}
 
@@ -273,7 +396,7 @@ func (cg *CGroup) CpuSet(c *Container) error {
 		dir = filepath.Dir(dir)
 	}
 
-	if err := WriteFileInt(filepath.Join(group, "cgroup.procs"), c.Pid); err != nil {
+	if err := joinCgroup(group, c.Pid); err != nil {
 		return err
 	}
 
@@ -281,23 +404,295 @@ func (cg *CGroup) CpuSet(c *Container) error {
 	return setters.Write(subsysCS, group, c.CgOpts)
 }
 
+// Devices denies all devices but the container's. A container without a
+// rootfs uses the host's /dev, it isn't put in a devices cgroup.
+func (cg *CGroup) Devices(c *Container) error {
+	if c.Rootfs == "" {
+		return nil
+	}
+
+	group, err := cg.cgroupPath(subsysDEV, c)
+	if err != nil {
+		return err
+	}
+
+	if err := joinCgroup(group, c.Pid); err != nil {
+		return err
+	}
+
+	cg.paths[subsysDEV] = group
+	return setters.Write(subsysDEV, group, c.CgOpts)
+}
+
+// Policies of --cgroup-reuse for a cgroup of the container's name which
+// still has the tasks of a previous run.
+const (
+	reuseFail  = "fail"  // refuse to mix the workloads
+	reuseKeep  = "reuse" // join it with the tasks and the limits left
+	reuseClean = "clean" // kill the tasks and recreate it, so the limits are reset
+)
+
+// staleKillTimeout is how long the killed tasks of a stale cgroup have to
+// leave it.
+const staleKillTimeout = time.Second * 5
+
+// checkStale applies the reuse policy to the cgroup dir if it's left by a
+// previous run. The init process itself may be in it already, when the
+// hierarchy is mounted with another one like cpu,cpuacct.
+func (cg *CGroup) checkStale(dir string, c *Container) error {
+	for _, p := range cg.paths {
+		if p == dir {
+			return nil
+		}
+	}
+
+	pids, err := readCgroupPids(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var stale []int
+	for _, pid := range pids {
+		if pid != c.Pid {
+			stale = append(stale, pid)
+		}
+	}
+
+	switch c.CgOpts.Reuse {
+	case reuseKeep:
+		if len(stale) > 0 {
+			log.Printf("Reuse cgroup %s with %d stale tasks \n", dir, len(stale))
+		}
+		return nil
+	case reuseClean:
+		return cleanCgroup(dir, stale)
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("Cgroup %s has %d stale tasks like %d, see --cgroup-reuse", dir, len(stale), stale[0])
+	}
+	return nil
+}
+
+// cleanCgroup kills the tasks of the cgroup dir and removes it.
+func cleanCgroup(dir string, pids []int) error {
+	for _, pid := range pids {
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("Kill stale task %d of %s: %v", pid, dir, err)
+		}
+	}
+
+	deadline := time.Now().Add(staleKillTimeout)
+	for {
+		left, err := readCgroupPids(dir)
+		if err != nil {
+			return err
+		}
+		if len(left) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Cgroup %s still has %d tasks after kill", dir, len(left))
+		}
+		time.Sleep(probeInterval)
+	}
+
+	log.Printf("Clean stale cgroup %s, killed %d tasks \n", dir, len(pids))
+	err := os.Remove(dir)
+	trace("rmdir", err, dir)
+	return err
+}
+
+// readCgroupPids reads the pids of cgroup.procs of the cgroup dir.
+func readCgroupPids(dir string) ([]int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(b)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// joinCgroup moves pid into the cgroup dir.
+func joinCgroup(dir string, pid int) error {
+	file := filepath.Join(dir, "cgroup.procs")
+	err := WriteFileInt(file, pid)
+	trace("write", err, file, strconv.Itoa(pid))
+	return err
+}
+
+// BlkIO places the container in the blkio cgroup, only if it has a
+// throttle, so a host without the blkio hierarchy still runs the others.
+func (cg *CGroup) BlkIO(c *Container) error {
+	if c.CgOpts.Blkio.IsEmpty() {
+		return nil
+	}
+
+	group, err := cg.cgroupPath(subsysBIO, c)
+	if err != nil {
+		return err
+	}
+
+	if err := joinCgroup(group, c.Pid); err != nil {
+		return err
+	}
+
+	cg.paths[subsysBIO] = group
+	return setters.Write(subsysBIO, group, c.CgOpts)
+}
+
 func (cg *CGroup) cgroupPath(name string, c *Container) (string, error) {
+	path, err := cg.groupPath(name, c)
+	if err != nil {
+		return "", err
+	}
+
+	if c.CgOpts.Existing != "" {
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("Existing cgroup %s not found", path)
+		}
+		if err := syscall.Access(filepath.Join(path, "cgroup.procs"), 2); err != nil {
+			return "", fmt.Errorf("Existing cgroup %s is not writable: %v", path, err)
+		}
+		return path, nil
+	}
+
+	if err := cg.checkStale(path, c); err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(path, 0755)
+	trace("mkdir", err, path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// groupPath returns the cgroup dir of the container for subsystem name,
+// it doesn't create the dir.
+func (cg *CGroup) groupPath(name string, c *Container) (string, error) {
 	mount := cg.mounts[name]
 	root := cg.roots[name]
 
 	if mount == "" || root == "" {
-		return "", fmt.Errorf("Not found %s mount or root path", name)
+		return "", fmt.Errorf("%w: not found %s mount or root path", ErrCgroupUnsupported, name)
 	}
 
-	path := path.Join(mount, root, c.CgPrefix, c.Name)
-
 	if debug {
 		log.Printf("mount: %s, root: %s, prefix: %s, name: %s \n", mount, root, c.CgPrefix, c.Name)
 	}
 
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return "", err
+	if c.CgOpts.Existing != "" {
+		return path.Join(mount, c.CgOpts.Existing), nil
 	}
 
-	return path, nil
+	if slice, scope, ok := systemdParent(c.CgOpts.Parent, c.Name); ok {
+		p, err := expandSlice(slice)
+		if err != nil {
+			return "", err
+		}
+		return path.Join(mount, p, scope), nil
+	}
+
+	return path.Join(mount, root, c.CgOpts.Parent, c.CgPrefix, c.Name), nil
+}
+
+// validateExisting checks the existing cgroup is an absolute path of the
+// hierarchy, it can't be set with a parent.
+func validateExisting(opt *CGroupOptions) error {
+	if opt.Existing == "" {
+		return nil
+	}
+	if opt.Parent != "" {
+		return fmt.Errorf("Can't set both cgroup parent and existing cgroup")
+	}
+	if !path.IsAbs(opt.Existing) || path.Clean(opt.Existing) != opt.Existing || opt.Existing == "/" {
+		return fmt.Errorf("Invalid existing cgroup %s, must be a clean absolute path", opt.Existing)
+	}
+	return nil
+}
+
+// validateParent checks the cgroup parent, a path must not escape the
+// hierarchy, and a systemd parent must be "slice:prefix:name".
+func validateParent(parent string) error {
+	if parent == "" {
+		return nil
+	}
+
+	if strings.Contains(parent, ":") {
+		fields := strings.Split(parent, ":")
+		if len(fields) != 3 || fields[1] == "" {
+			return fmt.Errorf("Invalid cgroup parent %s, expect slice:prefix:name", parent)
+		}
+		if fields[0] != "" {
+			if _, err := expandSlice(fields[0]); err != nil {
+				return err
+			}
+		}
+		for _, f := range fields[1:] {
+			if strings.Contains(f, "/") {
+				return fmt.Errorf("Invalid cgroup parent %s, prefix and name can't have /", parent)
+			}
+		}
+		return nil
+	}
+
+	for _, part := range strings.Split(parent, "/") {
+		if part == ".." {
+			return fmt.Errorf("Invalid cgroup parent %s, can't have ..", parent)
+		}
+	}
+	return nil
+}
+
+// systemdParent splits a systemd parent "slice:prefix:name" into the slice
+// and the scope unit of the container, the slice defaults to system.slice
+// and the name to the container's name.
+func systemdParent(parent, name string) (string, string, bool) {
+	fields := strings.Split(parent, ":")
+	if len(fields) != 3 {
+		return "", "", false
+	}
+
+	slice, prefix := fields[0], fields[1]
+	if slice == "" {
+		slice = "system.slice"
+	}
+	if fields[2] != "" {
+		name = fields[2]
+	}
+	return slice, prefix + "-" + name + ".scope", true
+}
+
+// expandSlice returns the path of a systemd slice, every "-" in its name
+// is a level of the hierarchy, e.g. a-b.slice is a.slice/a-b.slice.
+func expandSlice(slice string) (string, error) {
+	const suffix = ".slice"
+
+	name := strings.TrimSuffix(slice, suffix)
+	if name == slice || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("Invalid systemd slice %s", slice)
+	}
+	if name == "-" {
+		return "/", nil
+	}
+
+	var p, prefix string
+	for _, part := range strings.Split(name, "-") {
+		if part == "" {
+			return "", fmt.Errorf("Invalid systemd slice %s", slice)
+		}
+		p = path.Join(p, prefix+part+suffix)
+		prefix += part + "-"
+	}
+	return p, nil
 }
@@ -0,0 +1,151 @@
+package tinybox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	registerSetter(&defaultBlkio{})
+}
+
+// Throttle is a blkio throttle of a block device, the rate is in bytes or
+// IOs per second.
+type Throttle struct {
+	Path  string `json:"path"`
+	Major int64  `json:"major"`
+	Minor int64  `json:"minor"`
+	Rate  int64  `json:"rate"`
+}
+
+// statFunc is the stat syscall of the throttle devices.
+var statFunc = syscall.Stat
+
+// parseThrottle parses path:rate, the device numbers are read from the
+// path. A bps rate is a size like 10m or 10mb, an iops rate a count.
+func parseThrottle(s string, iops bool) (Throttle, error) {
+	var t Throttle
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return t, fmt.Errorf("Invalid throttle %s, expect path:rate", s)
+	}
+	t.Path = s[:i]
+
+	rate := strings.ToLower(s[i+1:])
+	var err error
+	if iops {
+		t.Rate, err = strconv.ParseInt(rate, 10, 64)
+	} else {
+		if strings.HasSuffix(rate, "kb") || strings.HasSuffix(rate, "mb") || strings.HasSuffix(rate, "gb") {
+			rate = rate[:len(rate)-1]
+		}
+		t.Rate, err = ParseSize(rate)
+	}
+	if err != nil || t.Rate <= 0 {
+		return t, fmt.Errorf("Invalid throttle rate %s", s[i+1:])
+	}
+
+	var st syscall.Stat_t
+	if err := statFunc(t.Path, &st); err != nil {
+		return t, fmt.Errorf("Throttle device %s: %v", t.Path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return t, fmt.Errorf("Throttle device %s is not a block device", t.Path)
+	}
+	t.Major = int64(devMajor(uint64(st.Rdev)))
+	t.Minor = int64(devMinor(uint64(st.Rdev)))
+	return t, nil
+}
+
+func (t Throttle) String() string {
+	return fmt.Sprintf("%d:%d %d", t.Major, t.Minor, t.Rate)
+}
+
+// BlkioOptions are the blkio throttles, the container only joins the
+// blkio cgroup with one of them.
+type BlkioOptions struct {
+	ReadBps   []Throttle `json:"readbps,omitempty"`
+	WriteBps  []Throttle `json:"writebps,omitempty"`
+	ReadIOPS  []Throttle `json:"readiops,omitempty"`
+	WriteIOPS []Throttle `json:"writeiops,omitempty"`
+}
+
+func (b *BlkioOptions) IsEmpty() bool {
+	return len(b.ReadBps)+len(b.WriteBps)+len(b.ReadIOPS)+len(b.WriteIOPS) == 0
+}
+
+type defaultBlkio struct{}
+
+func (d defaultBlkio) IsSubsys(typ string) bool {
+	return typ == subsysBIO
+}
+
+func (d defaultBlkio) Validate(opt *CGroupOptions) error {
+	for _, list := range [][]Throttle{opt.Blkio.ReadBps, opt.Blkio.WriteBps, opt.Blkio.ReadIOPS, opt.Blkio.WriteIOPS} {
+		devs := make(map[string]bool, len(list))
+		for _, t := range list {
+			if t.Rate <= 0 {
+				return fmt.Errorf("Invalid throttle rate %d of %s", t.Rate, t.Path)
+			}
+			key := fmt.Sprintf("%d:%d", t.Major, t.Minor)
+			if devs[key] {
+				return fmt.Errorf("Duplicate throttle of device %s", t.Path)
+			}
+			devs[key] = true
+		}
+	}
+	return nil
+}
+
+func (d defaultBlkio) Write(opt *CGroupOptions, dir string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	files := []struct {
+		name string
+		list []Throttle
+	}{
+		{"blkio.throttle.read_bps_device", opt.Blkio.ReadBps},
+		{"blkio.throttle.write_bps_device", opt.Blkio.WriteBps},
+		{"blkio.throttle.read_iops_device", opt.Blkio.ReadIOPS},
+		{"blkio.throttle.write_iops_device", opt.Blkio.WriteIOPS},
+	}
+	// The kernel takes one device per write.
+	for _, f := range files {
+		for _, t := range f.list {
+			writeLimit(opt, dir, f.name, t.String(), false)
+		}
+	}
+	return
+}
+
+// throttleValue is a --device-*-bps or --device-*-iops flag.
+type throttleValue struct {
+	list *[]Throttle
+	iops bool
+}
+
+func (v throttleValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	var paths []string
+	for _, t := range *v.list {
+		paths = append(paths, t.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (v throttleValue) Set(s string) error {
+	t, err := parseThrottle(s, v.iops)
+	if err != nil {
+		return err
+	}
+	*v.list = append(*v.list, t)
+	return nil
+}
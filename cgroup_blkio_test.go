@@ -0,0 +1,86 @@
+package tinybox
+
+import (
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestParseThrottle resolves the device paths with a fake stat, sda is
+// 8:0, nvme0n1p3 259:3 and null a char device.
+func TestParseThrottle(t *testing.T) {
+	defer func(f func(string, *syscall.Stat_t) error) { statFunc = f }(statFunc)
+	devs := map[string]syscall.Stat_t{
+		"/dev/sda":       {Mode: syscall.S_IFBLK | 0660, Rdev: devMkdev(8, 0)},
+		"/dev/nvme0n1p3": {Mode: syscall.S_IFBLK | 0660, Rdev: devMkdev(259, 3)},
+		"/dev/null":      {Mode: syscall.S_IFCHR | 0666, Rdev: devMkdev(1, 3)},
+	}
+	statFunc = func(path string, st *syscall.Stat_t) error {
+		dev, ok := devs[path]
+		if !ok {
+			return syscall.ENOENT
+		}
+		*st = dev
+		return nil
+	}
+
+	tests := []struct {
+		s    string
+		iops bool
+		want Throttle
+		err  string // "" for valid
+	}{
+		{"/dev/sda:10mb", false, Throttle{"/dev/sda", 8, 0, 10 << 20}, ""},
+		{"/dev/sda:10m", false, Throttle{"/dev/sda", 8, 0, 10 << 20}, ""},
+		{"/dev/sda:512KB", false, Throttle{"/dev/sda", 8, 0, 512 << 10}, ""},
+		{"/dev/nvme0n1p3:1g", false, Throttle{"/dev/nvme0n1p3", 259, 3, 1 << 30}, ""},
+		{"/dev/sda:1000", true, Throttle{"/dev/sda", 8, 0, 1000}, ""},
+		{"/dev/sda:10mb", true, Throttle{}, "Invalid throttle rate"},
+		{"/dev/sda:0", true, Throttle{}, "Invalid throttle rate"},
+		{"/dev/sda", false, Throttle{}, "expect path:rate"},
+		{"/dev/null:10mb", false, Throttle{}, "is not a block device"},
+		{"/dev/sdz:10mb", false, Throttle{}, "no such file"},
+	}
+	for _, tt := range tests {
+		got, err := parseThrottle(tt.s, tt.iops)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseThrottle(%q, %v) = %v, want %q", tt.s, tt.iops, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseThrottle(%q, %v) = %+v, %v, want %+v", tt.s, tt.iops, got, err, tt.want)
+		}
+	}
+
+	// The resolved numbers are what's written into the cgroup.
+	opt := CGroupOptions{}
+	for _, flag := range []struct {
+		v throttleValue
+		s string
+	}{
+		{throttleValue{&opt.Blkio.WriteBps, false}, "/dev/sda:10mb"},
+		{throttleValue{&opt.Blkio.WriteBps, false}, "/dev/nvme0n1p3:1m"},
+		{throttleValue{&opt.Blkio.ReadIOPS, true}, "/dev/sda:100"},
+	} {
+		if err := flag.v.Set(flag.s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	var err error
+	writes := traceWrites(t, func() { err = setters.Write(subsysBIO, dir, &opt) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"blkio.throttle.write_bps_device=8:0 10485760",
+		"blkio.throttle.write_bps_device=259:3 1048576",
+		"blkio.throttle.read_iops_device=8:0 100",
+	}
+	if !reflect.DeepEqual(writes, want) {
+		t.Errorf("wrote %q, want %q", writes, want)
+	}
+}
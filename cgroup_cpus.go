@@ -2,8 +2,12 @@ package tinybox
 
 import (
 	"fmt"
-	"path/filepath"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 func init() {
@@ -27,6 +31,12 @@ func (d defaultCpu) Validate(opt *CGroupOptions) error {
 	if _, err := strconv.Atoi(opt.CpuCfsquota); err != nil {
 		return err
 	}
+	if _, err := strconv.Atoi(opt.CpuRtRuntime); err != nil {
+		return err
+	}
+	if _, err := strconv.Atoi(opt.CpuRtPeriod); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -37,14 +47,23 @@ func (d defaultCpu) Write(opt *CGroupOptions, dir string) (err error) {
 		}
 	}()
 
+	// shares is only a weight, and rt files are missing when the kernel
+	// has no CONFIG_RT_GROUP_SCHED, so they are optional.
 	if opt.CpuShares != "0" {
-		WriteFileWithPanic(filepath.Join(dir, "cpu.shares"), opt.CpuShares)
+		writeLimit(opt, dir, "cpu.shares", opt.CpuShares, true)
 	}
 	if opt.CpuCfsPeriod != "0" {
-		WriteFileWithPanic(filepath.Join(dir, "cpu.cfs_period_us"), opt.CpuCfsPeriod)
+		writeLimit(opt, dir, "cpu.cfs_period_us", opt.CpuCfsPeriod, false)
 	}
 	if opt.CpuCfsquota != "0" {
-		WriteFileWithPanic(filepath.Join(dir, "cpu.cfs_quota_us"), opt.CpuCfsquota)
+		writeLimit(opt, dir, "cpu.cfs_quota_us", opt.CpuCfsquota, false)
+	}
+	// The period must be set before the runtime, which can't exceed it.
+	if opt.CpuRtPeriod != "0" {
+		writeLimit(opt, dir, "cpu.rt_period_us", opt.CpuRtPeriod, true)
+	}
+	if opt.CpuRtRuntime != "0" {
+		writeLimit(opt, dir, "cpu.rt_runtime_us", opt.CpuRtRuntime, true)
 	}
 	return
 }
@@ -55,8 +74,108 @@ func (d defaultCpuSet) IsSubsys(typ string) bool {
 	return typ == subsysCS
 }
 
-func (d defaultCpuSet) Validate(opt *CGroupOptions) error {
-	return nil
+func (d defaultCpuSet) Validate(opt *CGroupOptions) (err error) {
+	if opt.CpusetCpus, err = checkOnline("cpus", opt.CpusetCpus, "/sys/devices/system/cpu/online", opt.StrictLimits); err != nil {
+		return err
+	}
+	opt.CpusetMems, err = checkOnline("mems", opt.CpusetMems, "/sys/devices/system/node/online", opt.StrictLimits)
+	return err
+}
+
+// checkOnline checks the list of cpus or memory nodes are all online on
+// the host, a host without the online file of nodes only has node 0. The
+// ids not online are dropped from the returned list unless strict, it's
+// an error if none is left.
+func checkOnline(name, list, file string, strict bool) (string, error) {
+	if list == "" {
+		return "", nil
+	}
+
+	ids, err := parseList(list)
+	if err != nil {
+		return "", fmt.Errorf("Invalid cpuset %s %s", name, list)
+	}
+
+	online := map[int]bool{0: true}
+	if b, err := ioutil.ReadFile(file); err == nil {
+		if online, err = parseList(strings.TrimSpace(string(b))); err != nil {
+			return "", fmt.Errorf("Invalid %s: %v", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var offline []int
+	for _, id := range sortedIds(ids) {
+		if !online[id] {
+			if strict {
+				return "", fmt.Errorf("Invalid cpuset %s %s, %d is not online", name, list, id)
+			}
+			offline = append(offline, id)
+			delete(ids, id)
+		}
+	}
+	if len(offline) == 0 {
+		return list, nil
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("Invalid cpuset %s %s, none is online", name, list)
+	}
+
+	clamped := formatList(ids)
+	log.Printf("Cpuset %s %s clamped to %s, %d not online \n", name, list, clamped, len(offline))
+	return clamped, nil
+}
+
+func sortedIds(ids map[int]bool) []int {
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// formatList formats ids as a list like "0-3,8", the reverse of parseList.
+func formatList(ids map[int]bool) string {
+	sorted := sortedIds(ids)
+
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseList parses a cpu or node list like "0-3,8".
+func parseList(list string) (map[int]bool, error) {
+	ids := make(map[int]bool)
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("Invalid list %s", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first || last-first > 1<<16 {
+				return nil, fmt.Errorf("Invalid list %s", list)
+			}
+		}
+		for i := first; i <= last; i++ {
+			ids[i] = true
+		}
+	}
+	return ids, nil
 }
 
 func (d defaultCpuSet) Write(opt *CGroupOptions, dir string) (err error) {
@@ -67,10 +186,10 @@ func (d defaultCpuSet) Write(opt *CGroupOptions, dir string) (err error) {
 	}()
 
 	if opt.CpusetCpus != "" {
-		WriteFileWithPanic(filepath.Join(dir, "cpuset.cpus"), opt.CpusetCpus)
+		writeLimit(opt, dir, "cpuset.cpus", opt.CpusetCpus, false)
 	}
 	if opt.CpusetMems != "" {
-		WriteFileWithPanic(filepath.Join(dir, "cpuset.mems"), opt.CpusetMems)
+		writeLimit(opt, dir, "cpuset.mems", opt.CpusetMems, false)
 	}
 	return
 }
@@ -0,0 +1,168 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// TestCpuWrite writes the cpu limits set, the rt period before the
+// runtime which can't exceed it.
+func TestCpuWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  CGroupOptions
+		want []string
+	}{
+		{"none", CGroupOptions{}, nil},
+		{"shares and cfs", CGroupOptions{CpuShares: "512", CpuCfsPeriod: "100000", CpuCfsquota: "50000"},
+			[]string{"cpu.shares=512", "cpu.cfs_period_us=100000", "cpu.cfs_quota_us=50000"}},
+		{"rt", CGroupOptions{CpuRtPeriod: "1000000", CpuRtRuntime: "950000"},
+			[]string{"cpu.rt_period_us=1000000", "cpu.rt_runtime_us=950000"}},
+		{"rt runtime only", CGroupOptions{CpuRtRuntime: "10000"}, []string{"cpu.rt_runtime_us=10000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := tt.opt
+			for _, v := range []*string{&opt.CpuShares, &opt.CpuCfsPeriod, &opt.CpuCfsquota, &opt.CpuRtPeriod, &opt.CpuRtRuntime} {
+				if *v == "" {
+					*v = "0"
+				}
+			}
+			if err := (defaultCpu{}).Validate(&opt); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			var err error
+			writes := traceWrites(t, func() { err = (defaultCpu{}).Write(&opt, dir) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(writes, tt.want) {
+				t.Errorf("wrote %v, want %v", writes, tt.want)
+			}
+		})
+	}
+}
+
+// TestCpuSet places a container in a cpuset under an empty parent, like a
+// new cgroup v1 cpuset dir. The empty cpus and mems are inherited from the
+// nearest set ancestor, the ones set are written over them.
+func TestCpuSet(t *testing.T) {
+	tests := []struct {
+		name       string
+		cpus, mems string
+		want       []string // the writes of the setter
+		wantCpus   string   // cpuset.cpus of the container
+		wantMems   string
+	}{
+		{"inherited", "", "", nil, "0-3\n", "0\n"},
+		{"set", "1", "0", []string{"cpuset.cpus=1", "cpuset.mems=0"}, "1", "0"},
+		{"mems only", "", "0", []string{"cpuset.mems=0"}, "0-3\n", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			hierarchy := filepath.Join(root, subsysCS)
+			parent := filepath.Join(hierarchy, "batch")
+			group := filepath.Join(parent, "box")
+			files := map[string]string{
+				filepath.Join(hierarchy, "cpuset.cpus"): "0-3\n",
+				filepath.Join(hierarchy, "cpuset.mems"): "0\n",
+				filepath.Join(parent, "cpuset.cpus"):    "",
+				filepath.Join(parent, "cpuset.mems"):    "\n",
+				filepath.Join(group, "cpuset.cpus"):     "",
+				filepath.Join(group, "cpuset.mems"):     "",
+			}
+			for name, data := range files {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cg, err := newCGroup(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cg.roots[subsysCS] = "/"
+			c := &Container{
+				Name:   "box",
+				Pid:    os.Getpid(),
+				CgOpts: &CGroupOptions{Parent: "batch", CpusetCpus: tt.cpus, CpusetMems: tt.mems},
+			}
+
+			writes := traceWrites(t, func() { err = cg.CpuSet(c) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first write joins the cgroup.
+			if want := append([]string{"cgroup.procs=" + strconv.Itoa(c.Pid)}, tt.want...); !reflect.DeepEqual(writes, want) {
+				t.Errorf("wrote %v, want %v", writes, want)
+			}
+			if cg.Paths()[subsysCS] != group {
+				t.Errorf("path %s, want %s", cg.Paths()[subsysCS], group)
+			}
+
+			want := map[string]string{
+				filepath.Join(parent, "cpuset.cpus"): "0-3\n",
+				filepath.Join(parent, "cpuset.mems"): "0\n",
+				filepath.Join(group, "cpuset.cpus"):  tt.wantCpus,
+				filepath.Join(group, "cpuset.mems"):  tt.wantMems,
+			}
+			for name, data := range want {
+				if b, _ := ioutil.ReadFile(name); string(b) != data {
+					t.Errorf("%s = %q, want %q", name, b, data)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckOnline checks cpuset lists against a fake online file of the
+// host with cpus 0-3 and 8, an id not online is dropped unless strict.
+func TestCheckOnline(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "online")
+	if err := ioutil.WriteFile(file, []byte("0-3,8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		list   string
+		file   string // the online file, the fake one if ""
+		strict bool
+		want   string // an error if "invalid"
+	}{
+		{"", "", false, ""},
+		{"0-3", "", false, "0-3"},
+		{"1,3,8", "", true, "1,3,8"},
+		{"0-31", "", false, "0-3,8"},
+		{"0-31", "", true, "invalid"},
+		{"2-5", "", false, "2-3"},
+		{"4-7", "", false, "invalid"},
+		{"3-1", "", false, "invalid"},
+		{"0,1", "missing", false, "0"},
+		{"1", "missing", false, "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list+"/"+strconv.FormatBool(tt.strict), func(t *testing.T) {
+			f := file
+			if tt.file != "" {
+				f = filepath.Join(filepath.Dir(file), tt.file)
+			}
+			got, err := checkOnline("cpus", tt.list, f, tt.strict)
+			if (err != nil) != (tt.want == "invalid") {
+				t.Fatalf("checkOnline = %q, %v, want %q", got, err, tt.want)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("checkOnline = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
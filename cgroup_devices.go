@@ -0,0 +1,34 @@
+package tinybox
+
+import (
+	"fmt"
+)
+
+func init() {
+	registerSetter(&devicesSetter{})
+}
+
+type devicesSetter struct{}
+
+func (d devicesSetter) IsSubsys(typ string) bool {
+	return typ == subsysDEV
+}
+
+func (d devicesSetter) Validate(opt *CGroupOptions) error {
+	return nil
+}
+
+func (d devicesSetter) Write(opt *CGroupOptions, dir string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	// Deny all, then allow the devices the container has.
+	writeLimit(opt, dir, "devices.deny", "a", false)
+	for _, dev := range containerDevices(opt) {
+		writeLimit(opt, dir, "devices.allow", dev.Rule(), false)
+	}
+	return
+}
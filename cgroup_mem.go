@@ -1,5 +1,14 @@
 package tinybox
 
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
 func init() {
 	registerSetter(&defaultMem{})
 }
@@ -11,9 +20,98 @@ func (d defaultMem) IsSubsys(typ string) bool {
 }
 
 func (d defaultMem) Validate(opt *CGroupOptions) error {
+	limit, err := memSize(opt.Memory)
+	if err != nil {
+		return err
+	}
+	reservation, err := memSize(opt.MemoryReservation)
+	if err != nil {
+		return err
+	}
+
+	if limit > 0 || reservation > 0 {
+		total, err := memTotal()
+		if err != nil {
+			return err
+		}
+		if opt.Memory, err = clampMem("limit", opt.Memory, limit, total, opt.StrictLimits); err != nil {
+			return err
+		}
+		if opt.MemoryReservation, err = clampMem("reservation", opt.MemoryReservation, reservation, total, opt.StrictLimits); err != nil {
+			return err
+		}
+		limit, _ = memSize(opt.Memory)
+		reservation, _ = memSize(opt.MemoryReservation)
+	}
+
+	if limit > 0 && reservation > limit {
+		return fmt.Errorf("Memory reservation %s exceeds the memory limit %s", opt.MemoryReservation, opt.Memory)
+	}
 	return nil
 }
 
-func (d defaultMem) Write(opt *CGroupOptions, dir string) error {
-	return nil
+func (d defaultMem) Write(opt *CGroupOptions, dir string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if limit, _ := memSize(opt.Memory); limit > 0 {
+		writeLimit(opt, dir, "memory.limit_in_bytes", strconv.FormatInt(limit, 10), false)
+	}
+	// Under memory pressure the container is reclaimed down to the soft
+	// limit first.
+	if reservation, _ := memSize(opt.MemoryReservation); reservation > 0 {
+		writeLimit(opt, dir, "memory.soft_limit_in_bytes", strconv.FormatInt(reservation, 10), false)
+	}
+	return
+}
+
+// clampMem returns the memory size s of n bytes clamped to the host's
+// total, or an error if it exceeds the total and strict.
+func clampMem(name, s string, n, total int64, strict bool) (string, error) {
+	if total == 0 || n <= total {
+		return s, nil
+	}
+	if strict {
+		return "", fmt.Errorf("Memory %s %s exceeds the host memory of %d bytes", name, s, total)
+	}
+	log.Printf("Memory %s %s clamped to the host memory of %d bytes \n", name, s, total)
+	return strconv.FormatInt(total, 10), nil
+}
+
+// memTotal returns the total memory of the host in bytes, 0 if it's
+// unknown.
+func memTotal() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid MemTotal in /proc/meminfo: %s", fields[1])
+		}
+		return kb << 10, nil
+	}
+	return 0, scanner.Err()
+}
+
+// memSize parses a memory size, an empty one is 0 for not set.
+func memSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return ParseSize(s)
 }
@@ -0,0 +1,93 @@
+package tinybox
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// TestMemWrite writes the memory limit and the reservation as the soft
+// limit, a reservation over the limit is rejected.
+func TestMemWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  CGroupOptions
+		want []string // nil for no writes, an error if "invalid"
+	}{
+		{"none", CGroupOptions{}, nil},
+		{"limit", CGroupOptions{Memory: "64m"}, []string{"memory.limit_in_bytes=67108864"}},
+		{"reservation", CGroupOptions{MemoryReservation: "32m"}, []string{"memory.soft_limit_in_bytes=33554432"}},
+		{"both", CGroupOptions{Memory: "64m", MemoryReservation: "32m"},
+			[]string{"memory.limit_in_bytes=67108864", "memory.soft_limit_in_bytes=33554432"}},
+		{"reservation at the limit", CGroupOptions{Memory: "64m", MemoryReservation: "64m"},
+			[]string{"memory.limit_in_bytes=67108864", "memory.soft_limit_in_bytes=67108864"}},
+		{"reservation over the limit", CGroupOptions{Memory: "32m", MemoryReservation: "64m"}, []string{"invalid"}},
+		{"invalid reservation", CGroupOptions{MemoryReservation: "lots"}, []string{"invalid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := tt.opt
+			err := (defaultMem{}).Validate(&opt)
+			if invalid := reflect.DeepEqual(tt.want, []string{"invalid"}); (err != nil) != invalid {
+				t.Fatalf("Validate = %v, want an error %v", err, invalid)
+			}
+			if err != nil {
+				return
+			}
+
+			dir := t.TempDir()
+			writes := traceWrites(t, func() { err = (defaultMem{}).Write(&opt, dir) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(writes, tt.want) {
+				t.Errorf("wrote %v, want %v", writes, tt.want)
+			}
+		})
+	}
+}
+
+// TestClampMem clamps the memory sizes over the host's total of 1g, or
+// rejects them if strict.
+func TestClampMem(t *testing.T) {
+	const total = 1 << 30
+	tests := []struct {
+		s      string
+		strict bool
+		want   string // an error if "invalid"
+	}{
+		{"512m", false, "512m"},
+		{"1g", true, "1g"},
+		{"2g", false, "1073741824"},
+		{"2g", true, "invalid"},
+	}
+	for _, tt := range tests {
+		n, err := memSize(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := clampMem("limit", tt.s, n, total, tt.strict)
+		if (err != nil) != (tt.want == "invalid") || (err == nil && got != tt.want) {
+			t.Errorf("clampMem(%s, strict %v) = %q, %v, want %q", tt.s, tt.strict, got, err, tt.want)
+		}
+	}
+
+	// An unknown total clamps nothing.
+	if got, err := clampMem("limit", "2g", 2<<30, 0, true); err != nil || got != "2g" {
+		t.Errorf("clampMem with no total = %q, %v", got, err)
+	}
+
+	// The host's own total, a limit over it is clamped before the write.
+	host, err := memTotal()
+	if err != nil || host == 0 {
+		t.Skip("no MemTotal of the host")
+	}
+	opt := CGroupOptions{Memory: strconv.FormatInt(host*2, 10)}
+	if err := (defaultMem{}).Validate(&opt); err != nil || opt.Memory != strconv.FormatInt(host, 10) {
+		t.Errorf("Validate of twice the host memory = %v, limit %s, want %d", err, opt.Memory, host)
+	}
+	opt = CGroupOptions{Memory: strconv.FormatInt(host*2, 10), StrictLimits: true}
+	if err := (defaultMem{}).Validate(&opt); err == nil {
+		t.Error("strict Validate of twice the host memory succeeded")
+	}
+}
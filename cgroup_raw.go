@@ -0,0 +1,90 @@
+package tinybox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// managedSubs are the subsystems the container is placed in.
+var managedSubs = map[string]bool{
+	subsysMEM: true,
+	subsysCPU: true,
+	subsysCA:  true,
+	subsysCS:  true,
+	subsysDEV: true,
+}
+
+// CGroupRaw is a value written as is into a cgroup file, for the kernel
+// knobs not modeled by CGroupOptions.
+type CGroupRaw struct {
+	Subsys string `json:"subsys"`
+	File   string `json:"file"`
+	Value  string `json:"value"`
+}
+
+func (r CGroupRaw) String() string {
+	return fmt.Sprintf("%s:%s=%s", r.Subsys, r.File, r.Value)
+}
+
+// parseCGroupRaw parses --cgroup-raw controller:file=value, like
+// memory:memory.swappiness=10.
+func parseCGroupRaw(s string) (CGroupRaw, error) {
+	var r CGroupRaw
+
+	ix := strings.Index(s, ":")
+	eq := strings.Index(s, "=")
+	if ix <= 0 || eq < ix {
+		return r, fmt.Errorf("Invalid raw cgroup value %s, expect controller:file=value", s)
+	}
+	r.Subsys, r.File, r.Value = s[:ix], s[ix+1:eq], s[eq+1:]
+	return r, r.Validate()
+}
+
+// Validate checks the controller is managed by tinybox, and the file is
+// one of the controller in the container's cgroup dir.
+func (r CGroupRaw) Validate() error {
+	if !managedSubs[r.Subsys] {
+		return fmt.Errorf("Invalid raw cgroup %s, controller %s isn't managed", r, r.Subsys)
+	}
+	if strings.ContainsAny(r.File, "/\x00") || !strings.HasPrefix(r.File, r.Subsys+".") {
+		return fmt.Errorf("Invalid raw cgroup %s, file must be a %s.* file of the cgroup", r, r.Subsys)
+	}
+	return nil
+}
+
+// writeRaw writes the raw values of subsystem typ into dir, it runs after
+// the setters so a raw value overrides a structured limit.
+func writeRaw(opt *CGroupOptions, typ, dir string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	for _, r := range opt.Raw {
+		if r.Subsys == typ {
+			writeLimit(opt, dir, r.File, r.Value, false)
+		}
+	}
+	return
+}
+
+// cgroupRawValue is the --cgroup-raw flag.
+type cgroupRawValue []CGroupRaw
+
+func (v *cgroupRawValue) String() string {
+	var s []string
+	for _, r := range *v {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (v *cgroupRawValue) Set(s string) error {
+	r, err := parseCGroupRaw(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, r)
+	return nil
+}
@@ -0,0 +1,89 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCGroupRaw(t *testing.T) {
+	tests := []struct {
+		in   string
+		want CGroupRaw
+		ok   bool
+	}{
+		{"memory:memory.swappiness=10", CGroupRaw{subsysMEM, "memory.swappiness", "10"}, true},
+		{"cpu:cpu.cfs_period_us=100000", CGroupRaw{subsysCPU, "cpu.cfs_period_us", "100000"}, true},
+		{"memory:memory.oom_control=", CGroupRaw{subsysMEM, "memory.oom_control", ""}, true},
+		{"cpuset:cpuset.mems=0=1", CGroupRaw{subsysCS, "cpuset.mems", "0=1"}, true},
+		{"memory.swappiness=10", CGroupRaw{}, false},
+		{"memory:memory.swappiness", CGroupRaw{}, false},
+		{":memory.swappiness=10", CGroupRaw{}, false},
+		{"blkio:blkio.weight=100", CGroupRaw{}, false},
+		{"memory:cpu.shares=10", CGroupRaw{}, false},
+		{"memory:cgroup.procs=1", CGroupRaw{}, false},
+		{"memory:memory.x/../../cgroup.procs=1", CGroupRaw{}, false},
+		{"memory:../memory.swappiness=10", CGroupRaw{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseCGroupRaw(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseCGroupRaw = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && got != tt.want {
+				t.Errorf("parseCGroupRaw = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWriteRaw writes the limits of a subsystem with raw values, only the
+// raw values of the subsystem are written, after the setters.
+func TestWriteRaw(t *testing.T) {
+	var raw cgroupRawValue
+	for _, s := range []string{"memory:memory.swappiness=10", "cpu:cpu.shares=512", "memory:memory.limit_in_bytes=1024"} {
+		if err := raw.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		subsys string
+		opt    CGroupOptions
+		want   []string
+	}{
+		{subsysMEM, CGroupOptions{Raw: raw}, []string{"memory.swappiness=10", "memory.limit_in_bytes=1024"}},
+		{subsysMEM, CGroupOptions{Memory: "64m", Raw: raw},
+			[]string{"memory.limit_in_bytes=67108864", "memory.swappiness=10", "memory.limit_in_bytes=1024"}},
+		{subsysCPU, CGroupOptions{Raw: raw}, []string{"cpu.shares=", "cpu.cfs_period_us=", "cpu.cfs_quota_us=",
+			"cpu.rt_period_us=", "cpu.rt_runtime_us=", "cpu.shares=512"}},
+		{subsysMEM, CGroupOptions{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subsys, func(t *testing.T) {
+			opt := tt.opt
+			dir := t.TempDir()
+			var err error
+			writes := traceWrites(t, func() { err = setters.Write(tt.subsys, dir, &opt) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(writes, tt.want) {
+				t.Errorf("wrote %v, want %v", writes, tt.want)
+			}
+			if tt.subsys == subsysMEM && len(tt.opt.Raw) > 0 {
+				if data, err := ioutil.ReadFile(filepath.Join(dir, "memory.swappiness")); err != nil || string(data) != "10" {
+					t.Errorf("memory.swappiness = %q, %v, want 10", data, err)
+				}
+			}
+		})
+	}
+
+	// A raw value not written fails the setup, it isn't optional.
+	opt := CGroupOptions{Raw: raw[:1]}
+	if err := setters.Write(subsysMEM, filepath.Join(t.TempDir(), "missing"), &opt); err == nil {
+		t.Error("write into a missing cgroup succeeded")
+	}
+}
@@ -0,0 +1,403 @@
+package tinybox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// traceWrites records the writes of fn like --trace-setup does, as
+// "file=value" by the base name of the file.
+func traceWrites(t *testing.T, fn func()) []string {
+	t.Helper()
+	c := &Container{Name: "trace", Dir: t.TempDir(), TraceSetup: true}
+	startTrace(c, "master")
+	fn()
+	stopTrace()
+
+	recs, err := ReadTrace(filepath.Dir(c.Dir), filepath.Base(c.Dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writes []string
+	for _, rec := range recs {
+		if rec.Call == "write" && len(rec.Args) == 2 {
+			writes = append(writes, filepath.Base(rec.Args[0])+"="+rec.Args[1])
+		}
+	}
+	return writes
+}
+
+func TestWriteLimit(t *testing.T) {
+	dir := t.TempDir()
+	gone := filepath.Join(dir, "gone") // a missing dir fails the write with ENOENT
+
+	tests := []struct {
+		name     string
+		dir      string
+		optional bool
+		strict   bool
+		panics   bool
+		warns    bool
+	}{
+		{"written", dir, false, false, false, false},
+		{"optional skipped", gone, true, false, false, true},
+		{"optional strict", gone, true, true, true, false},
+		{"essential", gone, false, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			opt := &CGroupOptions{Strict: tt.strict}
+			panicked := func() (panicked bool) {
+				defer func() { panicked = recover() != nil }()
+				writeLimit(opt, tt.dir, "memory.memsw.limit_in_bytes", "100", tt.optional)
+				return false
+			}()
+
+			if panicked != tt.panics {
+				t.Errorf("panicked %v, want %v", panicked, tt.panics)
+			}
+			if warned := strings.Contains(buf.String(), "Warning: skip optional cgroup limit"); warned != tt.warns {
+				t.Errorf("warned %v, want %v: %q", warned, tt.warns, buf.String())
+			}
+			if applied := len(opt.Applied) == 1; applied != (tt.dir == dir) {
+				t.Errorf("Applied = %v", opt.Applied)
+			}
+			if tt.dir == dir {
+				if b, err := ioutil.ReadFile(filepath.Join(dir, "memory.memsw.limit_in_bytes")); err != nil || string(b) != "100" {
+					t.Errorf("written %q, %v", b, err)
+				}
+			}
+		})
+	}
+}
+
+// TestCgroupParent places a container under each form of parent, the
+// path must have the parent and be created.
+func TestCgroupParent(t *testing.T) {
+	tests := []struct {
+		parent string
+		want   string // relative to the memory hierarchy, an error if ""
+	}{
+		{"", "tinybox/box"},
+		{"batch", "batch/tinybox/box"},
+		{"/batch/low", "batch/low/tinybox/box"},
+		{"a-b.slice:tb:", "a.slice/a-b.slice/tb-box.scope"},
+		{":tb:web", "system.slice/tb-web.scope"},
+		{"-.slice:tb:", "tb-box.scope"},
+		{"../escape", ""},
+		{"a:b", ""},
+		{"slice:tb:", ""},
+		{"a.slice:t/b:", ""},
+		{"a--b.slice:tb:", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.parent, func(t *testing.T) {
+			err := validateParent(tt.parent)
+			if (err == nil) != (tt.want != "") {
+				t.Fatalf("validateParent = %v, want ok %v", err, tt.want != "")
+			}
+			if err != nil {
+				return
+			}
+
+			root := t.TempDir()
+			if err := os.Mkdir(filepath.Join(root, subsysMEM), 0755); err != nil {
+				t.Fatal(err)
+			}
+			cg, err := newCGroup(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cg.roots[subsysMEM] = "/"
+
+			c := &Container{Name: "box", CgPrefix: "tinybox", CgOpts: &CGroupOptions{Parent: tt.parent}}
+			dir, err := cg.cgroupPath(subsysMEM, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, subsysMEM, tt.want); dir != want {
+				t.Errorf("path = %s, want %s", dir, want)
+			}
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				t.Errorf("cgroup dir not created: %v", err)
+			}
+		})
+	}
+}
+
+// TestCgroupExisting joins a cgroup made beforehand, the pid must be
+// placed there, nothing made under the prefix, and the dir must survive
+// the cleanup of the container.
+func TestCgroupExisting(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		parent   string
+		create   bool // the existing dir is made beforehand
+		valid    bool
+		ok       bool
+	}{
+		{"existing", "/kubepods/pod1", "", true, true, true},
+		{"missing", "/kubepods/pod1", "", false, true, false},
+		{"relative", "kubepods/pod1", "", true, false, false},
+		{"unclean", "/kubepods/../pod1", "", true, false, false},
+		{"with parent", "/kubepods/pod1", "batch", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &CGroupOptions{Existing: tt.existing, Parent: tt.parent}
+			err := validateExisting(opts)
+			if (err == nil) != tt.valid {
+				t.Fatalf("validateExisting = %v, want ok %v", err, tt.valid)
+			}
+			if err != nil {
+				return
+			}
+
+			root := t.TempDir()
+			dir := filepath.Join(root, subsysMEM, tt.existing)
+			if err := os.MkdirAll(filepath.Join(root, subsysMEM), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tt.create {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cg, err := newCGroup(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cg.roots[subsysMEM] = "/"
+
+			c := &Container{
+				Name:     "box",
+				Dir:      t.TempDir(),
+				Pid:      os.Getpid(),
+				CgPrefix: "tinybox",
+				CgOpts:   opts,
+				fsop:     &rootFs{},
+				cgop:     cg,
+			}
+			err = cg.Memory(c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Memory = %v, want ok %v", err, tt.ok)
+			}
+			if _, err := os.Stat(filepath.Join(root, subsysMEM, c.CgPrefix)); !os.IsNotExist(err) {
+				t.Errorf("made a cgroup under the prefix: %v", err)
+			}
+			if err != nil {
+				return
+			}
+
+			if data, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs")); strings.TrimSpace(string(data)) != strconv.Itoa(c.Pid) {
+				t.Errorf("cgroup.procs = %q, want %d", data, c.Pid)
+			}
+			if got := cg.Paths()[subsysMEM]; got != dir {
+				t.Errorf("path = %s, want %s", got, dir)
+			}
+
+			master().cleanup(c)
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				t.Errorf("existing cgroup removed on cleanup: %v", err)
+			}
+		})
+	}
+}
+
+// TestParseMountinfo finds the hierarchies in a fake mountinfo mounted
+// under a temp dir, the cgroups of a container must be made under them.
+func TestParseMountinfo(t *testing.T) {
+	base := t.TempDir()
+	for _, dir := range []string{"mem ory", "cpu,cpuacct", "nested"} {
+		if err := os.Mkdir(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mem := strings.Replace(filepath.Join(base, "mem ory"), " ", `\040`, -1)
+	mountinfo := strings.Join([]string{
+		"23 28 0:22 / /proc rw,relatime - proc proc rw",
+		"32 24 0:28 / " + base + " rw,relatime - tmpfs tmpfs rw,mode=755",
+		"33 32 0:29 / " + mem + " rw,relatime shared:8 - cgroup cgroup rw,memory",
+		"34 32 0:30 / " + base + "/cpu,cpuacct rw,relatime - cgroup cgroup rw,cpu,cpuacct",
+		"35 32 0:31 /docker/abc " + base + "/nested rw,relatime master:3 - cgroup cgroup rw,cpuset",
+		"36 32 0:32 / /sys/fs/cgroup/unified rw,relatime - cgroup2 cgroup2 rw",
+		"bad line",
+	}, "\n")
+
+	mounts, roots, err := parseMountinfo(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMounts := map[string]string{
+		subsysMEM: filepath.Join(base, "mem ory"),
+		subsysCPU: filepath.Join(base, "cpu,cpuacct"),
+		subsysCA:  filepath.Join(base, "cpu,cpuacct"),
+		subsysCS:  filepath.Join(base, "nested"),
+	}
+	wantRoots := map[string]string{subsysMEM: "/", subsysCPU: "/", subsysCA: "/", subsysCS: "/docker/abc"}
+	if !reflect.DeepEqual(mounts, wantMounts) || !reflect.DeepEqual(roots, wantRoots) {
+		t.Fatalf("parseMountinfo = %v, %v, want %v, %v", mounts, roots, wantMounts, wantRoots)
+	}
+
+	// A scan of base finds the same hierarchies by the dir names.
+	scanned, err := scanCgroupRoot(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(wantMounts, subsysMEM)
+	delete(wantMounts, subsysCS)
+	if !reflect.DeepEqual(scanned, wantMounts) {
+		t.Errorf("scanCgroupRoot = %v, want %v", scanned, wantMounts)
+	}
+
+	cg := &CGroup{mounts: mounts, roots: map[string]string{subsysMEM: "/", subsysCPU: "/user", subsysCA: "/user"}, paths: map[string]string{}}
+	c := &Container{Name: "box", Pid: os.Getpid(), CgPrefix: "tinybox", CgOpts: &CGroupOptions{}}
+	for _, fn := range []func(*Container) error{cg.Memory, cg.CPU, cg.CpuAcct} {
+		if err := fn(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantPaths := map[string]string{
+		subsysMEM: filepath.Join(base, "mem ory", "tinybox", "box"),
+		subsysCPU: filepath.Join(base, "cpu,cpuacct", "user", "tinybox", "box"),
+		subsysCA:  filepath.Join(base, "cpu,cpuacct", "user", "tinybox", "box"),
+	}
+	if !reflect.DeepEqual(cg.Paths(), wantPaths) {
+		t.Errorf("Paths = %v, want %v", cg.Paths(), wantPaths)
+	}
+	for _, dir := range cg.Paths() {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs")); strings.TrimSpace(string(data)) != strconv.Itoa(c.Pid) {
+			t.Errorf("%s/cgroup.procs = %q, want %d", dir, data, c.Pid)
+		}
+	}
+}
+
+// TestCgroupStale seeds the cgroup dir of a container with a task left by
+// a previous run, each --cgroup-reuse policy must fail, join or clean it.
+func TestCgroupStale(t *testing.T) {
+	const stalePid = 4194300 // above any pid of the host
+	tests := []struct {
+		name  string
+		reuse string
+		procs string // cgroup.procs left, "-" for no dir
+		err   string // "" for ok
+	}{
+		{"fail", reuseFail, strconv.Itoa(stalePid), "has 1 stale tasks like 4194300, see --cgroup-reuse"},
+		{"fail empty", reuseFail, "", ""},
+		{"fail own pid", reuseFail, strconv.Itoa(os.Getpid()), ""},
+		{"fail no dir", reuseFail, "-", ""},
+		{"reuse", reuseKeep, strconv.Itoa(stalePid), ""},
+		{"clean no dir", reuseClean, "-", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.Mkdir(filepath.Join(root, subsysMEM), 0755); err != nil {
+				t.Fatal(err)
+			}
+			cg, err := newCGroup(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cg.roots[subsysMEM] = "/"
+			dir := filepath.Join(root, subsysMEM, "tinybox", "box")
+			if tt.procs != "-" {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(tt.procs+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := &Container{Name: "box", Pid: os.Getpid(), CgPrefix: "tinybox", CgOpts: &CGroupOptions{Reuse: tt.reuse}}
+			got, err := cg.cgroupPath(subsysMEM, c)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("cgroupPath = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != dir {
+				t.Errorf("cgroupPath = %s, want %s", got, dir)
+			}
+			if data, _ := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs")); tt.procs != "-" && string(data) != tt.procs+"\n" {
+				t.Errorf("cgroup.procs changed to %q", data)
+			}
+		})
+	}
+}
+
+// TestCgroupStaleClean leaves a task in a real memory cgroup, clean must
+// kill it and make the dir again, without the limits of the previous run.
+func TestCgroupStaleClean(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to make a memory cgroup")
+	}
+	cg, err := newCGroup("/sys/fs/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg.roots[subsysMEM] = "/"
+	prefix := "tinybox-test-" + strconv.Itoa(os.Getpid())
+	c := &Container{Name: "box", Pid: os.Getpid(), CgPrefix: prefix, CgOpts: &CGroupOptions{Reuse: reuseClean}}
+	dir, err := cg.groupPath(subsysMEM, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Skip("no memory cgroup: ", err)
+	}
+	defer os.Remove(filepath.Dir(dir))
+	defer os.Remove(dir)
+	if err := WriteFileStr(filepath.Join(dir, "memory.limit_in_bytes"), "64m"); err != nil {
+		t.Fatal(err)
+	}
+	limit, err := ioutil.ReadFile(filepath.Join(filepath.Dir(dir), "memory.limit_in_bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := exec.Command("/bin/sleep", "30")
+	if err := stale.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Process.Kill()
+	if err := joinCgroup(dir, stale.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cg.cgroupPath(subsysMEM, c)
+	if err != nil || got != dir {
+		t.Fatalf("cgroupPath = %s, %v, want %s", got, err, dir)
+	}
+	if err := stale.Wait(); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("stale task exited with %v, want killed", err)
+	}
+	if pids, err := readCgroupPids(dir); err != nil || len(pids) > 0 {
+		t.Errorf("cgroup tasks %v, %v, want none", pids, err)
+	}
+	// The dir is new, it has the limit of its parent.
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "memory.limit_in_bytes")); string(data) != string(limit) {
+		t.Errorf("limit %q, want the reset %q", data, limit)
+	}
+}
@@ -1,17 +1,51 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 
 	"github.com/skoo87/tinybox"
 	_ "github.com/skoo87/tinybox/nsenter"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gc":
+			gc(os.Args[2:])
+			return
+		case "cp":
+			cp(os.Args[2:])
+			return
+		case "export":
+			export(os.Args[2:])
+			return
+		case "wait":
+			wait(os.Args[2:])
+			return
+		case "top":
+			top(os.Args[2:])
+			return
+		case "image":
+			image(os.Args[2:])
+			return
+		case "metrics":
+			metrics(os.Args[2:])
+			return
+		}
+	}
+
 	c, err := tinybox.NewContainer()
 	if err != nil {
 		log.Fatalln(err)
@@ -35,6 +69,159 @@ func main() {
 	log.SetPrefix(typ + ": ")
 
 	if err := c.P.Start(c); err != nil {
+		// The log is in the container's dir, the user sees the master's
+		// error on stderr too.
+		if typ != "init" && typ != "setns" {
+			fmt.Fprintf(os.Stderr, "tinybox: %v\n", err)
+		}
+		log.Fatalln(err)
+	}
+
+	// The master exits with the code of the container, 128+sig if it was
+	// killed by a signal.
+	if c.ExitStatus != nil {
+		os.Exit(c.ExitStatus.Code)
+	}
+}
+
+// tinybox cp <src> <dst>, one of them is name:path in a running container.
+func cp(args []string) {
+	if len(args) != 2 {
+		log.Fatalln("Usage: tinybox cp <src> <dst>, one of them as name:path")
+	}
+
+	if err := tinybox.Copy(os.Getenv("TINYBOX_HOME"), args[0], args[1]); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// tinybox export [--output file] <name>, the tarball is written to stdout
+// without --output.
+func export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("output", "", "Write the tarball to the file instead of stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalln("Usage: tinybox export [--output file] <name>")
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := tinybox.Export(os.Getenv("TINYBOX_HOME"), fs.Arg(0), w); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// tinybox wait <name>, prints the exit status of the container as json
+// once it exits, and exits with its code.
+func wait(args []string) {
+	if len(args) != 1 {
+		log.Fatalln("Usage: tinybox wait <name>")
+	}
+
+	st, err := tinybox.WaitExit(os.Getenv("TINYBOX_HOME"), args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(st); err != nil {
+		log.Fatalln(err)
+	}
+	os.Exit(st.Code)
+}
+
+// tinybox top <name> [ps options], lists the processes of the container,
+// with ps options they're listed by ps.
+func top(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("Usage: tinybox top <name> [ps options]")
+	}
+	home := os.Getenv("TINYBOX_HOME")
+
+	if len(args) > 1 {
+		pids, err := tinybox.ContainerPids(home, args[0])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		list := make([]string, 0, len(pids))
+		for _, pid := range pids {
+			list = append(list, strconv.Itoa(pid))
+		}
+
+		ps := exec.Command("ps", append(args[1:], "-p", strings.Join(list, ","))...)
+		ps.Stdout, ps.Stderr = os.Stdout, os.Stderr
+		if err := ps.Run(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	procs, err := tinybox.Processes(home, args[0])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tNSPID\tPPID\tUSER\tCOMMAND")
+	for _, p := range procs {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\n", p.Pid, p.NSPid, p.PPid, p.User, p.Command)
+	}
+	w.Flush()
+}
+
+// tinybox image import <dir> <name>, dir has the manifest.json and the
+// layers of the image.
+func image(args []string) {
+	if len(args) != 3 || args[0] != "import" {
+		log.Fatalln("Usage: tinybox image import <dir> <name>")
+	}
+
+	if err := tinybox.ImportImage(os.Getenv("TINYBOX_HOME"), args[1], args[2]); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// tinybox metrics [--listen addr], prints the metrics of the running
+// containers, with --listen they're served at /metrics on each scrape.
+func metrics(args []string) {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	listen := fs.String("listen", "", "Serve the metrics at http://addr/metrics instead of printing them")
+	fs.Parse(args)
+	home := os.Getenv("TINYBOX_HOME")
+
+	if *listen == "" {
+		if err := tinybox.Metrics(home, os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := tinybox.Metrics(home, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	log.Fatalln(http.ListenAndServe(*listen, nil))
+}
+
+// tinybox gc [--dry-run]
+func gc(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only report what would be cleaned")
+	fs.Parse(args)
+
+	done, err := tinybox.GC(os.Getenv("TINYBOX_HOME"), *dryRun)
+	for _, action := range done {
+		fmt.Println(action)
+	}
+	if err != nil {
 		log.Fatalln(err)
 	}
 }
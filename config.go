@@ -0,0 +1,361 @@
+package tinybox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config is all needed to create a container, it doesn't depend on the
+// command line or environment, so tinybox can be used as a library.
+type Config struct {
+	Home  string // the dir which holds all containers, like TINYBOX_HOME
+	Name  string
+	Run   bool // create and run a new container
+	Exec  bool // exec Path in the running container Name
+	Force bool // reset the state of a stopped container with the same name
+	Rm    bool // remove the container's dir once it exits
+	Tty   bool // run in a new pty attached to the stdio of the master
+
+	Rootfs        string
+	RootfsTar     string // tarball extracted as the rootfs, can't be set with Rootfs
+	Image         string // imported image the rootfs is copied from, its config gives the defaults
+	Path          string
+	Argv          []string
+	Argv0         string // overrides Argv[0], Path is still the binary run
+	Cwd           string
+	Env           []string
+	EnvUnset      []string
+	NoEnvInherit  bool // exec without the container's env
+	KeepEnv       bool // start from the current environment, not a minimal one
+	Hostname      string
+	ShmSize       string
+	TmpAsTmpfs    bool
+	NoMtab        bool // don't link a missing /etc/mtab to /proc/self/mounts
+	ProcMode      string
+	RootfsSwitch  string // how the root is switched to Rootfs: auto, pivot or move
+	Propagation   string // propagation of the container's root: slave or private
+	Localtime     bool
+	Timezone      string
+	StopSig       string
+	Labels        map[string]string
+	Rlimits       []Rlimit
+	DNS           DNSOptions
+	NetMode       string
+	NetnsPath     string           // where the network namespace is bind mounted for a plugin
+	NetHook       string           // CNI-style plugin run to add and del the container's network
+	TimeOffsets   map[string]int64 // clock offsets in seconds of a time namespace
+	Fds           int
+	Nice          int
+	SchedPolicy   string
+	SchedPriority int
+	NoSetsid      bool
+	Pidfile       string // file the host pid of the init process is written to
+	WaitCmd       string // readiness probe run in the container after start
+	WaitTCP       string // host:port the readiness probe connects to in the container's network
+	WaitHTTP      string // url the readiness probe gets in the container's network
+	TraceSetup    bool   // record the setup calls into the trace file
+	TraceRedact   bool   // replace the rootfs and the dir in the trace
+	ExecAuthzCmd  string // host command which must permit each exec into the container
+	OnOOM         string // host command run with the name and kill count on an OOM kill
+	WaitTimeout   time.Duration
+	Timeout       time.Duration // the container is stopped after it, 0 for never
+	MaxStarts     int           // containers of Home in setup at once, 0 for no limit
+	Secrets       []Secret
+	Volumes       []Volume // anonymous volumes, Source is set at create time
+	VolumesFrom   []VolumesFrom
+	KernelIfaces  []string // kernel interfaces bound read-only, from kernelIfaces
+	CapProfile    string   // named capability set, "" keeps all capabilities
+	CapAdd        []string
+	CapDrop       []string
+	CgOpts        CGroupOptions
+	// ResourceProfile is a named preset of the cpu and memory limits of
+	// CgOpts, the limits set in CgOpts override it.
+	ResourceProfile string
+}
+
+// maxNameLen keeps the name fit in a hostname and a unix socket path.
+const maxNameLen = 64
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// reservedNames are the commands of tinybox, the first arg of a command
+// line can't be both.
+var reservedNames = map[string]bool{
+	"cp":      true,
+	"image":   true,
+	"metrics": true,
+	"export":  true,
+	"gc":      true,
+	"top":     true,
+	"wait":    true,
+}
+
+// validateName checks the name is safe as a dir, a cgroup and a hostname.
+func validateName(name string) error {
+	if name == "" {
+		return ErrOptInvalidName
+	}
+	if len(name) > maxNameLen {
+		return fmt.Errorf("%w %s, longer than %d", ErrOptInvalidName, name, maxNameLen)
+	}
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("%w %s, expect [a-zA-Z0-9][a-zA-Z0-9_.-]*", ErrOptInvalidName, name)
+	}
+	if reservedNames[name] {
+		return fmt.Errorf("%w %s, it's a command", ErrOptInvalidName, name)
+	}
+	return nil
+}
+
+// setDefaults fills the fields not set with the defaults of the command
+// line.
+func (cfg *Config) setDefaults() {
+	defaults := []struct {
+		v   *string
+		def string
+	}{
+		{&cfg.Cwd, "/"},
+		{&cfg.ShmSize, "64m"},
+		{&cfg.ProcMode, procMasked},
+		{&cfg.RootfsSwitch, switchAuto},
+		{&cfg.Propagation, propSlave},
+		{&cfg.StopSig, "SIGTERM"},
+		{&cfg.CgOpts.Reuse, reuseFail},
+		{&cfg.CgOpts.CpuShares, "0"},
+		{&cfg.CgOpts.CpuCfsPeriod, "0"},
+		{&cfg.CgOpts.CpuCfsquota, "0"},
+		{&cfg.CgOpts.CpuRtRuntime, "0"},
+		{&cfg.CgOpts.CpuRtPeriod, "0"},
+	}
+	for _, d := range defaults {
+		if *d.v == "" {
+			*d.v = d.def
+		}
+	}
+	cfg.SchedPolicy = strings.ToUpper(cfg.SchedPolicy)
+
+	// Only a container with a rootfs gets a uts namespace to set it in.
+	if cfg.Hostname == "" && (cfg.Rootfs != "" || cfg.RootfsTar != "" || cfg.Image != "") {
+		cfg.Hostname = defaultHostname(cfg.Name)
+	}
+}
+
+// defaultHostname is the hostname of a container without one, a short id
+// hashed from the name like docker's, so it's the same on each run.
+func defaultHostname(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Validate checks the config of a new container.
+func (cfg *Config) Validate() error {
+	if err := validateName(cfg.Name); err != nil {
+		return err
+	}
+	if !path.IsAbs(cfg.Home) {
+		return fmt.Errorf("Invalid home %s, must be an absolute path", cfg.Home)
+	}
+	if !cfg.Run {
+		return nil
+	}
+
+	if cfg.Path == "" {
+		return ErrOptNoRun
+	}
+	if cfg.Rootfs != "" && !path.IsAbs(cfg.Rootfs) {
+		return ErrOptNoRoot
+	}
+	if cfg.Rootfs != "" && cfg.RootfsTar != "" {
+		return fmt.Errorf("Can't set both rootfs and rootfs tarball")
+	}
+	if cfg.Image != "" && (cfg.Rootfs != "" || cfg.RootfsTar != "") {
+		return fmt.Errorf("Can't set image with rootfs or rootfs tarball")
+	}
+	if !path.IsAbs(cfg.Cwd) {
+		return ErrOptInvalidWd
+	}
+
+	if len(cfg.Hostname) > 64 || strings.ContainsAny(cfg.Hostname, " \t\n/\x00") {
+		return fmt.Errorf("Invalid hostname %s", cfg.Hostname)
+	}
+
+	switch cfg.ProcMode {
+	case procMasked, procRW, procRO:
+	default:
+		return fmt.Errorf("Invalid proc mode %s", cfg.ProcMode)
+	}
+
+	switch cfg.RootfsSwitch {
+	case switchAuto, switchPivot, switchMove:
+	default:
+		return fmt.Errorf("Invalid rootfs switch method %s", cfg.RootfsSwitch)
+	}
+
+	switch cfg.Propagation {
+	case propSlave, propPrivate:
+	default:
+		return fmt.Errorf("Invalid mount propagation %s, expect slave or private", cfg.Propagation)
+	}
+
+	if _, err := ParseSize(cfg.ShmSize); err != nil {
+		return err
+	}
+
+	if cfg.Localtime && cfg.Timezone != "" {
+		return ErrOptTimezone
+	}
+
+	for _, rl := range cfg.Rlimits {
+		if _, ok := rlimits[rl.Name]; !ok {
+			return fmt.Errorf("Unknown rlimit %s", rl.Name)
+		}
+		if rl.Soft > rl.Hard {
+			return fmt.Errorf("Rlimit %s soft limit is greater than hard limit", rl.Name)
+		}
+	}
+
+	if _, err := ParseSignal(cfg.StopSig); err != nil {
+		return err
+	}
+
+	if cfg.Pidfile != "" {
+		if !path.IsAbs(cfg.Pidfile) {
+			return fmt.Errorf("Invalid pidfile %s, must be an absolute path", cfg.Pidfile)
+		}
+		if info, err := os.Stat(path.Dir(cfg.Pidfile)); err != nil || !info.IsDir() {
+			return fmt.Errorf("Invalid pidfile %s, dir %s does not exist", cfg.Pidfile, path.Dir(cfg.Pidfile))
+		}
+	}
+
+	if cfg.OnOOM != "" && !path.IsAbs(cfg.OnOOM) {
+		return fmt.Errorf("Invalid on-oom command %s, must be an absolute path", cfg.OnOOM)
+	}
+
+	if cfg.ExecAuthzCmd != "" && !path.IsAbs(cfg.ExecAuthzCmd) {
+		return fmt.Errorf("Invalid exec authorization command %s, must be an absolute path", cfg.ExecAuthzCmd)
+	}
+
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("Invalid timeout %s", cfg.Timeout)
+	}
+
+	if (cfg.WaitCmd != "" || cfg.WaitTCP != "" || cfg.WaitHTTP != "") && cfg.WaitTimeout <= 0 {
+		return fmt.Errorf("Invalid wait timeout %s", cfg.WaitTimeout)
+	}
+	if err := validateProbes(cfg.WaitTCP, cfg.WaitHTTP); err != nil {
+		return err
+	}
+
+	if err := validateTimeOffsets(cfg.TimeOffsets); err != nil {
+		return err
+	}
+
+	if _, err := resolveCaps(cfg.CapProfile, cfg.CapAdd, cfg.CapDrop); err != nil {
+		return err
+	}
+
+	if err := validateVolumes(cfg.Volumes); err != nil {
+		return err
+	}
+	for _, f := range cfg.VolumesFrom {
+		if err := validateName(f.Name); err != nil {
+			return err
+		}
+		if f.Name == cfg.Name {
+			return fmt.Errorf("Invalid volumes from %s, it's the container itself", f.Name)
+		}
+	}
+
+	if err := validateKernelIfaces(cfg.KernelIfaces); err != nil {
+		return err
+	}
+
+	for i := range cfg.Secrets {
+		if err := cfg.Secrets[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	if cfg.MaxStarts < 0 {
+		return fmt.Errorf("Invalid max concurrent starts %d", cfg.MaxStarts)
+	}
+
+	if cfg.Fds < 0 {
+		return fmt.Errorf("Invalid preserve-fds %d", cfg.Fds)
+	}
+
+	if cfg.CgOpts.Root != "" && !path.IsAbs(cfg.CgOpts.Root) {
+		return fmt.Errorf("Invalid cgroup root %s, must be an absolute path", cfg.CgOpts.Root)
+	}
+	switch cfg.CgOpts.Reuse {
+	case reuseFail, reuseKeep, reuseClean:
+	default:
+		return fmt.Errorf("Invalid cgroup reuse policy %s, expect fail, reuse or clean", cfg.CgOpts.Reuse)
+	}
+	if err := validateParent(cfg.CgOpts.Parent); err != nil {
+		return err
+	}
+	for _, r := range cfg.CgOpts.Raw {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateExisting(&cfg.CgOpts); err != nil {
+		return err
+	}
+
+	if err := validateSched(cfg.Nice, cfg.SchedPolicy, cfg.SchedPriority, &cfg.CgOpts); err != nil {
+		return err
+	}
+
+	if err := validateNetwork(cfg.NetMode, &cfg.DNS, cfg.NetnsPath, cfg.NetHook); err != nil {
+		return err
+	}
+
+	if cfg.Tty && cfg.NoSetsid {
+		return fmt.Errorf("%w: --tty needs the session of the container, it can't be set with --no-setsid", ErrOptConflict)
+	}
+
+	if err := cfg.validateConflicts(); err != nil {
+		return err
+	}
+
+	return cfg.DNS.Validate()
+}
+
+// validateConflicts checks the options which need a namespace the config
+// doesn't get. Without a rootfs the container has no new namespaces, so a
+// mount would land on the host and a private network isn't there.
+func (cfg *Config) validateConflicts() error {
+	if cfg.Rootfs != "" || cfg.RootfsTar != "" || cfg.Image != "" {
+		return nil
+	}
+
+	needRootfs := []struct {
+		set  bool
+		name string
+	}{
+		{cfg.NetMode == netNone, "--network none"},
+		{len(cfg.Volumes) > 0, "--volume"},
+		{len(cfg.VolumesFrom) > 0, "--volumes-from"},
+		{len(cfg.KernelIfaces) > 0, "--expose-kernel-iface"},
+		{len(cfg.CgOpts.Devices) > 0, "--device"},
+		{len(cfg.Secrets) > 0, "--secret"},
+		{cfg.TmpAsTmpfs, "--tmp-as-tmpfs"},
+		{cfg.Localtime || cfg.Timezone != "", "--localtime and --timezone"},
+		{cfg.RootfsSwitch != switchAuto, "--rootfs-switch-method"},
+		{cfg.Propagation != propSlave, "--mount-propagation"},
+	}
+	for _, opt := range needRootfs {
+		if opt.set {
+			return fmt.Errorf("%w: %s needs a rootfs, the container without one shares the host's namespaces", ErrOptConflict, opt.name)
+		}
+	}
+	return nil
+}
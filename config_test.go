@@ -0,0 +1,234 @@
+package tinybox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestNewContainerWithConfig creates containers from a Config only, with
+// no TINYBOX_HOME or command line.
+func TestNewContainerWithConfig(t *testing.T) {
+	if home, ok := os.LookupEnv("TINYBOX_HOME"); ok {
+		os.Unsetenv("TINYBOX_HOME")
+		defer os.Setenv("TINYBOX_HOME", home)
+	}
+	home := t.TempDir()
+	rootfs := t.TempDir()
+
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"minimal", Config{Home: home, Name: "min", Run: true, Path: "/bin/true"}, true},
+		{"rootfs", Config{Home: home, Name: "rootfs", Run: true, Path: "/bin/sh", Rootfs: rootfs, Cwd: "/tmp"}, true},
+		{"no home", Config{Name: "nohome", Run: true, Path: "/bin/true"}, false},
+		{"relative home", Config{Home: "home", Name: "rel", Run: true, Path: "/bin/true"}, false},
+		{"no path", Config{Home: home, Name: "nopath", Run: true}, false},
+		{"relative rootfs", Config{Home: home, Name: "relroot", Run: true, Path: "/bin/true", Rootfs: "rootfs"}, false},
+		{"relative cwd", Config{Home: home, Name: "relcwd", Run: true, Path: "/bin/true", Cwd: "tmp"}, false},
+		{"pidfile", Config{Home: home, Name: "pidfile", Run: true, Path: "/bin/true", Pidfile: filepath.Join(home, "box.pid")}, true},
+		{"relative pidfile", Config{Home: home, Name: "relpid", Run: true, Path: "/bin/true", Pidfile: "box.pid"}, false},
+		{"name with slash", Config{Home: home, Name: "../escape", Run: true, Path: "/bin/true"}, false},
+		{"empty name", Config{Home: home, Run: true, Path: "/bin/true"}, false},
+		{"pidfile in missing dir", Config{Home: home, Name: "nopiddir", Run: true, Path: "/bin/true", Pidfile: filepath.Join(home, "run", "box.pid")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewContainerWithConfig(tt.cfg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("NewContainerWithConfig = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+
+			if want := filepath.Join(home, tt.cfg.Name); c.Dir != want {
+				t.Errorf("Dir = %s, want %s", c.Dir, want)
+			}
+			if info, err := os.Stat(c.Dir); err != nil || !info.IsDir() {
+				t.Errorf("dir of the container not created: %v", err)
+			}
+			if c.Path != tt.cfg.Path || c.Rootfs != tt.cfg.Rootfs {
+				t.Errorf("Path, Rootfs = %s, %s, want %s, %s", c.Path, c.Rootfs, tt.cfg.Path, tt.cfg.Rootfs)
+			}
+
+			cwd := tt.cfg.Cwd
+			if cwd == "" {
+				cwd = "/"
+			}
+			if c.Cwd != cwd || c.ShmSize != "64m" || c.StopSig != "SIGTERM" || c.Propagation != propSlave {
+				t.Errorf("defaults Cwd %s, ShmSize %s, StopSig %s, Propagation %s", c.Cwd, c.ShmSize, c.StopSig, c.Propagation)
+			}
+			if hasHostname := c.Hostname != ""; hasHostname != (tt.cfg.Rootfs != "") {
+				t.Errorf("Hostname = %q, want one only with a rootfs", c.Hostname)
+			}
+		})
+	}
+}
+
+// TestArgv0 runs the test binary by the Path and Argv of a container, it
+// prints the argv[0] it got.
+func TestArgv0(t *testing.T) {
+	if os.Getenv("TINYBOX_TEST_ARGV0") != "" {
+		fmt.Println(os.Args[0])
+		os.Exit(0)
+	}
+
+	home := t.TempDir()
+	tests := []struct {
+		name  string
+		argv  []string
+		argv0 string
+		want  string
+	}{
+		{"override", []string{os.Args[0], "-test.run=^TestArgv0$"}, "mydaemon", "mydaemon"},
+		{"no override", []string{os.Args[0], "-test.run=^TestArgv0$"}, "", os.Args[0]},
+		{"override without argv", nil, "mydaemon", "mydaemon"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewContainerWithConfig(Config{
+				Home:  home,
+				Name:  fmt.Sprintf("argv0-%d", i),
+				Run:   true,
+				Path:  os.Args[0],
+				Argv:  tt.argv,
+				Argv0: tt.argv0,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Path != os.Args[0] {
+				t.Errorf("Path = %s, want the binary %s", c.Path, os.Args[0])
+			}
+			if len(tt.argv) == 0 {
+				// Without -test.run, the binary would run all tests.
+				if len(c.Argv) != 1 || c.Argv[0] != tt.want {
+					t.Errorf("Argv = %q, want [%s]", c.Argv, tt.want)
+				}
+				return
+			}
+
+			cmd := &exec.Cmd{Path: c.Path, Args: c.Argv, Env: append(os.Environ(), "TINYBOX_TEST_ARGV0=1")}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); got != tt.want {
+				t.Errorf("argv[0] = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"web", true},
+		{"Web-1.prod_a", true},
+		{"0box", true},
+		{strings.Repeat("a", maxNameLen), true},
+		{"", false},
+		{strings.Repeat("a", maxNameLen+1), false},
+		{"a/b", false},
+		{"../escape", false},
+		{"/abs", false},
+		{".hidden", false},
+		{"-flag", false},
+		{"_under", false},
+		{"with space", false},
+		{"tab\tname", false},
+		{"a:b", false},
+		{"gc", false},
+		{"cp", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%.20q", tt.name), func(t *testing.T) {
+			err := validateName(tt.name)
+			if (err == nil) != tt.ok {
+				t.Fatalf("validateName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+			}
+			if err != nil && !errors.Is(err, ErrOptInvalidName) {
+				t.Errorf("error %v isn't ErrOptInvalidName", err)
+			}
+		})
+	}
+}
+
+// TestValidateConflicts sets each option needing a rootfs on a config
+// without one, it must fail with the option named.
+func TestValidateConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*Config)
+		want string // in the error, "" for none
+	}{
+		{"none", func(cfg *Config) {}, ""},
+		{"host network", func(cfg *Config) { cfg.NetMode = netHost }, ""},
+		{"network none", func(cfg *Config) { cfg.NetMode = netNone }, "--network none"},
+		{"volume", func(cfg *Config) { cfg.Volumes = []Volume{{Dest: "/data"}} }, "--volume"},
+		{"volumes from", func(cfg *Config) { cfg.VolumesFrom = []VolumesFrom{{Name: "db"}} }, "--volumes-from"},
+		{"kernel iface", func(cfg *Config) { cfg.KernelIfaces = []string{"/sys/kernel/mm"} }, "--expose-kernel-iface"},
+		{"device", func(cfg *Config) { cfg.CgOpts.Devices = []Device{{Path: "/dev/fuse"}} }, "--device"},
+		{"secret", func(cfg *Config) { cfg.Secrets = []Secret{{Name: "token"}} }, "--secret"},
+		{"tmp as tmpfs", func(cfg *Config) { cfg.TmpAsTmpfs = true }, "--tmp-as-tmpfs"},
+		{"localtime", func(cfg *Config) { cfg.Localtime = true }, "--localtime and --timezone"},
+		{"timezone", func(cfg *Config) { cfg.Timezone = "UTC" }, "--localtime and --timezone"},
+		{"rootfs switch", func(cfg *Config) { cfg.RootfsSwitch = switchMove }, "--rootfs-switch-method"},
+		{"propagation", func(cfg *Config) { cfg.Propagation = propPrivate }, "--mount-propagation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, rootfs := range []string{"", "/srv/rootfs"} {
+				cfg := Config{RootfsSwitch: switchAuto, Propagation: propSlave, Rootfs: rootfs}
+				tt.set(&cfg)
+				err := cfg.validateConflicts()
+				if rootfs != "" || tt.want == "" {
+					if err != nil {
+						t.Errorf("rootfs %q: validateConflicts = %v, want ok", rootfs, err)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrOptConflict) || !strings.Contains(err.Error(), tt.want+" needs a rootfs") {
+					t.Errorf("validateConflicts = %v, want %v of %s", err, ErrOptConflict, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestDefaultHostname fills the hostname of a container with a rootfs from
+// its name, the same name gets the same hostname on each run.
+func TestDefaultHostname(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"rootfs", Config{Name: "web", Rootfs: "/rootfs"}, "4b5e57f6eb2f"},
+		{"other name", Config{Name: "web2", Rootfs: "/rootfs"}, "146d3146edc9"},
+		{"rootfs tar", Config{Name: "web", RootfsTar: "/rootfs.tar"}, "4b5e57f6eb2f"},
+		{"image", Config{Name: "web", Image: "busybox"}, "4b5e57f6eb2f"},
+		{"explicit", Config{Name: "web", Rootfs: "/rootfs", Hostname: "box"}, "box"},
+		{"no rootfs", Config{Name: "web"}, ""}, // no uts namespace
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for run := 0; run < 2; run++ {
+				cfg := tt.cfg
+				cfg.setDefaults()
+				if cfg.Hostname != tt.want {
+					t.Errorf("run %d: hostname %q, want %q", run, cfg.Hostname, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -1,18 +1,23 @@
 package tinybox
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type namespaceOper interface {
 	Cloneflags(*Container) uintptr
+	Validate(*Container) error
 	Setup(*Container) error
+	Inspect(*Container) (map[string]bool, error)
 }
 
 type cgroupOper interface {
@@ -22,6 +27,8 @@ type cgroupOper interface {
 	CPU(*Container) error
 	CpuAcct(*Container) error
 	CpuSet(*Container) error
+	Devices(*Container) error
+	BlkIO(*Container) error
 }
 
 type rootfsOper interface {
@@ -34,14 +41,64 @@ type Container struct {
 	Name string `json:"name"` // container's name
 	Dir  string `json:"dir"`
 
-	Rootfs   string         `json:"rootfs"`
-	Path     string         `json:"path"` // the binary path of the first process.
-	Argv     []string       `json:"argv"`
-	Hostname string         `json:"hostname"`
-	CgPrefix string         `json:"cgprefix"`
-	CgOpts   *CGroupOptions `json:"cgopts"`
-
-	Pid int `json:"pid"` // process id of the init process
+	Rootfs        string            `json:"rootfs"`
+	RootfsTar     string            `json:"rootfstar,omitempty"` // the tarball Rootfs is extracted from
+	Image         string            `json:"image,omitempty"`     // the image Rootfs is copied from
+	Profile       string            `json:"profile,omitempty"`   // the resource profile of CgOpts
+	Path          string            `json:"path"`                // the binary path of the first process.
+	Argv          []string          `json:"argv"`
+	Cwd           string            `json:"cwd"` // working directory inside the rootfs.
+	Env           []string          `json:"env,omitempty"`
+	EnvUnset      []string          `json:"envunset,omitempty"` // names removed from the inherited env.
+	KeepEnv       bool              `json:"keepenv,omitempty"`  // start from the environment of tinybox
+	Hostname      string            `json:"hostname"`
+	ShmSize       string            `json:"shmsize"`
+	TmpAsTmpfs    bool              `json:"tmpastmpfs"`
+	Rm            bool              `json:"rm,omitempty"`
+	Tty           bool              `json:"tty,omitempty"`
+	TraceSetup    bool              `json:"tracesetup,omitempty"`
+	TraceRedact   bool              `json:"traceredact,omitempty"`
+	NoMtab        bool              `json:"nomtab,omitempty"`
+	ProcMode      string            `json:"procmode"`
+	RootfsSwitch  string            `json:"rootfsswitch,omitempty"`
+	Propagation   string            `json:"propagation,omitempty"`
+	Localtime     bool              `json:"localtime"` // bind mount the host's /etc/localtime.
+	Timezone      string            `json:"timezone"`
+	StopSig       string            `json:"stopsignal"` // first signal sent to stop the init process.
+	Labels        map[string]string `json:"labels,omitempty"`
+	Rlimits       []Rlimit          `json:"rlimits,omitempty"`
+	DNS           *DNSOptions       `json:"dns,omitempty"`
+	NetMode       string            `json:"netmode,omitempty"`
+	NetnsPath     string            `json:"netnspath,omitempty"`
+	NetHook       string            `json:"nethook,omitempty"`
+	TimeOffsets   map[string]int64  `json:"timeoffsets,omitempty"`
+	Fds           int               `json:"preservefds"` // number of fds passed into the container from fd 3
+	Nice          int               `json:"nice"`
+	SchedPolicy   string            `json:"schedpolicy"`
+	SchedPriority int               `json:"schedpriority"`
+	NoSetsid      bool              `json:"nosetsid"` // don't make the init process a session leader
+	Pidfile       string            `json:"pidfile,omitempty"`
+	WaitCmd       string            `json:"waitcmd,omitempty"`
+	WaitTCP       string            `json:"waittcp,omitempty"`
+	WaitHTTP      string            `json:"waithttp,omitempty"`
+	ExecAuthzCmd  string            `json:"execauthzcmd,omitempty"`
+	OnOOM         string            `json:"onoom,omitempty"`
+	WaitTimeout   time.Duration     `json:"waittimeout,omitempty"`
+	Timeout       time.Duration     `json:"timeout,omitempty"`
+	MaxStarts     int               `json:"maxstarts,omitempty"`
+	Secrets       []Secret          `json:"secrets,omitempty"`
+	Volumes       []Volume          `json:"volumes,omitempty"`
+	KernelIfaces  []string          `json:"kernelifaces,omitempty"`
+	CapProfile    string            `json:"capprofile,omitempty"`
+	CapAdd        []string          `json:"capadd,omitempty"`
+	CapDrop       []string          `json:"capdrop,omitempty"`
+	CgPrefix      string            `json:"cgprefix"`
+	CgOpts        *CGroupOptions    `json:"cgopts"`
+
+	Pid        int             `json:"pid"`                  // process id of the init process
+	StopReason string          `json:"stopreason,omitempty"` // why tinybox stopped the init process
+	ExitStatus *ExitStatus     `json:"exitstatus,omitempty"` // set once the init process exited
+	Namespaces map[string]bool `json:"namespaces,omitempty"` // true for a new namespace, false for the host's
 
 	nsop   namespaceOper `json:"-"`
 	cgop   cgroupOper    `json:"-"`
@@ -58,39 +115,66 @@ func NewContainer() (*Container, error) {
 	}
 
 	home := os.Getenv("TINYBOX_HOME")
+	if os.Args[0] == "setns" {
+		home = os.Getenv(homeEnv)
+	}
 	if !path.IsAbs(home) {
 		return nil, fmt.Errorf("Not found TINYBOX_HOME environment var")
 	}
 
+	cfg := opt.Config()
+	cfg.Home = home
+
+	return NewContainerWithConfig(cfg)
+}
+
+// NewContainerWithConfig creates a container from cfg, it doesn't read
+// the command line or environment.
+func NewContainerWithConfig(cfg Config) (*Container, error) {
+	if err := cfg.applyImage(); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyProfile(); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	c := new(Container)
-	c.Name = opt.name
-	c.Dir = filepath.Join(home, c.Name)
-	c.isExec = opt.IsExec()
+	c.Name = cfg.Name
+	c.Dir = filepath.Join(cfg.Home, c.Name)
+	c.isExec = cfg.Exec
 	c.CgPrefix = "tinybox"
-	c.CgOpts = &opt.cgopts
+	c.CgOpts = &cfg.CgOpts
 
 	if err := MkdirIfNotExist(c.Dir); err != nil {
 		return nil, err
 	}
 
-	// Create named pipe.
-	if _, err := os.Lstat(c.PipeFile()); err != nil {
-		if os.IsNotExist(err) {
-			if err := syscall.Mkfifo(c.PipeFile(), 0); err != nil {
-				return nil, err
-			}
+	if cfg.Run {
+		if err := c.checkExists(cfg.Force); err != nil {
+			return nil, err
 		}
 	}
 
-	if _, err := os.Lstat(c.LockFile()); err != nil {
-		if os.IsNotExist(err) {
-			if _, err := os.Create(c.LockFile()); err != nil {
-				return nil, err
-			}
+	// Create named pipe.
+	if err := c.createPipe(); err != nil {
+		return nil, setupErr("pipe", err)
+	}
+
+	if err := ensureFile(c.LockFile(), 0, func(name string) error {
+		f, err := os.Create(name)
+		if err == nil {
+			f.Close()
 		}
+		return err
+	}); err != nil {
+		return nil, setupErr("lock", err)
 	}
 
-	if opt.IsExec() {
+	if cfg.Exec {
 		info, err := ioutil.ReadFile(c.JsonFile())
 		if err != nil {
 			return nil, err
@@ -98,8 +182,13 @@ func NewContainer() (*Container, error) {
 		if err = json.Unmarshal(info, c); err != nil {
 			return nil, err
 		}
+		if !processAlive(c.Pid) {
+			return nil, fmt.Errorf("%w: %s", ErrNotRunning, c.Name)
+		}
 
-		c.Path = opt.argv
+		c.Path = cfg.Path
+		c.KeepEnv = c.KeepEnv || cfg.KeepEnv
+		c.Env, c.EnvUnset = execEnv(!cfg.NoEnvInherit, c.Env, c.EnvUnset, cfg.Env, cfg.EnvUnset)
 		c.Argv = nil
 		c.Hostname = ""
 		c.Rootfs = ""
@@ -107,14 +196,143 @@ func NewContainer() (*Container, error) {
 		return c, nil
 	}
 
-	c.Rootfs = opt.root
-	c.Path = opt.argv
-	c.Argv = opt.args
-	c.Hostname = opt.hostname
+	c.Rootfs = cfg.Rootfs
+	c.Path = cfg.Path
+	c.Argv = cfg.Argv
+	if cfg.Argv0 != "" {
+		if len(c.Argv) == 0 {
+			c.Argv = []string{c.Path}
+		}
+		c.Argv = append([]string{cfg.Argv0}, c.Argv[1:]...)
+	}
+	c.Cwd = cfg.Cwd
+	c.Env = cfg.Env
+	c.EnvUnset = cfg.EnvUnset
+	c.KeepEnv = cfg.KeepEnv
+	c.Hostname = cfg.Hostname
+	c.ShmSize = cfg.ShmSize
+	c.TmpAsTmpfs = cfg.TmpAsTmpfs
+	c.Rm = cfg.Rm
+	c.Tty = cfg.Tty
+	c.TraceSetup = cfg.TraceSetup
+	c.TraceRedact = cfg.TraceRedact
+	c.Profile = cfg.ResourceProfile
+	c.KernelIfaces = cfg.KernelIfaces
+	c.NoMtab = cfg.NoMtab
+	c.ProcMode = cfg.ProcMode
+	c.RootfsSwitch = cfg.RootfsSwitch
+	c.Propagation = cfg.Propagation
+	c.Localtime = cfg.Localtime
+	c.Timezone = cfg.Timezone
+	c.StopSig = cfg.StopSig
+	c.Labels = cfg.Labels
+	c.Rlimits = cfg.Rlimits
+	c.NetMode = cfg.NetMode
+	c.NetnsPath = cfg.NetnsPath
+	c.NetHook = cfg.NetHook
+	c.TimeOffsets = cfg.TimeOffsets
+	c.Fds = cfg.Fds
+	c.Nice = cfg.Nice
+	c.SchedPolicy = cfg.SchedPolicy
+	c.SchedPriority = cfg.SchedPriority
+	c.NoSetsid = cfg.NoSetsid
+	c.Pidfile = cfg.Pidfile
+	c.WaitCmd = cfg.WaitCmd
+	c.WaitTCP = cfg.WaitTCP
+	c.WaitHTTP = cfg.WaitHTTP
+	c.ExecAuthzCmd = cfg.ExecAuthzCmd
+	c.OnOOM = cfg.OnOOM
+	c.WaitTimeout = cfg.WaitTimeout
+	c.Timeout = cfg.Timeout
+	c.MaxStarts = cfg.MaxStarts
+	c.CapProfile = cfg.CapProfile
+	c.CapAdd = cfg.CapAdd
+	c.CapDrop = cfg.CapDrop
+	if !cfg.DNS.IsEmpty() {
+		c.DNS = &cfg.DNS
+	}
+
+	if len(cfg.Secrets) > 0 {
+		var err error
+		if c.Secrets, err = readSecrets(cfg.Secrets); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.Volumes) > 0 {
+		var err error
+		if c.Volumes, err = c.createVolumes(cfg.Volumes); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.VolumesFrom) > 0 {
+		shared, err := sharedVolumes(cfg.Home, cfg.VolumesFrom)
+		if err != nil {
+			return nil, err
+		}
+		c.Volumes = append(c.Volumes, shared...)
+		if err := validateVolumes(c.Volumes); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Image != "" {
+		c.Image = cfg.Image
+		c.Rootfs = filepath.Join(c.Dir, "rootfs")
+		if err := os.RemoveAll(c.Rootfs); err != nil {
+			return nil, err
+		}
+		if err := cloneRootfs(cfg.Home, c.Image, c.Rootfs); err != nil {
+			return nil, setupErr("image rootfs", err)
+		}
+	}
+
+	if cfg.RootfsTar != "" {
+		c.RootfsTar = cfg.RootfsTar
+		c.Rootfs = filepath.Join(c.Dir, "rootfs")
+		if err := os.RemoveAll(c.Rootfs); err != nil {
+			return nil, err
+		}
+		if err := extractTar(c.RootfsTar, c.Rootfs); err != nil {
+			return nil, setupErr("rootfs tarball", err)
+		}
+	}
 
 	return c, nil
 }
 
+// checkExists fails if a container with the same name is running, a
+// stopped one is reused, or reset if force is set.
+func (c *Container) checkExists(force bool) error {
+	info, err := ioutil.ReadFile(c.JsonFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	old := struct {
+		Pid int `json:"pid"`
+	}{}
+	if err := json.Unmarshal(info, &old); err != nil {
+		if !force {
+			return fmt.Errorf("Container %s has invalid state, use --force to reset it: %v", c.Name, err)
+		}
+	} else if processAlive(old.Pid) {
+		return fmt.Errorf("%w: %s", ErrContainerExists, c.Name)
+	}
+
+	if force {
+		for _, file := range []string{c.JsonFile(), c.PipeFile()} {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Container) SetByType(typ string) error {
 	c.typ = typ
 
@@ -132,8 +350,14 @@ func (c *Container) SetByType(typ string) error {
 		c.P = master()
 
 		var err error
-		if c.cgop, err = newCGroup(); err != nil {
-			return err
+		if c.cgop, err = newCGroup(c.CgOpts.Root); err != nil {
+			return setupErr("cgroup", err)
+		}
+
+		if !c.IsExec() {
+			if err := c.nsop.Validate(c); err != nil {
+				return err
+			}
 		}
 
 		if err := c.cgop.Validate(c); err != nil {
@@ -144,6 +368,15 @@ func (c *Container) SetByType(typ string) error {
 	return nil
 }
 
+// kill sends sig to the init process, or to its whole process group if
+// it leads one.
+func (c *Container) kill(sig syscall.Signal) error {
+	if c.NoSetsid {
+		return syscall.Kill(c.Pid, sig)
+	}
+	return syscall.Kill(-c.Pid, sig)
+}
+
 func (c *Container) IsExec() bool {
 	return c.isExec
 }
@@ -152,26 +385,54 @@ func (c *Container) WaitJson() error {
 	return c.readPipe()
 }
 
-// writePipe write the json of Container into pipe
-func (c *Container) writePipe() error {
-	pipe, err := os.OpenFile(c.PipeFile(), os.O_WRONLY, 0)
-	if err != nil {
-		return fmt.Errorf("Write container pipe: %v", err)
-	}
-	defer pipe.Close()
+// Thresholds of writePipe waiting the init process to read, a slow setup
+// is warned at syncWarn and fails at syncTimeout.
+var (
+	syncWarn    = time.Second * 5
+	syncTimeout = time.Minute
+)
 
-	return json.NewEncoder(pipe).Encode(c)
+// writePipe write the json of Container into pipe, it waits the init
+// process until ctx is done or syncTimeout.
+func (c *Container) writePipe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+
+	ch := c.syncChannel()
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.send(c)
+	}()
+
+	warn := time.NewTimer(syncWarn)
+	defer warn.Stop()
+	check := time.NewTicker(time.Millisecond * 500)
+	defer check.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-warn.C:
+			log.Printf("Warning: init process hasn't read the container after %s \n", syncWarn)
+		case <-check.C:
+			if processExited(c.Pid) {
+				ch.abort()
+				<-done
+				return fmt.Errorf("Init process exited before reading the container")
+			}
+		case <-ctx.Done():
+			ch.abort()
+			<-done
+			return fmt.Errorf("Init process didn't read the container in %s: %v", time.Since(start).Round(time.Millisecond), ctx.Err())
+		}
+	}
 }
 
 // readPipe read the json of Container from pipe
 func (c *Container) readPipe() error {
-	pipe, err := os.OpenFile(c.PipeFile(), os.O_RDONLY, 0)
-	if err != nil {
-		return fmt.Errorf("Read container pipe: %v", err)
-	}
-	defer pipe.Close()
-
-	return json.NewDecoder(pipe).Decode(c)
+	return c.syncChannel().receive(c)
 }
 
 func (c *Container) PipeFile() string {
@@ -182,6 +443,24 @@ func (c *Container) LockFile() string {
 	return filepath.Join(c.Dir, "lock")
 }
 
+// saveJson writes the container's info into its json file.
+func (c *Container) saveJson() error {
+	info, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.JsonFile(), info, 0644)
+}
+
+// writePidfile writes the host pid of the init process to c.Pidfile if
+// set, atomically for the supervisor reading it.
+func (c *Container) writePidfile() error {
+	if c.Pidfile == "" {
+		return nil
+	}
+	return writeFileAtomic(c.Pidfile, []byte(fmt.Sprintf("%d\n", c.Pid)), 0644)
+}
+
 func (c *Container) JsonFile() string {
 	return filepath.Join(c.Dir, "container.json")
 }
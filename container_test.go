@@ -0,0 +1,190 @@
+package tinybox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestCheckExists creates a container over the state of one of the same
+// name: none, a stopped one, a running one.
+func TestCheckExists(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string // container.json, none if ""
+		force bool
+		err   error // errAny for any error
+		reset bool  // the old state is removed
+	}{
+		{"no existing", "", false, nil, false},
+		{"stopped", `{"pid":0}`, false, nil, false},
+		{"stopped forced", `{"pid":0}`, true, nil, true},
+		{"running", `{"pid":PID}`, false, ErrContainerExists, false},
+		{"running forced", `{"pid":PID}`, true, ErrContainerExists, false},
+		{"invalid", `{"pid":`, false, errAny, false},
+		{"invalid forced", `{"pid":`, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Name: "c", Dir: t.TempDir()}
+			if tt.state != "" {
+				state := strings.Replace(tt.state, "PID", strconv.Itoa(os.Getpid()), 1)
+				if err := ioutil.WriteFile(c.JsonFile(), []byte(state), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(c.PipeFile(), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := c.checkExists(tt.force)
+			switch {
+			case tt.err == errAny:
+				if err == nil {
+					t.Fatal("checkExists succeeded, want an error")
+				}
+			case !errors.Is(err, tt.err):
+				t.Fatalf("checkExists = %v, want %v", err, tt.err)
+			}
+
+			_, err = os.Stat(c.JsonFile())
+			if removed := os.IsNotExist(err); tt.state != "" && removed != tt.reset {
+				t.Errorf("state removed %v, want %v", removed, tt.reset)
+			}
+			if _, err := os.Stat(c.PipeFile()); tt.reset && !os.IsNotExist(err) {
+				t.Errorf("pipe kept on a reset")
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+// TestKill signals a session leader with a child like the init process
+// of a container, the child must be signaled too unless NoSetsid.
+func TestKill(t *testing.T) {
+	tests := []struct {
+		name     string
+		noSetsid bool
+	}{
+		{"group", false},
+		{"leader only", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidfile := filepath.Join(t.TempDir(), "child")
+			cmd := exec.Command("/bin/sh", "-c", "sleep 30 & echo $! > "+pidfile+"; wait")
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			var child int
+			for i := 0; i < 100 && child == 0; i++ {
+				data, _ := ioutil.ReadFile(pidfile)
+				child, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+				time.Sleep(time.Millisecond * 10)
+			}
+			if child == 0 {
+				t.Fatal("the child didn't start")
+			}
+			defer syscall.Kill(child, syscall.SIGKILL)
+
+			pid := cmd.Process.Pid
+			if pgid, err := syscall.Getpgid(pid); err != nil || pgid != pid {
+				t.Fatalf("pgid %d, %v, want %d", pgid, err, pid)
+			}
+
+			c := &Container{Pid: pid, NoSetsid: tt.noSetsid}
+			if err := c.kill(syscall.SIGTERM); err != nil {
+				t.Fatal(err)
+			}
+			cmd.Wait()
+
+			// The child is reparented once the leader exits, a zombie whoever
+			// reaps it is dead.
+			alive := true
+			for i := 0; i < 100 && alive; i++ {
+				stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(child) + "/stat")
+				alive = err == nil && !strings.Contains(string(stat), ") Z ")
+				time.Sleep(time.Millisecond * 10)
+			}
+			if alive != tt.noSetsid {
+				t.Errorf("child alive %v, want %v", alive, tt.noSetsid)
+			}
+		})
+	}
+}
+
+// TestWritePipe syncs with an init process reading the container late or
+// never, a slow one is warned but still synced before the hard deadline.
+func TestWritePipe(t *testing.T) {
+	defer func(w, d time.Duration) { syncWarn, syncTimeout = w, d }(syncWarn, syncTimeout)
+	syncWarn, syncTimeout = time.Millisecond*200, time.Second*2
+
+	exited := exec.Command("/bin/true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		pid   int
+		delay time.Duration // the read starts after it, never if 0
+		warn  bool
+		ok    bool
+	}{
+		{"fast", os.Getpid(), time.Millisecond, false, true},
+		{"slow", os.Getpid(), time.Millisecond * 700, true, true},
+		{"never read", os.Getpid(), 0, true, false},
+		// The init process is checked each 500ms, after the warning.
+		{"init exited", exited.Process.Pid, 0, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			c := &Container{Name: "sync", Dir: t.TempDir(), Pid: tt.pid}
+			if err := c.createPipe(); err != nil {
+				t.Fatal(err)
+			}
+			received := make(chan string, 1)
+			if tt.delay > 0 {
+				go func() {
+					time.Sleep(tt.delay)
+					var got Container
+					c.syncChannel().receive(&got)
+					received <- got.Name
+				}()
+			}
+
+			start := time.Now()
+			err := c.writePipe(context.Background())
+			if (err == nil) != tt.ok {
+				t.Fatalf("writePipe = %v, want ok %v", err, tt.ok)
+			}
+			if elapsed := time.Since(start); elapsed > syncTimeout+time.Second {
+				t.Errorf("writePipe took %s, past the deadline %s", elapsed, syncTimeout)
+			}
+			if warned := strings.Contains(buf.String(), "hasn't read the container"); warned != tt.warn {
+				t.Errorf("warned %v, want %v: %s", warned, tt.warn, buf.String())
+			}
+			if tt.ok {
+				if name := <-received; name != c.Name {
+					t.Errorf("received %q, want %q", name, c.Name)
+				}
+			}
+		})
+	}
+}
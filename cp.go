@@ -0,0 +1,196 @@
+package tinybox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Copy copies a file or a dir recursively between the host and a running
+// container, one of src and dst is "name:path" of the container. The path
+// in the container is resolved through /proc/<pid>/root, so it's in the
+// container's mount namespace. If dst is a dir, src is copied into it, a
+// symlink at dst in the container is replaced.
+func Copy(home, src, dst string) error {
+	if !filepath.IsAbs(home) {
+		return fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	sName, sPath := splitCopyArg(src)
+	dName, dPath := splitCopyArg(dst)
+	if (sName == "") == (dName == "") {
+		return fmt.Errorf("Expect one of %s and %s in a container as name:path", src, dst)
+	}
+
+	if sName != "" {
+		var err error
+		if sPath, err = containerPath(home, sName, sPath, true); err != nil {
+			return err
+		}
+		if info, err := os.Stat(dPath); err == nil && info.IsDir() {
+			dPath = filepath.Join(dPath, filepath.Base(sPath))
+		}
+		return copyTree(sPath, dPath)
+	}
+
+	// A symlink at dst in the container is replaced, not followed, and
+	// the path into a dir is walked again for symlinks.
+	host, err := containerPath(home, dName, dPath, false)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(host); err == nil && info.IsDir() {
+		dPath = path.Join(dPath, filepath.Base(sPath))
+		if host, err = containerPath(home, dName, dPath, false); err != nil {
+			return err
+		}
+	}
+	return copyTree(sPath, host)
+}
+
+// splitCopyArg splits "name:path" to the container name and path, a host
+// path has no name.
+func splitCopyArg(arg string) (string, string) {
+	ix := strings.Index(arg, ":")
+	if ix <= 0 || strings.Contains(arg[:ix], "/") {
+		return "", arg
+	}
+	return arg[:ix], arg[ix+1:]
+}
+
+// loadContainer reads the state of the container name under home.
+func loadContainer(home, name string) (*Container, error) {
+	c := &Container{Dir: filepath.Join(home, name)}
+	info, err := ioutil.ReadFile(c.JsonFile())
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(info, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// containerPath returns the host path of p in the running container name.
+// The parents of p in the container must not be symlinks, which would be
+// resolved against the host's root, and p itself neither if it's the
+// source.
+func containerPath(home, name, p string, src bool) (string, error) {
+	c, err := loadContainer(home, name)
+	if err != nil {
+		return "", err
+	}
+	if !processAlive(c.Pid) {
+		return "", fmt.Errorf("%w: %s", ErrNotRunning, name)
+	}
+
+	root := fmt.Sprintf("/proc/%d/root", c.Pid)
+	clean := filepath.Clean("/" + p)
+	if clean == "/" {
+		return root, nil
+	}
+
+	parts := strings.Split(clean[1:], "/")
+	if !src {
+		parts = parts[:len(parts)-1]
+	}
+
+	dir := root
+	for _, part := range parts {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) && !src {
+				break
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Can't copy through symlink %s in container %s", dir[len(root):], name)
+		}
+	}
+	return filepath.Join(root, clean), nil
+}
+
+// copyTree copies src to dst with the permissions, dirs recursively and
+// symlinks as they are. What's at dst is replaced, except a dir.
+func copyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if old, err := os.Lstat(dst); err == nil && !old.IsDir() {
+			return fmt.Errorf("Can't copy dir %s over %s", src, dst)
+		}
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		names, err := readDirNames(src)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := copyTree(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+				return err
+			}
+		}
+
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := removeTarget(dst); err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+
+	case info.Mode().IsRegular():
+		if err := removeTarget(dst); err != nil {
+			return err
+		}
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("Can't copy %s, not a file or dir", src)
+	}
+
+	return os.Chmod(dst, tarMode(info.Mode()))
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
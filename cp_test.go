@@ -0,0 +1,104 @@
+package tinybox
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestCopy copies in and out of a running container, a child of the test
+// chrooted into the rootfs. It's seen through /proc/<pid>/root.
+func TestCopy(t *testing.T) {
+	if root := os.Getenv("TINYBOX_TEST_CP_ROOT"); root != "" {
+		if err := syscall.Chroot(root); err != nil {
+			os.Exit(1)
+		}
+		os.Stdout.WriteString("ready\n")
+		ioutil.ReadAll(os.Stdin)
+		os.Exit(0)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to chroot")
+	}
+
+	home := t.TempDir()
+	rootfs := t.TempDir()
+	for _, dir := range []string{"etc", "data/sub"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(rootfs, "data/sub/log"), []byte("log"), 0640)
+	os.Symlink("/etc", filepath.Join(rootfs, "link"))
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCopy$")
+	cmd.Env = append(os.Environ(), "TINYBOX_TEST_CP_ROOT="+rootfs)
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "ready\n" {
+		t.Fatalf("the container didn't start: %q", line)
+	}
+
+	c := &Container{Name: "box", Dir: filepath.Join(home, "box"), Pid: cmd.Process.Pid}
+	os.Mkdir(c.Dir, 0755)
+	if err := c.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+	host := t.TempDir()
+	conf := filepath.Join(host, "app.conf")
+	ioutil.WriteFile(conf, []byte("conf"), 0600)
+	inside := filepath.Join("/proc", strconv.Itoa(c.Pid), "root")
+
+	tests := []struct {
+		name     string
+		src, dst string
+		file     string // the copied file on the host path, "" for an error
+		data     string
+		mode     os.FileMode
+	}{
+		{"into a file", conf, "box:/etc/app.conf", filepath.Join(inside, "etc/app.conf"), "conf", 0600},
+		{"into a dir", conf, "box:/data", filepath.Join(inside, "data/app.conf"), "conf", 0600},
+		{"dir out", "box:/data", filepath.Join(host, "out"), filepath.Join(host, "out/sub/log"), "log", 0640},
+		{"through a symlink", conf, "box:/link/app.conf", "", "", 0},
+		{"over a symlink", conf, "box:/link", filepath.Join(inside, "link"), "conf", 0600},
+		{"both on the host", conf, filepath.Join(host, "copy"), "", "", 0},
+		{"not running", conf, "gone:/etc/app.conf", "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Copy(home, tt.src, tt.dst)
+			if (err == nil) != (tt.file != "") {
+				t.Fatalf("Copy = %v, want ok %v", err, tt.file != "")
+			}
+			if err != nil {
+				return
+			}
+			info, err := os.Stat(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := ioutil.ReadFile(tt.file); string(data) != tt.data || info.Mode().Perm() != tt.mode {
+				t.Errorf("%s = %q %v, want %q %v", tt.file, data, info.Mode().Perm(), tt.data, tt.mode)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/app.conf")); err != nil {
+		t.Errorf("the copy isn't in the rootfs: %v", err)
+	}
+	if info, err := os.Lstat(filepath.Join(rootfs, "link")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("the symlink in the rootfs isn't replaced: %v", err)
+	}
+	if _, err := os.Lstat("/etc/app.conf"); !os.IsNotExist(err) {
+		t.Errorf("the copy went to the host's /etc")
+	}
+}
@@ -0,0 +1,150 @@
+package tinybox
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type Device struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"` // "b" or "c"
+	Major int64  `json:"major"`
+	Minor int64  `json:"minor"`
+	Perms string `json:"perms"` // devices cgroup permissions, a combination of r, w and m
+	Mode  uint32 `json:"mode"`
+}
+
+// defaultDevices are the nodes every container has and the devices cgroup
+// rules allowing them, a device with no path is only a rule, and a -1
+// number matches any.
+var defaultDevices = []Device{
+	{Type: "c", Major: -1, Minor: -1, Perms: "m"},
+	{Type: "b", Major: -1, Minor: -1, Perms: "m"},
+	{Path: "/dev/null", Type: "c", Major: 1, Minor: 3, Perms: "rwm", Mode: syscall.S_IFCHR | 0666},
+	{Path: "/dev/zero", Type: "c", Major: 1, Minor: 5, Perms: "rwm", Mode: syscall.S_IFCHR | 0666},
+	{Path: "/dev/full", Type: "c", Major: 1, Minor: 7, Perms: "rwm", Mode: syscall.S_IFCHR | 0666},
+	{Path: "/dev/random", Type: "c", Major: 1, Minor: 8, Perms: "rwm", Mode: syscall.S_IFCHR | 0666},
+	{Path: "/dev/urandom", Type: "c", Major: 1, Minor: 9, Perms: "rwm", Mode: syscall.S_IFCHR | 0666},
+	{Path: "/dev/tty", Type: "c", Major: 5, Minor: 0, Perms: "rwm", Mode: syscall.S_IFCHR | 0666},
+	{Type: "c", Major: 5, Minor: 1, Perms: "rwm"},    // /dev/console
+	{Type: "c", Major: 5, Minor: 2, Perms: "rwm"},    // /dev/ptmx
+	{Type: "c", Major: 136, Minor: -1, Perms: "rwm"}, // /dev/pts/*
+}
+
+// containerDevices returns all devices of the container, the defaults and
+// the ones added by --device, both the nodes and the devices cgroup are
+// set up by it, so a node is never denied by the cgroup.
+func containerDevices(opt *CGroupOptions) []Device {
+	devices := make([]Device, 0, len(defaultDevices)+len(opt.Devices))
+	devices = append(devices, defaultDevices...)
+	return append(devices, opt.Devices...)
+}
+
+// parseDevice parses --device path[:rwm], the node is read from the host.
+func parseDevice(s string) (Device, error) {
+	d := Device{Perms: "rwm"}
+
+	fields := strings.SplitN(s, ":", 2)
+	d.Path = filepath.Clean(fields[0])
+	if len(fields) == 2 {
+		d.Perms = fields[1]
+	}
+
+	if !path.IsAbs(d.Path) || !strings.HasPrefix(d.Path, "/dev/") {
+		return d, fmt.Errorf("Invalid device %s, must be under /dev", d.Path)
+	}
+	if d.Perms == "" || strings.Trim(d.Perms, "rwm") != "" {
+		return d, fmt.Errorf("Invalid device permissions %s", d.Perms)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(d.Path, &st); err != nil {
+		return d, fmt.Errorf("Device %s: %v", d.Path, err)
+	}
+
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		d.Type = "b"
+	case syscall.S_IFCHR:
+		d.Type = "c"
+	default:
+		return d, fmt.Errorf("%s is not a device", d.Path)
+	}
+
+	d.Major = int64(devMajor(uint64(st.Rdev)))
+	d.Minor = int64(devMinor(uint64(st.Rdev)))
+	d.Mode = st.Mode
+	return d, nil
+}
+
+// Rule returns the devices cgroup rule of the device.
+func (d Device) Rule() string {
+	num := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%s %s:%s %s", d.Type, num(d.Major), num(d.Minor), d.Perms)
+}
+
+// Mknod creates the device node in dev, the fresh tmpfs on /dev of the
+// container, with the missing dirs of it. A node already made at the path
+// is kept, a --device of a default node is the same device.
+func (d Device) Mknod(dev *os.File) error {
+	if d.Path == "" {
+		return nil
+	}
+
+	name := strings.TrimPrefix(d.Path, "/dev/")
+	dir, err := openInRoot(procPath(dev), path.Dir(name), true)
+	if err != nil {
+		return fmt.Errorf("Mknod %s: %v", d.Path, err)
+	}
+	defer dir.Close()
+
+	num := devMkdev(uint64(d.Major), uint64(d.Minor))
+	err = syscall.Mknodat(int(dir.Fd()), path.Base(name), d.Mode, int(num))
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("Mknod %s: %v", d.Path, err)
+	}
+	return nil
+}
+
+// The numbers of a dev_t like glibc's makedev, a 32-bit major and minor
+// are split around each other.
+func devMajor(dev uint64) uint64 {
+	return (dev>>8)&0xfff | (dev>>32)&0xfffff000
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev&0xff | (dev>>12)&0xffffff00
+}
+
+func devMkdev(major, minor uint64) uint64 {
+	return (major&0xfff)<<8 | (major&0xfffff000)<<32 | minor&0xff | (minor&0xffffff00)<<12
+}
+
+// deviceValue is the --device flag.
+type deviceValue []Device
+
+func (v *deviceValue) String() string {
+	var paths []string
+	for _, d := range *v {
+		paths = append(paths, d.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (v *deviceValue) Set(s string) error {
+	d, err := parseDevice(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, d)
+	return nil
+}
@@ -0,0 +1,218 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseDevice(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Device // Path "" for an error
+	}{
+		{"/dev/null", Device{Path: "/dev/null", Type: "c", Major: 1, Minor: 3, Perms: "rwm"}},
+		{"/dev/null:r", Device{Path: "/dev/null", Type: "c", Major: 1, Minor: 3, Perms: "r"}},
+		{"/dev//zero:rw", Device{Path: "/dev/zero", Type: "c", Major: 1, Minor: 5, Perms: "rw"}},
+		{"/dev/loop0", Device{Path: "/dev/loop0", Type: "b", Major: 7, Minor: 0, Perms: "rwm"}},
+		{"/dev/null:rx", Device{}},
+		{"/dev/null:", Device{}},
+		{"/tmp/null", Device{}},
+		{"dev/null", Device{}},
+		{"/dev/../etc/passwd", Device{}},
+		{"/dev/pts", Device{}},
+		{"/dev/missing", Device{}},
+	}
+	for _, tt := range tests {
+		if tt.want.Type == "b" {
+			if _, err := os.Stat(tt.want.Path); err != nil {
+				continue
+			}
+		}
+		got, err := parseDevice(tt.in)
+		if tt.want.Path == "" {
+			if err == nil {
+				t.Errorf("parseDevice(%q) succeeded, want an error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDevice(%q) = %v", tt.in, err)
+			continue
+		}
+		got.Mode = 0
+		if got != tt.want {
+			t.Errorf("parseDevice(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestDevNumbers round trips the numbers through a dev_t, majors over 255
+// and minors over 255 live in the high bits.
+func TestDevNumbers(t *testing.T) {
+	tests := []struct {
+		major, minor uint64
+		dev          uint64
+	}{
+		{1, 3, 0x103},
+		{8, 17, 0x811},
+		{259, 65536, 0x10010300},
+		{4095, 255, 0xfffff},
+		{4096, 1048575, 0x1000fff000ff},
+	}
+	for _, tt := range tests {
+		dev := devMkdev(tt.major, tt.minor)
+		if dev != tt.dev {
+			t.Errorf("devMkdev(%d, %d) = %#x, want %#x", tt.major, tt.minor, dev, tt.dev)
+		}
+		if devMajor(dev) != tt.major || devMinor(dev) != tt.minor {
+			t.Errorf("dev %#x is %d:%d, want %d:%d", dev, devMajor(dev), devMinor(dev), tt.major, tt.minor)
+		}
+	}
+}
+
+func TestDeviceRule(t *testing.T) {
+	tests := []struct {
+		d    Device
+		want string
+	}{
+		{Device{Type: "c", Major: 1, Minor: 3, Perms: "rwm"}, "c 1:3 rwm"},
+		{Device{Type: "b", Major: 7, Minor: 0, Perms: "r"}, "b 7:0 r"},
+		{Device{Type: "c", Major: 136, Minor: -1, Perms: "rwm"}, "c 136:* rwm"},
+		{Device{Type: "b", Major: -1, Minor: -1, Perms: "m"}, "b *:* m"},
+	}
+	for _, tt := range tests {
+		if got := tt.d.Rule(); got != tt.want {
+			t.Errorf("Rule of %+v = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+// TestMknod creates the node of a device in the dir standing for the /dev
+// tmpfs, the missing dirs too. A node already at the path is kept, it has
+// mode 0600 while a new node doesn't.
+func TestMknod(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mknod")
+	}
+	null, err := parseDevice("/dev/null")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		kept bool
+	}{
+		{"missing", "/dev/null", false},
+		{"in a new dir", "/dev/sub/dir/null", false},
+		{"existing", "/dev/null", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			node := filepath.Join(dir, strings.TrimPrefix(tt.path, "/dev/"))
+			if tt.kept {
+				if err := syscall.Mknod(node, syscall.S_IFCHR|0600, int(devMkdev(1, 3))); err != nil {
+					t.Fatal(err)
+				}
+				os.Chmod(node, 0600)
+			}
+
+			dev, err := os.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dev.Close()
+			d := null
+			d.Path = tt.path
+			if err := d.Mknod(dev); err != nil {
+				t.Fatal(err)
+			}
+			var st syscall.Stat_t
+			if err := syscall.Lstat(node, &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || devMajor(uint64(st.Rdev)) != 1 || devMinor(uint64(st.Rdev)) != 3 {
+				t.Errorf("node is %o %d:%d, want c 1:3", st.Mode, devMajor(uint64(st.Rdev)), devMinor(uint64(st.Rdev)))
+			}
+			if kept := st.Mode&0777 == 0600; kept != tt.kept {
+				t.Errorf("node kept %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+// TestCustomDevice adds a device to a container, its node must be created
+// in /dev and permitted by a devices cgroup, like the defaults.
+func TestCustomDevice(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mknod")
+	}
+	loop, err := parseDevice("/dev/loop0:rw")
+	if err != nil {
+		t.Skip("no /dev/loop0")
+	}
+	devcg := "/sys/fs/cgroup/devices"
+	if _, err := os.Stat(filepath.Join(devcg, "devices.allow")); err != nil {
+		t.Skip("no devices cgroup")
+	}
+
+	opt := &CGroupOptions{Devices: []Device{loop}}
+	rootfs := t.TempDir()
+	dir := filepath.Join(devcg, "tinybox-test-"+strconv.Itoa(os.Getpid()))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dir)
+
+	if err := os.Mkdir(filepath.Join(rootfs, "dev"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	devDir, err := os.Open(filepath.Join(rootfs, "dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devDir.Close()
+	for _, dev := range containerDevices(opt) {
+		if err := dev.Mknod(devDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := (devicesSetter{}).Write(opt, dir); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ioutil.ReadFile(filepath.Join(dir, "devices.list"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := strings.Split(strings.TrimSpace(string(list)), "\n")
+
+	devices := containerDevices(opt)
+	if devices[len(devices)-1] != loop {
+		t.Fatalf("the custom device isn't in the devices of the container")
+	}
+	for _, dev := range devices {
+		if dev.Path != "" {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(filepath.Join(rootfs, dev.Path), &st); err != nil {
+				t.Errorf("no node %s: %v", dev.Path, err)
+			} else if st.Mode&syscall.S_IFMT != dev.Mode&syscall.S_IFMT || int64(devMajor(st.Rdev)) != dev.Major || int64(devMinor(st.Rdev)) != dev.Minor {
+				t.Errorf("node %s isn't %s", dev.Path, dev.Rule())
+			}
+		}
+
+		var ok bool
+		for _, rule := range allowed {
+			ok = ok || rule == dev.Rule()
+		}
+		if !ok {
+			t.Errorf("the cgroup doesn't permit %s, allowed %q", dev.Rule(), allowed)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tinybox
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+type DNSOptions struct {
+	Servers []string `json:"servers,omitempty"`
+	Search  []string `json:"search,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+func (d *DNSOptions) IsEmpty() bool {
+	return len(d.Servers) == 0 && len(d.Search) == 0 && len(d.Options) == 0
+}
+
+func (d *DNSOptions) Validate() error {
+	for _, server := range d.Servers {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("Invalid dns server %s", server)
+		}
+	}
+	for _, domain := range d.Search {
+		if domain == "" || len(domain) > 253 || strings.ContainsAny(domain, " \t\n/") {
+			return fmt.Errorf("Invalid dns search domain %s", domain)
+		}
+	}
+	for _, opt := range d.Options {
+		if opt == "" || strings.ContainsAny(opt, " \t\n") {
+			return fmt.Errorf("Invalid dns option %s", opt)
+		}
+	}
+	return nil
+}
+
+// ResolvConf returns the content of resolv.conf.
+func (d *DNSOptions) ResolvConf() []byte {
+	var buf bytes.Buffer
+	for _, server := range d.Servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", server)
+	}
+	if len(d.Search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(d.Search, " "))
+	}
+	if len(d.Options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(d.Options, " "))
+	}
+	return buf.Bytes()
+}
+
+func (c *Container) ResolvFile() string {
+	return filepath.Join(c.Dir, "resolv.conf")
+}
+
+// mountResolvConf generates resolv.conf in the container's dir and binds
+// it over <rootfs>/etc/resolv.conf, the rootfs itself is left untouched:
+// a symlink is covered, not followed, and without a resolv.conf or with a
+// symlinked etc there's nothing to bind over. With the host network, the
+// host's resolv.conf is bound read-only instead.
+func (fs *rootFs) mountResolvConf(c *Container) error {
+	if !c.hasResolvConf() {
+		return nil
+	}
+
+	target, err := openInRoot(c.Rootfs, "etc/resolv.conf", false)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+		log.Printf("Warning: skip resolv.conf, no file to bind over in rootfs: %v \n", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Bind over /etc/resolv.conf of rootfs: %v", err)
+	}
+	defer target.Close()
+	if info, err := target.Stat(); err != nil || info.IsDir() {
+		return fmt.Errorf("Bind over /etc/resolv.conf of rootfs: not a file")
+	}
+
+	source := c.ResolvFile()
+	if c.NetMode == netHost {
+		source = "/etc/resolv.conf"
+	} else if err := WriteFileStr(source, string(c.DNS.ResolvConf())); err != nil {
+		return err
+	}
+
+	if err := mount(source, procPath(target), "bind", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	if c.NetMode != netHost {
+		return nil
+	}
+
+	// Opened again, the path now leads to the bind.
+	bind, err := openInRoot(c.Rootfs, "etc/resolv.conf", false)
+	if err != nil {
+		return err
+	}
+	defer bind.Close()
+	flag := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+	return mount("", procPath(bind), "", uintptr(flag), "")
+}
+
+// hasResolvConf reports if resolv.conf of the rootfs is bound over.
+func (c *Container) hasResolvConf() bool {
+	return c.NetMode == netHost || (c.DNS != nil && !c.DNS.IsEmpty())
+}
@@ -0,0 +1,140 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestResolvConf(t *testing.T) {
+	tests := []struct {
+		name string
+		dns  DNSOptions
+		want string
+	}{
+		{"empty", DNSOptions{}, ""},
+		{"servers", DNSOptions{Servers: []string{"10.0.0.2", "::1"}}, "nameserver 10.0.0.2\nnameserver ::1\n"},
+		{"search and options", DNSOptions{
+			Servers: []string{"10.0.0.2"},
+			Search:  []string{"svc.local", "local"},
+			Options: []string{"ndots:2", "timeout:1"},
+		}, "nameserver 10.0.0.2\nsearch svc.local local\noptions ndots:2 timeout:1\n"},
+		{"search only", DNSOptions{Search: []string{"local"}}, "search local\n"},
+	}
+	for _, tt := range tests {
+		if err := tt.dns.Validate(); err != nil {
+			t.Errorf("%s: Validate = %v", tt.name, err)
+		}
+		if got := string(tt.dns.ResolvConf()); got != tt.want {
+			t.Errorf("%s: ResolvConf = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateDNS(t *testing.T) {
+	tests := []struct {
+		name string
+		dns  DNSOptions
+	}{
+		{"server", DNSOptions{Servers: []string{"dns.local"}}},
+		{"empty domain", DNSOptions{Search: []string{""}}},
+		{"domain with space", DNSOptions{Search: []string{"a b"}}},
+		{"domain with slash", DNSOptions{Search: []string{"a/b"}}},
+		{"empty option", DNSOptions{Options: []string{""}}},
+		{"option with newline", DNSOptions{Options: []string{"ndots:1\nnameserver 1.1.1.1"}}},
+	}
+	for _, tt := range tests {
+		if err := tt.dns.Validate(); err == nil {
+			t.Errorf("%s: Validate succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestMountResolvConf(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	const conf = "nameserver 10.0.0.2\n"
+	tests := []struct {
+		name string
+		etc  string // "link" symlinks etc to the host dir, "" leaves it out
+		file string // "file", "link" to the host file, or "" for none
+		want string // content seen at etc/resolv.conf, "" if not bound
+	}{
+		{"over file", "dir", "file", conf},
+		{"over symlink", "dir", "link", conf},
+		{"no resolv.conf", "dir", "", ""},
+		{"no etc", "", "", ""},
+		{"symlinked etc", "link", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs, hostDir := t.TempDir(), t.TempDir()
+			hostFile := filepath.Join(hostDir, "resolv.conf")
+			if err := ioutil.WriteFile(hostFile, []byte("host"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			etc := filepath.Join(rootfs, "etc")
+			var err error
+			switch tt.etc {
+			case "dir":
+				err = os.Mkdir(etc, 0755)
+			case "link":
+				err = os.Symlink(hostDir, etc)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := filepath.Join(etc, "resolv.conf")
+			switch tt.file {
+			case "file":
+				err = ioutil.WriteFile(target, []byte("rootfs"), 0644)
+			case "link":
+				err = os.Symlink(hostFile, target)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := &Container{Dir: t.TempDir(), Rootfs: rootfs, DNS: &DNSOptions{Servers: []string{"10.0.0.2"}}}
+			if err := (&rootFs{}).mountResolvConf(c); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != "" {
+				defer syscall.Unmount(target, syscall.MNT_DETACH)
+				if data, err := ioutil.ReadFile(target); err != nil || string(data) != tt.want {
+					t.Errorf("etc/resolv.conf = %q, %v, want %q", data, err, tt.want)
+				}
+				syscall.Unmount(target, syscall.MNT_DETACH)
+			}
+
+			if data, err := ioutil.ReadFile(hostFile); err != nil || string(data) != "host" {
+				t.Errorf("host resolv.conf = %q, %v, want %q", data, err, "host")
+			}
+			if info, err := os.Lstat(hostFile); err != nil || !info.Mode().IsRegular() {
+				t.Errorf("host resolv.conf is no longer a file")
+			}
+			switch tt.file {
+			case "link":
+				if link, _ := os.Readlink(target); link != hostFile {
+					t.Errorf("etc/resolv.conf links to %q, want %s", link, hostFile)
+				}
+			case "":
+				if tt.etc == "dir" {
+					if _, err := os.Lstat(target); !os.IsNotExist(err) {
+						t.Errorf("etc/resolv.conf was created in the rootfs")
+					}
+				}
+			}
+			if tt.etc == "" {
+				if _, err := os.Lstat(etc); !os.IsNotExist(err) {
+					t.Errorf("etc was created in the rootfs")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package tinybox
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// buildEnv returns the container's env at create time, the passthrough
+// variables are copied from the current environment, then --env ones
+// override them.
+func buildEnv(passthrough, env []string) ([]string, error) {
+	var result []string
+	for _, name := range passthrough {
+		if value, ok := os.LookupEnv(name); ok {
+			result = setEnv(result, name+"="+value)
+		}
+	}
+
+	for _, kv := range env {
+		if _, _, err := parseKV(kv); err != nil {
+			return nil, fmt.Errorf("Invalid env %s", kv)
+		}
+		result = setEnv(result, kv)
+	}
+	return result, nil
+}
+
+// mergeEnv overrides base with env, and removes the unset names.
+func mergeEnv(base, env, unset []string) []string {
+	var result []string
+	for _, kv := range base {
+		result = setEnv(result, kv)
+	}
+	for _, kv := range env {
+		result = setEnv(result, kv)
+	}
+	for _, name := range unset {
+		result = unsetEnv(result, name)
+	}
+	return result
+}
+
+// execEnv returns the env and unset names of an exec process. By
+// precedence from low to high, the exec process gets the base env, then
+// the container's env and unset names if inherit is set, then the exec's
+// own env and unset names.
+func execEnv(inherit bool, cEnv, cUnset, env, unset []string) ([]string, []string) {
+	if !inherit {
+		return env, unset
+	}
+
+	result := mergeEnv(cEnv, env, nil)
+
+	// A name set by the exec isn't unset by the container.
+	var names []string
+	for _, name := range cUnset {
+		set := false
+		for _, kv := range env {
+			if strings.HasPrefix(kv, name+"=") {
+				set = true
+				break
+			}
+		}
+		if !set {
+			names = append(names, name)
+		}
+	}
+	return result, append(names, unset...)
+}
+
+// internalEnvPrefix is the prefix of the variables tinybox passes to its
+// own child processes, they never reach the container.
+const internalEnvPrefix = "__TINYBOX_"
+
+// homeEnv passes the home to the setns process, whose env is the
+// container's and has no TINYBOX_HOME.
+const homeEnv = internalEnvPrefix + "HOME__"
+
+// baseEnv returns the env a container process starts from, before the
+// container's env. By default it's a minimal set, with keep it's the
+// current environment like before.
+func baseEnv(keep bool, hostname string) []string {
+	var env []string
+	if keep {
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, internalEnvPrefix) {
+				env = append(env, kv)
+			}
+		}
+		return env
+	}
+
+	env = []string{"PATH=" + defaultPath, "HOME=/root"}
+	if term, ok := os.LookupEnv("TERM"); ok && isTerminal(0) {
+		env = append(env, "TERM="+term)
+	}
+	if hostname != "" {
+		env = append(env, "HOSTNAME="+hostname)
+	}
+	return env
+}
+
+// setEnv sets key=value in env, replacing the old value of key.
+func setEnv(env []string, kv string) []string {
+	key := kv
+	if ix := strings.Index(kv, "="); ix >= 0 {
+		key = kv[:ix]
+	}
+
+	for i, old := range env {
+		if strings.HasPrefix(old, key+"=") {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+func unsetEnv(env []string, key string) []string {
+	result := env[:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key+"=") {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
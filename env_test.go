@@ -0,0 +1,154 @@
+package tinybox
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestBuildEnv passes host variables through, --env overrides them.
+func TestBuildEnv(t *testing.T) {
+	os.Setenv("TINYBOX_TEST_PASS", "host")
+	defer os.Unsetenv("TINYBOX_TEST_PASS")
+	os.Unsetenv("TINYBOX_TEST_MISSING")
+
+	tests := []struct {
+		name string
+		pass []string
+		env  []string
+		want []string
+		ok   bool
+	}{
+		{"none", nil, nil, nil, true},
+		{"passthrough", []string{"TINYBOX_TEST_PASS"}, nil, []string{"TINYBOX_TEST_PASS=host"}, true},
+		{"missing passthrough", []string{"TINYBOX_TEST_MISSING"}, nil, nil, true},
+		{"env overrides passthrough", []string{"TINYBOX_TEST_PASS"}, []string{"TINYBOX_TEST_PASS=env"}, []string{"TINYBOX_TEST_PASS=env"}, true},
+		{"last env wins", nil, []string{"A=1", "B=2", "A=3"}, []string{"A=3", "B=2"}, true},
+		{"empty value", nil, []string{"A="}, []string{"A="}, true},
+		{"invalid", nil, []string{"A"}, nil, false},
+	}
+	for _, tt := range tests {
+		got, err := buildEnv(tt.pass, tt.env)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: buildEnv = %v, %v, want %v, ok %v", tt.name, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestMergeEnv is the env the init process gets from the inherited one.
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  []string
+		env   []string
+		unset []string
+		want  []string
+	}{
+		{"base", []string{"PATH=/bin", "HOME=/root"}, nil, nil, []string{"PATH=/bin", "HOME=/root"}},
+		{"override", []string{"PATH=/bin"}, []string{"PATH=/usr/bin", "A=1"}, nil, []string{"PATH=/usr/bin", "A=1"}},
+		{"unset", []string{"PATH=/bin", "SECRET=x"}, nil, []string{"SECRET"}, []string{"PATH=/bin"}},
+		{"unset a set one", nil, []string{"A=1"}, []string{"A"}, []string{}},
+		{"unset by the full name", []string{"AB=1", "A=2"}, nil, []string{"A"}, []string{"AB=1"}},
+	}
+	for _, tt := range tests {
+		got := mergeEnv(tt.base, tt.env, tt.unset)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mergeEnv = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestExecEnv is the env of an exec process in a container with the env
+// APP=box and HOME unset, with and without inheriting it.
+func TestExecEnv(t *testing.T) {
+	caller := []string{"PATH=/bin", "HOME=/root", "TERM=xterm"}
+	cEnv, cUnset := []string{"APP=box", "MODE=prod"}, []string{"HOME"}
+
+	tests := []struct {
+		name    string
+		inherit bool
+		env     []string
+		unset   []string
+		want    []string
+	}{
+		{"inherit", true, nil, nil, []string{"PATH=/bin", "TERM=xterm", "APP=box", "MODE=prod"}},
+		{"no inherit", false, nil, nil, []string{"PATH=/bin", "HOME=/root", "TERM=xterm"}},
+		{"exec env over the container's", true, []string{"MODE=dev"}, nil, []string{"PATH=/bin", "TERM=xterm", "APP=box", "MODE=dev"}},
+		{"exec sets a name the container unsets", true, []string{"HOME=/home/app"}, nil, []string{"PATH=/bin", "HOME=/home/app", "TERM=xterm", "APP=box", "MODE=prod"}},
+		{"exec unsets the container's", true, nil, []string{"APP"}, []string{"PATH=/bin", "TERM=xterm", "MODE=prod"}},
+		{"exec env without inherit", false, []string{"MODE=dev"}, []string{"TERM"}, []string{"PATH=/bin", "HOME=/root", "MODE=dev"}},
+	}
+	for _, tt := range tests {
+		env, unset := execEnv(tt.inherit, cEnv, cUnset, tt.env, tt.unset)
+		if got := mergeEnv(caller, env, unset); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: env = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestBaseEnv builds the env of a container process with a host variable
+// and an internal one set in the env of tinybox, only keep passes the
+// host's, and never the internal one.
+func TestBaseEnv(t *testing.T) {
+	for k, v := range map[string]string{"TINYBOX_TEST_HOST": "leak", "__TINYBOX_TEST_INTERNAL": "1", "TERM": "xterm"} {
+		if old, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Setenv(k, v)
+	}
+	var term []string
+	if isTerminal(0) {
+		term = []string{"TERM=xterm"}
+	}
+
+	tests := []struct {
+		name     string
+		keep     bool
+		hostname string
+		env      []string
+		has      []string
+		hasNot   []string
+	}{
+		{"minimal", false, "", nil,
+			append([]string{"PATH=" + defaultPath, "HOME=/root"}, term...),
+			[]string{"TINYBOX_TEST_HOST=leak", "__TINYBOX_TEST_INTERNAL=1", "HOSTNAME="}},
+		{"hostname", false, "box", nil, []string{"HOSTNAME=box"}, []string{"TINYBOX_TEST_HOST=leak"}},
+		{"passed explicitly", false, "", []string{"TINYBOX_TEST_HOST=given"}, []string{"TINYBOX_TEST_HOST=given"}, nil},
+		{"keep", true, "box", nil, []string{"TINYBOX_TEST_HOST=leak", "TERM=xterm"},
+			[]string{"__TINYBOX_TEST_INTERNAL=1", "HOSTNAME=box"}},
+		{"keep overridden", true, "", []string{"TINYBOX_TEST_HOST=given", "HOME=/home/app"},
+			[]string{"TINYBOX_TEST_HOST=given", "HOME=/home/app"}, []string{"TINYBOX_TEST_HOST=leak"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := mergeEnv(baseEnv(tt.keep, tt.hostname), tt.env, nil)
+			vars := make(map[string]bool, len(env))
+			for _, kv := range env {
+				vars[kv] = true
+			}
+			for _, kv := range tt.has {
+				if !vars[kv] {
+					t.Errorf("%s not in %q", kv, env)
+				}
+			}
+			for _, kv := range tt.hasNot {
+				for _, got := range env {
+					if strings.HasPrefix(got, kv) {
+						t.Errorf("%s in %q", got, env)
+					}
+				}
+			}
+		})
+	}
+
+	want := append([]string{"PATH=" + defaultPath, "HOME=/root"}, term...)
+	if env := baseEnv(false, ""); !reflect.DeepEqual(env, want) {
+		t.Errorf("minimal env %q, want only %q", env, want)
+	}
+}
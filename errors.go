@@ -0,0 +1,39 @@
+package tinybox
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrContainerExists      = errors.New("Container already exists")
+	ErrNotRunning           = errors.New("Container is not running")
+	ErrCgroupUnsupported    = errors.New("Cgroup subsystem is not supported")
+	ErrNamespaceUnsupported = errors.New("Namespace is not supported")
+	ErrOptConflict          = errors.New("Conflicting options")
+	ErrExecDenied           = errors.New("Exec denied")
+	ErrExecNotFound         = errors.New("executable file not found")
+	ErrExecPermission       = errors.New("permission denied")
+)
+
+// SetupError is returned when a step of the container setup fails.
+type SetupError struct {
+	Step string
+	Err  error
+}
+
+func (e *SetupError) Error() string {
+	return fmt.Sprintf("Setup %s: %v", e.Step, e.Err)
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+// setupErr wraps err in a SetupError of step, nil stays nil.
+func setupErr(step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SetupError{Step: step, Err: err}
+}
@@ -0,0 +1,82 @@
+package tinybox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestErrorsIs matches the errors of the key failures with errors.Is, the
+// way a library user tells them apart.
+func TestErrorsIs(t *testing.T) {
+	home := t.TempDir()
+	for name, pid := range map[string]int{"running": os.Getpid(), "stopped": 0} {
+		if err := os.MkdirAll(filepath.Join(home, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		state := []byte(`{"name":"` + name + `","pid":` + strconv.Itoa(pid) + `}`)
+		if err := ioutil.WriteFile(filepath.Join(home, name, "container.json"), state, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(name string) Config {
+		return Config{Home: home, Name: name, Run: true, Path: "/bin/true", Argv: []string{"/bin/true"}}
+	}
+
+	tests := []struct {
+		name string
+		err  func() error
+		want error
+	}{
+		{"run over a running container", func() error {
+			_, err := NewContainerWithConfig(run("running"))
+			return err
+		}, ErrContainerExists},
+		{"exec in a stopped container", func() error {
+			_, err := NewContainerWithConfig(Config{Home: home, Name: "stopped", Exec: true, Path: "/bin/ls"})
+			return err
+		}, ErrNotRunning},
+		{"pids of a stopped container", func() error {
+			_, err := ContainerPids(home, "stopped")
+			return err
+		}, ErrNotRunning},
+		{"tty without a session", func() error {
+			cfg := run("tty")
+			cfg.Tty, cfg.NoSetsid = true, true
+			_, err := NewContainerWithConfig(cfg)
+			return err
+		}, ErrOptConflict},
+		{"missing cgroup hierarchy", func() error {
+			cg := &CGroup{mounts: map[string]string{}, roots: map[string]string{}}
+			_, err := cg.groupPath(subsysMEM, &Container{Name: "c", CgOpts: &CGroupOptions{}})
+			return err
+		}, ErrCgroupUnsupported},
+		{"setup step", func() error {
+			return setupErr("mount", syscall.EPERM)
+		}, syscall.EPERM},
+	}
+	for _, tt := range tests {
+		if err := tt.err(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSetupError(t *testing.T) {
+	if err := setupErr("mount", nil); err != nil {
+		t.Errorf("setupErr of nil = %v", err)
+	}
+
+	err := setupErr("cgroup", ErrCgroupUnsupported)
+	var setup *SetupError
+	if !errors.As(err, &setup) || setup.Step != "cgroup" {
+		t.Fatalf("errors.As(%v) didn't find the step", err)
+	}
+	if want := "Setup cgroup: " + ErrCgroupUnsupported.Error(); err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
@@ -0,0 +1,94 @@
+package tinybox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// ExitStatus is how the init process of a container exited, it's kept in
+// the container's dir after tinybox has exited.
+type ExitStatus struct {
+	Code      int       `json:"code"` // 128+signal if signaled, like a shell
+	Signaled  bool      `json:"signaled"`
+	Signal    string    `json:"signal,omitempty"`
+	SignalNum int       `json:"signum,omitempty"`
+	OOMKilled bool      `json:"oomkilled"`        // killed by the OOM killer of its memory cgroup
+	Reason    string    `json:"reason,omitempty"` // set if tinybox stopped it, like timeout
+	Time      time.Time `json:"time"`
+}
+
+func (c *Container) ExitStatusFile() string {
+	return filepath.Join(c.Dir, "exit_status")
+}
+
+// stopTimedOut is the reason of a container stopped at its --timeout.
+const stopTimedOut = "timeout"
+
+// newExitStatus returns the exit status of the wait status ws, the init
+// process is OOM killed only if it got a SIGKILL and the memory cgroup
+// had a kill, oomKills is the count of them.
+func newExitStatus(ws syscall.WaitStatus, reason string, oomKills int64) *ExitStatus {
+	st := &ExitStatus{Code: ws.ExitStatus(), Reason: reason, Time: time.Now()}
+	if ws.Signaled() {
+		st.Code = 128 + int(ws.Signal())
+		st.Signaled = true
+		st.Signal = signalName(ws.Signal())
+		st.SignalNum = int(ws.Signal())
+		st.OOMKilled = ws.Signal() == syscall.SIGKILL && oomKills > 0
+	}
+	return st
+}
+
+// writeExitStatus writes the exit status of the init process atomically,
+// so a poller never reads a partial file.
+func (c *Container) writeExitStatus(st *ExitStatus) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.ExitStatusFile(), data, 0644)
+}
+
+// WaitExit waits the container name under home to exit and returns its
+// exit status, the container may have exited already.
+func WaitExit(home, name string) (*ExitStatus, error) {
+	if !filepath.IsAbs(home) {
+		return nil, fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	c, err := loadContainer(home, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The status is written by the master shortly after the init process
+	// exits, it's given stopTimeout to do so.
+	var exited time.Time
+	for {
+		data, err := ioutil.ReadFile(c.ExitStatusFile())
+		if err == nil {
+			st := new(ExitStatus)
+			if err := json.Unmarshal(data, st); err != nil {
+				return nil, fmt.Errorf("Invalid exit status of %s: %v", name, err)
+			}
+			return st, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if processAlive(c.Pid) {
+			exited = time.Time{}
+		} else if exited.IsZero() {
+			exited = time.Now()
+		} else if time.Since(exited) > stopTimeout {
+			return nil, fmt.Errorf("Container %s exited without an exit status", name)
+		}
+		time.Sleep(probeInterval)
+	}
+}
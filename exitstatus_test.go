@@ -0,0 +1,185 @@
+package tinybox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestWaitExit runs an init process to its exit and cleans up after it
+// like the master, the exit status must be read back from exit_status
+// once the master is gone.
+func TestWaitExit(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		code     int
+		signaled bool
+		signal   string
+	}{
+		{"exit code", "exit 3", 3, false, ""},
+		{"success", "exit 0", 0, false, ""},
+		{"signaled", "kill -TERM $$", 128 + 15, true, "SIGTERM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			c := &Container{
+				Name:   "job",
+				Dir:    filepath.Join(home, "job"),
+				CgOpts: &CGroupOptions{},
+				fsop:   &rootFs{},
+				cgop:   &CGroup{paths: map[string]string{}},
+			}
+			if err := os.Mkdir(c.Dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			c.Pid = cmd.Process.Pid
+			if err := c.saveJson(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A waiter started while the container runs gets the status
+			// written at its exit.
+			done := make(chan *ExitStatus, 1)
+			go func() {
+				st, err := WaitExit(home, c.Name)
+				if err != nil {
+					t.Error(err)
+				}
+				done <- st
+			}()
+
+			cmd.Wait()
+			p := master()
+			p.status = cmd.ProcessState.Sys().(syscall.WaitStatus)
+			p.cleanup(c)
+
+			var st *ExitStatus
+			select {
+			case st = <-done:
+			case <-time.After(time.Second * 5):
+				t.Fatal("WaitExit didn't return after the exit")
+			}
+			if st == nil {
+				return
+			}
+			if st.Code != tt.code || st.Signaled != tt.signaled || st.Signal != tt.signal {
+				t.Errorf("exit status %+v, want code %d signaled %v %s", st, tt.code, tt.signaled, tt.signal)
+			}
+
+			// It's still there after the waiter and the master are gone.
+			data, err := ioutil.ReadFile(c.ExitStatusFile())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved ExitStatus
+			if err := json.Unmarshal(data, &saved); err != nil || saved.Code != tt.code {
+				t.Errorf("exit_status = %s, %v, want code %d", data, err, tt.code)
+			}
+		})
+	}
+}
+
+// TestWaitExitMissing waits a container which exited without a status,
+// the wait must give up after stopTimeout.
+func TestWaitExitMissing(t *testing.T) {
+	defer func(d time.Duration) { stopTimeout = d }(stopTimeout)
+	stopTimeout = time.Millisecond * 300
+
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	c := &Container{Name: "lost", Dir: filepath.Join(home, "lost"), Pid: cmd.Process.Pid}
+	if err := os.Mkdir(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err := WaitExit(home, c.Name); err == nil {
+		t.Errorf("WaitExit = %+v, want an error", st)
+	}
+	if _, err := WaitExit("home", c.Name); err == nil {
+		t.Error("WaitExit of a relative home succeeded")
+	}
+}
+
+func TestNewExitStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		ws    syscall.WaitStatus
+		kills int64
+		want  ExitStatus
+	}{
+		{"exit code", 3 << 8, 0, ExitStatus{Code: 3}},
+		{"exit code with kills", 3 << 8, 1, ExitStatus{Code: 3}},
+		{"killed", syscall.WaitStatus(syscall.SIGKILL), 0,
+			ExitStatus{Code: 137, Signaled: true, Signal: "SIGKILL", SignalNum: 9}},
+		{"oom killed", syscall.WaitStatus(syscall.SIGKILL), 2,
+			ExitStatus{Code: 137, Signaled: true, Signal: "SIGKILL", SignalNum: 9, OOMKilled: true}},
+		{"terminated with kills", syscall.WaitStatus(syscall.SIGTERM), 1,
+			ExitStatus{Code: 143, Signaled: true, Signal: "SIGTERM", SignalNum: 15}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newExitStatus(tt.ws, "", tt.kills)
+			got.Time = time.Time{}
+			if *got != tt.want {
+				t.Errorf("newExitStatus = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestExitStatusKilled kills a running init process with SIGKILL, the
+// recorded status must be the signal, not an exit code.
+func TestExitStatusKilled(t *testing.T) {
+	home := t.TempDir()
+	c := &Container{
+		Name:   "killed",
+		Dir:    filepath.Join(home, "killed"),
+		CgOpts: &CGroupOptions{},
+		fsop:   &rootFs{},
+		cgop:   &CGroup{paths: map[string]string{}},
+	}
+	if err := os.Mkdir(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	c.Pid = cmd.Process.Pid
+	cmd.Process.Kill()
+	cmd.Wait()
+
+	p := master()
+	p.status = cmd.ProcessState.Sys().(syscall.WaitStatus)
+	p.cleanup(c)
+
+	st, err := WaitExit(home, c.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Signaled || st.Signal != "SIGKILL" || st.SignalNum != 9 || st.Code != 137 || st.OOMKilled {
+		t.Errorf("exit status %+v, want killed by SIGKILL", st)
+	}
+	saved, err := loadContainer(home, c.Name)
+	if err != nil || saved.ExitStatus == nil || saved.ExitStatus.Signal != "SIGKILL" {
+		t.Errorf("container.json exit status %+v, %v, want SIGKILL", saved.ExitStatus, err)
+	}
+}
@@ -0,0 +1,78 @@
+package tinybox
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Export writes the rootfs of the container name under home to w as a
+// tarball, the container may be stopped. Sockets are skipped.
+func Export(home, name string, w io.Writer) error {
+	if !filepath.IsAbs(home) {
+		return fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	c, err := loadContainer(home, name)
+	if err != nil {
+		return err
+	}
+	if c.Rootfs == "" || c.Rootfs == "/" {
+		return fmt.Errorf("Container %s has no rootfs to export", name)
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTar(tw, c.Rootfs); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTar writes the tree of root into tw, the names are relative to
+// root, and symlinks aren't followed.
+func writeTar(tw *tar.Writer, root string) error {
+	return filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
@@ -0,0 +1,127 @@
+package tinybox
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestExport changes the rootfs of a stopped container, the export has
+// the changes, a removed file is gone and a socket is skipped.
+func TestExport(t *testing.T) {
+	tests := []struct {
+		name   string
+		rootfs string // "" for a tree under the container's dir
+		home   string // "" for a temp dir
+		want   map[string]string
+		ok     bool
+	}{
+		{"changed rootfs", "", "", map[string]string{
+			"etc/":         "",
+			"etc/hostname": "changed",
+			"etc/new":      "added",
+			"bin/":         "",
+			"bin/sh":       "-> busybox",
+		}, true},
+		{"host root", "/", "", nil, false},
+		{"relative home", "/rootfs", "home", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := tt.home
+			if home == "" {
+				home = t.TempDir()
+			}
+			c := &Container{Name: "exp", Dir: filepath.Join(home, "exp"), Rootfs: tt.rootfs}
+			if c.Rootfs == "" {
+				c.Rootfs = filepath.Join(c.Dir, "rootfs")
+				seedExportRootfs(t, c.Rootfs)
+			}
+			if filepath.IsAbs(home) {
+				if err := os.MkdirAll(c.Dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := c.saveJson(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+			err := Export(home, c.Name, &buf)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Export = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+
+			got := map[string]string{}
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch hdr.Typeflag {
+				case tar.TypeSymlink:
+					got[hdr.Name] = "-> " + hdr.Linkname
+				default:
+					data, err := ioutil.ReadAll(tr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got[hdr.Name] = string(data)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exported %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// seedExportRootfs makes a rootfs, then changes a file, adds one, removes
+// one and leaves a socket in it.
+func seedExportRootfs(t *testing.T, rootfs string) {
+	t.Helper()
+	for _, dir := range []string{"etc", "bin"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{
+		"etc/hostname": "orig",
+		"etc/removed":  "gone",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("busybox", filepath.Join(rootfs, "bin/sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/hostname"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "etc/new"), []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(rootfs, "etc/removed")); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", filepath.Join(rootfs, "etc/sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+}
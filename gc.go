@@ -0,0 +1,233 @@
+package tinybox
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// GC cleans up the containers under home whose init process is dead: it
+// unmounts anything left under their dirs, removes their cgroup dirs and
+// deletes their state. With a journal, only what it records as
+// set up is rolled back. Running containers are never touched. It
+// returns what's cleaned, or would be with dryRun.
+func GC(home string, dryRun bool) ([]string, error) {
+	if !filepath.IsAbs(home) {
+		return nil, fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	entries, err := ioutil.ReadDir(home)
+	if err != nil {
+		return nil, err
+	}
+
+	cg, err := newCGroup("")
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		c, err := loadContainer(home, entry.Name())
+		if err != nil {
+			continue
+		}
+		if c.Name != entry.Name() || processAlive(c.Pid) {
+			continue
+		}
+
+		ccg := cg
+		if c.CgOpts != nil && c.CgOpts.Root != "" {
+			if ccg, err = newCGroup(c.CgOpts.Root); err != nil {
+				return done, err
+			}
+		}
+
+		actions, err := gcContainer(c, ccg, dryRun)
+		done = append(done, actions...)
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func gcContainer(c *Container, cg *CGroup, dryRun bool) ([]string, error) {
+	var actions []string
+
+	mounts, cgroups, ok := c.rollback()
+	if ok {
+		// Roll back what the journal records, if it's still there.
+		var err error
+		if mounts, err = mounted(mounts); err != nil {
+			return nil, err
+		}
+	} else {
+		// The container's mounts are in its own namespace, the mounts a
+		// host scan finds under a user's rootfs aren't its to remove.
+		// Only the ones under its dir, like a tarball rootfs, are.
+		var err error
+		if mounts, err = mountsUnder(c.Dir, true); err != nil {
+			return nil, err
+		}
+
+		// Without the cgroup options the paths aren't known, and an
+		// existing cgroup isn't the container's.
+		if c.CgOpts != nil && c.CgOpts.Existing == "" {
+			for _, name := range subs {
+				if dir, err := cg.groupPath(name, c); err == nil {
+					cgroups = append(cgroups, dir)
+				}
+			}
+		}
+	}
+	sortMounts(mounts)
+
+	for _, mount := range mounts {
+		actions = append(actions, fmt.Sprintf("unmount %s", mount))
+		if dryRun {
+			continue
+		}
+		if err := syscall.Unmount(mount, syscall.MNT_DETACH); err != nil {
+			return actions, fmt.Errorf("Unmount %s: %v", mount, err)
+		}
+	}
+
+	for _, dir := range cgroups {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		actions = append(actions, fmt.Sprintf("remove cgroup %s", dir))
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(dir); err != nil {
+			return actions, err
+		}
+	}
+
+	// Its volumes are still shared into other containers.
+	if len(c.Volumes) > 0 {
+		users, err := volumeUsers(filepath.Dir(c.Dir), c.Name)
+		if err != nil {
+			return actions, err
+		}
+		if len(users) > 0 {
+			return append(actions, fmt.Sprintf("keep state %s, its volumes are used by %s", c.Dir, strings.Join(users, ","))), nil
+		}
+	}
+
+	actions = append(actions, fmt.Sprintf("remove state %s", c.Dir))
+	if dryRun {
+		return actions, nil
+	}
+
+	// Never remove the dir through a mount point.
+	if mounts, err := mountsUnder(c.Dir, true); err != nil || len(mounts) > 0 {
+		return actions, fmt.Errorf("Dir %s still has mounts", c.Dir)
+	}
+	return actions, os.RemoveAll(c.Dir)
+}
+
+// mountsUnder returns the mount points under dir, and dir itself if self
+// is set.
+func mountsUnder(dir string, self bool) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	all, err := mountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []string
+	for _, mount := range all {
+		if (self && mount == dir) || strings.HasPrefix(mount, dir+"/") {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	sortMounts(mounts)
+	return mounts, nil
+}
+
+// mounted returns the mount points of mounts which are still mounted.
+func mounted(mounts []string) ([]string, error) {
+	all, err := mountPoints()
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool, len(all))
+	for _, mount := range all {
+		set[mount] = true
+	}
+
+	var still []string
+	for _, mount := range mounts {
+		if set[mount] {
+			still = append(still, mount)
+		}
+	}
+	return still, nil
+}
+
+// mountPoints returns all mount points in /proc/self/mountinfo.
+func mountPoints() ([]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMount(fields[4]))
+	}
+	return mounts, scanner.Err()
+}
+
+// sortMounts sorts the mount points deepest first, so they can be
+// unmounted in order.
+func sortMounts(mounts []string) {
+	sort.Slice(mounts, func(i, j int) bool {
+		return len(mounts[i]) > len(mounts[j])
+	})
+}
+
+// unescapeMount decodes the octal escapes (like \040 for space) of a path
+// in mountinfo.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var v byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &v); err == nil {
+				b.WriteByte(v)
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
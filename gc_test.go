@@ -0,0 +1,86 @@
+package tinybox
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// TestGC seeds a leaked mount and cgroup of a container, gc must clean
+// them up once its init is dead and leave a running one intact.
+func TestGC(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	dead := cmd.Process.Pid
+
+	tests := []struct {
+		name   string
+		pid    int
+		dryRun bool
+		clean  bool // the mount, cgroup and state are gone
+	}{
+		{"dead", dead, false, true},
+		{"dead dry run", dead, true, false},
+		{"running", os.Getpid(), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			cgroot := t.TempDir()
+			c := &Container{
+				Name:   "leak",
+				Dir:    filepath.Join(home, "leak"),
+				Pid:    tt.pid,
+				CgOpts: &CGroupOptions{Root: cgroot},
+			}
+			cgdir := filepath.Join(cgroot, subsysMEM, c.Name)
+			rootfs := filepath.Join(c.Dir, "rootfs")
+			for _, dir := range []string{cgdir, rootfs} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.saveJson(); err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Mount("tmpfs", rootfs, "tmpfs", 0, "size=64k"); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Unmount(rootfs, syscall.MNT_DETACH)
+
+			actions, err := GC(home, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			if tt.pid == dead {
+				want = []string{"unmount " + rootfs, "remove cgroup " + cgdir, "remove state " + c.Dir}
+			}
+			if !reflect.DeepEqual(actions, want) {
+				t.Errorf("actions = %q, want %q", actions, want)
+			}
+
+			mounts, err := mountsUnder(rootfs, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(mounts) == 0) != tt.clean {
+				t.Errorf("mounts left %v, want cleaned %v", mounts, tt.clean)
+			}
+			for _, p := range []string{cgdir, c.Dir} {
+				if _, err := os.Stat(p); os.IsNotExist(err) != tt.clean {
+					t.Errorf("%s removed %v, want %v", p, os.IsNotExist(err), tt.clean)
+				}
+			}
+		})
+	}
+}
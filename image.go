@@ -0,0 +1,156 @@
+package tinybox
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// imagesDir holds the imported images in the home, its name can't be a
+// container's.
+const imagesDir = ".images"
+
+// ImageConfig is the config embedded in an image, the defaults of a
+// container run from it.
+type ImageConfig struct {
+	Env     []string `json:"env,omitempty"`
+	Cmd     []string `json:"cmd,omitempty"`
+	Workdir string   `json:"workdir,omitempty"`
+	User    string   `json:"user,omitempty"`
+}
+
+// imageManifest is the manifest.json of an image dir, the layers are
+// tarballs relative to the dir, from the lowest one.
+type imageManifest struct {
+	Layers []string    `json:"layers"`
+	Config ImageConfig `json:"config"`
+}
+
+func imageDir(home, name string) string {
+	return filepath.Join(home, imagesDir, name)
+}
+
+// ImportImage unpacks the image in dir src into an image name under home,
+// the layers are applied in order with their whiteouts. An image of the
+// same name is replaced.
+func ImportImage(home, src, name string) error {
+	if !filepath.IsAbs(home) {
+		return fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+	if !namePattern.MatchString(name) || len(name) > maxNameLen {
+		return fmt.Errorf("Invalid image name %s", name)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(src, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	var m imageManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("Invalid manifest of %s: %v", src, err)
+	}
+	if len(m.Layers) == 0 {
+		return fmt.Errorf("Image %s has no layers", src)
+	}
+
+	// Unpack aside, so a failed import leaves the old image.
+	dir := imageDir(home, name)
+	tmp := filepath.Join(home, imagesDir, "."+name)
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, layer := range m.Layers {
+		if filepath.IsAbs(layer) || filepath.Clean(layer) != layer || layer == ".." || filepath.Dir(layer) != "." {
+			return fmt.Errorf("Invalid layer %s, must be a file in the image dir", layer)
+		}
+		f, err := os.Open(filepath.Join(src, layer))
+		if err != nil {
+			return err
+		}
+		err = untar(f, filepath.Join(tmp, "rootfs"), true)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Unpack layer %s: %v", layer, err)
+		}
+	}
+
+	config, err := json.Marshal(&m.Config)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "config.json"), config, 0644); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// loadImage reads the config of the image name under home.
+func loadImage(home, name string) (*ImageConfig, error) {
+	data, err := ioutil.ReadFile(filepath.Join(imageDir(home, name), "config.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("Not found image %s", name)
+		}
+		return nil, err
+	}
+	config := new(ImageConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Invalid config of image %s: %v", name, err)
+	}
+	return config, nil
+}
+
+// applyImage sets the fields of cfg not set from the config of cfg.Image,
+// the env of cfg overrides the image's.
+func (cfg *Config) applyImage() error {
+	if cfg.Image == "" || !cfg.Run {
+		return nil
+	}
+
+	image, err := loadImage(cfg.Home, cfg.Image)
+	if err != nil {
+		return err
+	}
+	// The container's process always runs as root.
+	if image.User != "" && image.User != "root" && image.User != "0" {
+		return fmt.Errorf("Image %s runs as user %s, which isn't supported", cfg.Image, image.User)
+	}
+
+	if cfg.Path == "" && len(image.Cmd) > 0 {
+		cfg.Path = image.Cmd[0]
+		cfg.Argv = image.Cmd
+	}
+	if cfg.Cwd == "" {
+		cfg.Cwd = image.Workdir
+	}
+	cfg.Env = mergeEnv(image.Env, cfg.Env, nil)
+	return nil
+}
+
+// cloneRootfs copies the rootfs of the image name under home to dest,
+// with the ownership and device nodes like a tarball.
+func cloneRootfs(home, name, dest string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := writeTar(tw, filepath.Join(imageDir(home, name), "rootfs"))
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := untar(pr, dest, false)
+	pr.CloseWithError(err)
+	return err
+}
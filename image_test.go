@@ -0,0 +1,111 @@
+package tinybox
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeLayer writes a layer tarball of files by name, a name ending with
+// / is a dir.
+func writeLayer(t *testing.T, file string, files [][2]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f[0], Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(f[1]))}
+		if strings.HasSuffix(f[0], "/") {
+			hdr.Mode, hdr.Typeflag, hdr.Size = 0755, tar.TypeDir, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f[1]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestImportImage imports an image of two layers and creates containers
+// from it, the upper layer wins and the config gives the defaults.
+func TestImportImage(t *testing.T) {
+	if home, ok := os.LookupEnv("TINYBOX_HOME"); ok {
+		os.Unsetenv("TINYBOX_HOME")
+		defer os.Setenv("TINYBOX_HOME", home)
+	}
+	home := t.TempDir()
+	src := t.TempDir()
+	writeLayer(t, filepath.Join(src, "base.tar"), [][2]string{
+		{"etc/", ""}, {"etc/os", "base"}, {"etc/old", "old"}, {"bin/", ""}, {"bin/app", "app"},
+	})
+	writeLayer(t, filepath.Join(src, "top.tar"), [][2]string{
+		{"etc/", ""}, {"etc/os", "top"}, {"etc/.wh.old", ""}, {"srv/", ""}, {"srv/data", "data"},
+	})
+	manifest, _ := json.Marshal(&imageManifest{
+		Layers: []string{"base.tar", "top.tar"},
+		Config: ImageConfig{Env: []string{"A=image", "B=image"}, Cmd: []string{"/bin/app", "--serve"}, Workdir: "/srv"},
+	})
+	if err := ioutil.WriteFile(filepath.Join(src, "manifest.json"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportImage(home, src, "app"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bin/", "bin/app", "etc/", "etc/os", "srv/", "srv/data"}
+	if got := treeFiles(t, filepath.Join(imageDir(home, "app"), "rootfs")); !reflect.DeepEqual(got, want) {
+		t.Errorf("image rootfs %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		path string
+		argv []string
+		cwd  string
+		env  []string
+	}{
+		{"image defaults", Config{Name: "d"}, "/bin/app", []string{"/bin/app", "--serve"}, "/srv", []string{"A=image", "B=image"}},
+		{"overridden", Config{Name: "o", Path: "/bin/sh", Cwd: "/etc", Env: []string{"B=flag"}},
+			"/bin/sh", nil, "/etc", []string{"A=image", "B=flag"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Home, cfg.Run, cfg.Image = home, true, "app"
+			c, err := NewContainerWithConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Path != tt.path || !reflect.DeepEqual(c.Argv, tt.argv) || c.Cwd != tt.cwd {
+				t.Errorf("Path %s, Argv %q, Cwd %s, want %s, %q, %s", c.Path, c.Argv, c.Cwd, tt.path, tt.argv, tt.cwd)
+			}
+			if !reflect.DeepEqual(c.Env, tt.env) {
+				t.Errorf("Env %q, want %q", c.Env, tt.env)
+			}
+			if c.Rootfs != filepath.Join(c.Dir, "rootfs") {
+				t.Errorf("Rootfs %s, want in the container's dir", c.Rootfs)
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(c.Rootfs, "etc/os")); err != nil || string(data) != "top" {
+				t.Errorf("etc/os = %q, %v, want the upper layer's", data, err)
+			}
+			if got := treeFiles(t, c.Rootfs); !reflect.DeepEqual(got, want) {
+				t.Errorf("rootfs %v, want %v", got, want)
+			}
+		})
+	}
+
+	if _, err := NewContainerWithConfig(Config{Home: home, Name: "none", Run: true, Image: "missing"}); err == nil {
+		t.Error("created a container of a missing image")
+	}
+}
@@ -0,0 +1,121 @@
+package tinybox
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Steps of the container lifecycle recorded in the journal.
+const (
+	stepCreateBegin = "create-begin"
+	stepNamespaces  = "namespaces-done"
+	stepMounts      = "mounts-done"
+	stepCgroups     = "cgroups-done"
+	stepNetwork     = "network-done"
+	stepStarted     = "started"
+	stepInitFailed  = "init-failed"
+	stepStopped     = "stopped"
+)
+
+// journalRecord is a line of the journal, what a step has set up is kept
+// with it, so a crashed container can be rolled back by it. Only mounts
+// the host sees are kept, like the bind of the network namespace.
+type journalRecord struct {
+	Step    string    `json:"step"`
+	Time    time.Time `json:"time"`
+	Pid     int       `json:"pid,omitempty"`
+	Mounts  []string  `json:"mounts,omitempty"`
+	Cgroups []string  `json:"cgroups,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (c *Container) JournalFile() string {
+	return filepath.Join(c.Dir, "journal")
+}
+
+// journal appends rec to the journal and syncs it, create-begin starts a
+// new journal. An error is only logged, the journal must not stop the
+// container.
+func (c *Container) journal(rec journalRecord) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if rec.Step == stepCreateBegin {
+		flag |= os.O_TRUNC
+	}
+	rec.Time = time.Now()
+
+	file, err := os.OpenFile(c.JournalFile(), flag, 0644)
+	if err != nil {
+		log.Printf("Open journal error: %v \n", err)
+		return
+	}
+	defer file.Close()
+
+	if err := json.NewEncoder(file).Encode(&rec); err != nil {
+		log.Printf("Write journal %s error: %v \n", rec.Step, err)
+		return
+	}
+	if err := file.Sync(); err != nil {
+		log.Printf("Sync journal error: %v \n", err)
+	}
+}
+
+// readJournal reads the records of the journal, a torn last line of a
+// crash is ignored.
+func readJournal(name string) ([]journalRecord, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var recs []journalRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			break
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
+
+// rollback returns the mounts and cgroup dirs the journal of c records as
+// set up and not cleaned up, ok is false if there's no journal.
+func (c *Container) rollback() (mounts, cgroups []string, ok bool) {
+	recs, err := readJournal(c.JournalFile())
+	if err != nil || len(recs) == 0 {
+		return nil, nil, false
+	}
+
+	for _, rec := range recs {
+		switch rec.Step {
+		case stepMounts, stepNetwork:
+			mounts = append(mounts, rec.Mounts...)
+		case stepCgroups:
+			cgroups = rec.Cgroups
+		case stepStopped:
+			mounts, cgroups = nil, nil
+		}
+	}
+	return mounts, cgroups, true
+}
+
+// initFailure returns the setup error the init process recorded in the
+// journal before exec, "" if it has none.
+func (c *Container) initFailure() string {
+	recs, err := readJournal(c.JournalFile())
+	if err != nil {
+		return ""
+	}
+	for i := len(recs); i > 0; i-- {
+		if recs[i-1].Step == stepInitFailed {
+			return recs[i-1].Error
+		}
+	}
+	return ""
+}
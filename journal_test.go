@@ -0,0 +1,143 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// writeJournal seeds the journal of c with the lines.
+func writeJournal(t *testing.T, c *Container, lines ...string) {
+	t.Helper()
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := ""
+	for _, line := range lines {
+		data += line + "\n"
+	}
+	if err := ioutil.WriteFile(c.JournalFile(), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		mounts  []string
+		cgroups []string
+	}{
+		{
+			name: "crash after mounts-done",
+			lines: []string{
+				`{"step":"create-begin"}`,
+				`{"step":"namespaces-done"}`,
+				`{"step":"mounts-done"}`,
+			},
+		},
+		{
+			name: "crash after network-done",
+			lines: []string{
+				`{"step":"create-begin"}`,
+				`{"step":"cgroups-done","cgroups":["/sys/fs/cgroup/memory/tinybox/c"]}`,
+				`{"step":"network-done","mounts":["/home/c/netns"]}`,
+				`{"step":"mounts-done"}`,
+			},
+			mounts:  []string{"/home/c/netns"},
+			cgroups: []string{"/sys/fs/cgroup/memory/tinybox/c"},
+		},
+		{
+			name: "stopped",
+			lines: []string{
+				`{"step":"create-begin"}`,
+				`{"step":"cgroups-done","cgroups":["/sys/fs/cgroup/memory/tinybox/c"]}`,
+				`{"step":"network-done","mounts":["/home/c/netns"]}`,
+				`{"step":"stopped"}`,
+			},
+		},
+		{
+			name: "torn last line",
+			lines: []string{
+				`{"step":"create-begin"}`,
+				`{"step":"network-done","mounts":["/home/c/netns"]}`,
+				`{"step":"stop`,
+			},
+			mounts: []string{"/home/c/netns"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Dir: filepath.Join(t.TempDir(), "c")}
+			writeJournal(t, c, tt.lines...)
+
+			mounts, cgroups, ok := c.rollback()
+			if !ok {
+				t.Fatal("rollback found no journal")
+			}
+			if !reflect.DeepEqual(mounts, tt.mounts) {
+				t.Errorf("mounts = %v, want %v", mounts, tt.mounts)
+			}
+			if !reflect.DeepEqual(cgroups, tt.cgroups) {
+				t.Errorf("cgroups = %v, want %v", cgroups, tt.cgroups)
+			}
+		})
+	}
+}
+
+// TestGCRollbackCrash crashes a container after mounts-done, gc must
+// unmount the recorded netns bind and leave the user's rootfs mount.
+func TestGCRollbackCrash(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	home := t.TempDir()
+	c := &Container{Name: "c", Dir: filepath.Join(home, "c"), Rootfs: filepath.Join(home, "rootfs")}
+	netns := filepath.Join(c.Dir, "netns")
+	writeJournal(t, c,
+		`{"step":"create-begin"}`,
+		`{"step":"cgroups-done"}`,
+		`{"step":"network-done","mounts":["`+netns+`"]}`,
+		`{"step":"namespaces-done"}`,
+		`{"step":"mounts-done"}`,
+	)
+
+	if err := ioutil.WriteFile(netns, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("/proc/self/ns/net", netns, "bind", syscall.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(netns, syscall.MNT_DETACH)
+
+	user := filepath.Join(c.Rootfs, "mnt")
+	if err := os.MkdirAll(user, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", user, "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(user, syscall.MNT_DETACH)
+
+	actions, err := gcContainer(c, &CGroup{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"unmount " + netns, "remove state " + c.Dir}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("actions = %v, want %v", actions, want)
+	}
+
+	still, err := mounted([]string{netns, user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(still, []string{user}) {
+		t.Errorf("still mounted = %v, want only %s", still, user)
+	}
+}
@@ -0,0 +1,70 @@
+package tinybox
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// kernelIfaces are the kernel interfaces a container may see with
+// --expose-kernel-iface, always read-only and at the same path.
+var kernelIfaces = map[string]bool{
+	"/sys/kernel/security": true, // securityfs, like the LSM policies
+	"/sys/kernel/config":   true, // configfs
+}
+
+// validateKernelIfaces checks each path is one of kernelIfaces.
+func validateKernelIfaces(paths []string) error {
+	seen := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		if !kernelIfaces[p] {
+			allowed := make([]string, 0, len(kernelIfaces))
+			for k := range kernelIfaces {
+				allowed = append(allowed, k)
+			}
+			sort.Strings(allowed)
+			return fmt.Errorf("Invalid kernel interface %s, expect one of %s", p, strings.Join(allowed, ", "))
+		}
+		if seen[p] {
+			return fmt.Errorf("Duplicate kernel interface %s", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// mountKernelIfaces binds the host's kernel interfaces read-only in the
+// rootfs, the submounts are left out. The path is opened in the rootfs, a
+// symlinked /sys fails rather than lead the bind to the host.
+func (fs *rootFs) mountKernelIfaces(c *Container) error {
+	for _, p := range c.KernelIfaces {
+		if info, err := os.Stat(p); err != nil || !info.IsDir() {
+			return fmt.Errorf("Kernel interface %s is not on the host", p)
+		}
+
+		target, err := openInRoot(c.Rootfs, p, true)
+		if err != nil {
+			return fmt.Errorf("Bind kernel interface %s: %v", p, err)
+		}
+		err = mount(p, procPath(target), "bind", syscall.MS_BIND, "")
+		target.Close()
+		if err != nil {
+			return fmt.Errorf("Bind kernel interface %s: %v", p, err)
+		}
+
+		// Opened again, the path now leads to the bind.
+		bind, err := openInRoot(c.Rootfs, p, false)
+		if err != nil {
+			return err
+		}
+		flag := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+		err = mount("", procPath(bind), "", uintptr(flag), "")
+		bind.Close()
+		if err != nil {
+			return fmt.Errorf("Remount kernel interface %s read-only: %v", p, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestValidateKernelIfaces(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		err   string // "" for valid
+	}{
+		{"none", nil, ""},
+		{"securityfs", []string{"/sys/kernel/security"}, ""},
+		{"both", []string{"/sys/kernel/security", "/sys/kernel/config"}, ""},
+		{"arbitrary", []string{"/etc"}, "Invalid kernel interface /etc"},
+		{"escape", []string{"/sys/kernel/security/../../../etc"}, "Invalid kernel interface"},
+		{"prefix", []string{"/sys/kernel/securityfs"}, "Invalid kernel interface"},
+		{"sub dir", []string{"/sys/kernel/security/apparmor"}, "Invalid kernel interface"},
+		{"duplicate", []string{"/sys/kernel/config", "/sys/kernel/config"}, "Duplicate kernel interface"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateKernelIfaces(tt.paths)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("validateKernelIfaces(%q) = %v", tt.paths, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("validateKernelIfaces(%q) = %v, want %q", tt.paths, err, tt.err)
+			}
+		})
+	}
+}
+
+// TestMountKernelIfaces binds securityfs in a rootfs, it's the host's and
+// read-only there. An allowed interface the host doesn't have is an
+// error, so is a symlinked sys, and the host dir it leads to is left
+// alone.
+func TestMountKernelIfaces(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+	const missing = "/sys/kernel/tinybox-test"
+	kernelIfaces[missing] = true
+	defer delete(kernelIfaces, missing)
+
+	tests := []struct {
+		name    string
+		iface   string
+		linkSys bool // sys of the rootfs is a symlink to a host dir
+		ok      bool
+	}{
+		{"security", "/sys/kernel/security", false, true},
+		{"missing", missing, false, false},
+		{"symlinked sys", "/sys/kernel/security", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat(tt.iface); tt.iface != missing && err != nil {
+				t.Skipf("no %s on the host", tt.iface)
+			}
+			c := &Container{Rootfs: t.TempDir(), KernelIfaces: []string{tt.iface}}
+			hostDir := t.TempDir()
+			if tt.linkSys {
+				if err := os.Symlink(hostDir, filepath.Join(c.Rootfs, "sys")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := (&rootFs{}).mountKernelIfaces(c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("mountKernelIfaces = %v, want ok %v", err, tt.ok)
+			}
+			if names, _ := readDirNames(hostDir); len(names) > 0 {
+				syscall.Unmount(filepath.Join(hostDir, "kernel/security"), syscall.MNT_DETACH)
+				t.Errorf("the host dir sys leads to has %q, want it empty", names)
+			}
+			if err != nil {
+				return
+			}
+			target := filepath.Join(c.Rootfs, tt.iface)
+			defer syscall.Unmount(target, syscall.MNT_DETACH)
+
+			var host, st syscall.Stat_t
+			if err := syscall.Stat(tt.iface, &host); err != nil {
+				t.Fatal(err)
+			}
+			if err := syscall.Stat(target, &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Dev != host.Dev || st.Ino != host.Ino {
+				t.Errorf("%s in the rootfs isn't the host's", tt.iface)
+			}
+
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(target, &fs); err != nil {
+				t.Fatal(err)
+			}
+			const stRdonly = 1
+			if fs.Flags&stRdonly == 0 {
+				t.Errorf("%s is writable in the rootfs", tt.iface)
+			}
+			if err := ioutil.WriteFile(filepath.Join(target, "f"), nil, 0644); err == nil {
+				t.Errorf("write in %s succeeded", tt.iface)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package tinybox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metricFamily is a metric of the Prometheus text format, read from a
+// cgroup of the container.
+type metricFamily struct {
+	name string
+	typ  string
+	help string
+	sub  string
+	read func(dir string) (float64, error)
+}
+
+var metricFamilies = []metricFamily{
+	{"tinybox_memory_usage_bytes", "gauge", "Memory usage of the container.", subsysMEM, readCgroupFloat("memory.usage_in_bytes", 1)},
+	{"tinybox_memory_limit_bytes", "gauge", "Memory limit of the container.", subsysMEM, readCgroupFloat("memory.limit_in_bytes", 1)},
+	{"tinybox_cpu_usage_seconds_total", "counter", "Cpu time used by the container.", subsysCA, readCgroupFloat("cpuacct.usage", 1e9)},
+	{"tinybox_pids_current", "gauge", "Processes in the container.", subsysMEM, func(dir string) (float64, error) {
+		pids, err := readCgroupPids(dir)
+		return float64(len(pids)), err
+	}},
+	{"tinybox_oom_kills_total", "counter", "Processes of the container killed by OOM.", subsysMEM, func(dir string) (float64, error) {
+		n, err := oomKills(dir)
+		return float64(n), err
+	}},
+}
+
+// readCgroupFloat reads a number of the cgroup file, divided by unit.
+func readCgroupFloat(file string, unit float64) func(dir string) (float64, error) {
+	return func(dir string) (float64, error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+		return v / unit, err
+	}
+}
+
+// Metrics writes the cgroup metrics of the running containers under home
+// to w in the Prometheus text format. The samples are labeled with the
+// container's name and its labels as label_<key>, a container which
+// stopped during the scan is skipped.
+func Metrics(home string, w io.Writer) error {
+	if !filepath.IsAbs(home) {
+		return fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	entries, err := ioutil.ReadDir(home)
+	if err != nil {
+		return err
+	}
+
+	samples := make([][]string, len(metricFamilies))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		c, err := loadContainer(home, entry.Name())
+		if err != nil || c.Name != entry.Name() || c.CgOpts == nil || !processAlive(c.Pid) {
+			continue
+		}
+
+		cg, err := newCGroup(c.CgOpts.Root)
+		if err != nil {
+			return err
+		}
+		labels := metricLabels(c)
+
+		values := make([]string, len(metricFamilies))
+		for i, m := range metricFamilies {
+			dir, err := cg.groupPath(m.sub, c)
+			if err != nil {
+				continue
+			}
+			v, err := m.read(dir)
+			if err != nil {
+				continue
+			}
+			values[i] = fmt.Sprintf("%s{%s} %s", m.name, labels, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+
+		// Its cgroups may be gone or reused once it stopped.
+		if !processAlive(c.Pid) {
+			continue
+		}
+		for i, v := range values {
+			if v != "" {
+				samples[i] = append(samples[i], v)
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	for i, m := range metricFamilies {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, s := range samples[i] {
+			fmt.Fprintln(bw, s)
+		}
+	}
+	return bw.Flush()
+}
+
+// metricLabels formats the name and the labels of c as the labels of a
+// sample.
+func metricLabels(c *Container) string {
+	keys := make([]string, 0, len(c.Labels))
+	for k := range c.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{fmt.Sprintf("name=%s", quoteLabel(c.Name))}
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("label_%s=%s", labelName(k), quoteLabel(c.Labels[k])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// labelName replaces the chars not allowed in a label name with _.
+func labelName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// quoteLabel quotes a label value with the escapes of the text format.
+func quoteLabel(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
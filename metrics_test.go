@@ -0,0 +1,106 @@
+package tinybox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestMetrics scrapes the metrics of a home with a running container on
+// a fake cgroup root, a stopped one and one whose cgroups are gone. Only
+// the running one has samples, named and labeled by its name and labels.
+func TestMetrics(t *testing.T) {
+	root := t.TempDir()
+	for _, sub := range []string{subsysMEM, subsysCA} {
+		if err := os.Mkdir(filepath.Join(root, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cg, err := newCGroup(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dead := exec.Command("/bin/true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	home := t.TempDir()
+	containers := []struct {
+		c     *Container
+		files map[string]string // of a subsystem/file of its cgroups
+	}{
+		{&Container{Name: "web", Pid: os.Getpid(), Labels: map[string]string{"app": "shop", "tier.name": `a"b`}}, map[string]string{
+			"memory/memory.usage_in_bytes": "1048576\n",
+			"memory/memory.limit_in_bytes": "67108864\n",
+			"memory/cgroup.procs":          "1\n2\n3\n",
+			"memory/memory.oom_control":    "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n",
+			"cpuacct/cpuacct.usage":        "1500000000\n",
+		}},
+		{&Container{Name: "stopped", Pid: dead.Process.Pid}, map[string]string{
+			"memory/memory.usage_in_bytes": "1\n",
+		}},
+		{&Container{Name: "nocgroup", Pid: os.Getpid()}, nil},
+	}
+	for _, tc := range containers {
+		c := tc.c
+		c.Dir = filepath.Join(home, c.Name)
+		c.CgPrefix = "tinybox"
+		c.CgOpts = &CGroupOptions{Root: root}
+		if err := os.Mkdir(c.Dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.saveJson(); err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range tc.files {
+			dir, err := cg.groupPath(filepath.Dir(name), c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(name)), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Not a container.
+	if err := ioutil.WriteFile(filepath.Join(home, "profiles.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Metrics(home, &buf); err != nil {
+		t.Fatal(err)
+	}
+	labels := `{name="web",label_app="shop",label_tier_name="a\"b"}`
+	want := `# HELP tinybox_memory_usage_bytes Memory usage of the container.
+# TYPE tinybox_memory_usage_bytes gauge
+tinybox_memory_usage_bytes` + labels + ` 1048576
+# HELP tinybox_memory_limit_bytes Memory limit of the container.
+# TYPE tinybox_memory_limit_bytes gauge
+tinybox_memory_limit_bytes` + labels + ` 67108864
+# HELP tinybox_cpu_usage_seconds_total Cpu time used by the container.
+# TYPE tinybox_cpu_usage_seconds_total counter
+tinybox_cpu_usage_seconds_total` + labels + ` 1.5
+# HELP tinybox_pids_current Processes in the container.
+# TYPE tinybox_pids_current gauge
+tinybox_pids_current` + labels + ` 3
+# HELP tinybox_oom_kills_total Processes of the container killed by OOM.
+# TYPE tinybox_oom_kills_total counter
+tinybox_oom_kills_total` + labels + ` 2
+`
+	if buf.String() != want {
+		t.Errorf("metrics\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if err := Metrics("home", &buf); err == nil {
+		t.Error("Metrics of a relative home succeeded")
+	}
+}
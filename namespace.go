@@ -1,6 +1,11 @@
 package tinybox
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -36,10 +41,58 @@ func (m NamespaceManager) Cloneflags(c *Container) uintptr {
 	return flag
 }
 
+// Validate checks the kernel supports all namespaces the container needs.
+func (m NamespaceManager) Validate(c *Container) error {
+	if m.Cloneflags(c) == 0 {
+		return nil
+	}
+
+	for name, set := range m {
+		if set.flag(c) == 0 {
+			continue
+		}
+		file := filepath.Join("/proc/self/ns", strings.ToLower(name))
+		if _, err := os.Lstat(file); err != nil {
+			return fmt.Errorf("%w: %s", ErrNamespaceUnsupported, name)
+		}
+	}
+	return nil
+}
+
 func (m NamespaceManager) Setup(c *Container) error {
 	return nil
 }
 
+// Inspect returns the namespaces the init process is in, a namespace is
+// new if its inode differs from the one of the current process.
+func (m NamespaceManager) Inspect(c *Container) (map[string]bool, error) {
+	result := make(map[string]bool, len(m))
+	for name := range m {
+		file := strings.ToLower(name)
+		self, err := nsInode(filepath.Join("/proc/self/ns", file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		init, err := nsInode(filepath.Join("/proc", strconv.Itoa(c.Pid), "ns", file))
+		if err != nil {
+			return nil, err
+		}
+		result[file] = init != self
+	}
+	return result, nil
+}
+
+func nsInode(file string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		return 0, err
+	}
+	return st.Ino, nil
+}
+
 type baseN struct{}
 
 func (b baseN) setup(c *Container) error {
@@ -83,6 +136,9 @@ type setNET struct {
 }
 
 func (s setNET) flag(c *Container) uintptr {
+	if c.NetMode == netNone {
+		return uintptr(s.clone)
+	}
 	return uintptr(0)
 }
 
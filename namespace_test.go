@@ -0,0 +1,63 @@
+package tinybox
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// TestNamespaceInspect clones a process with the flags of a container,
+// Inspect must report exactly the namespaces of the flags as new.
+func TestNamespaceInspect(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to clone namespaces")
+	}
+
+	tests := []struct {
+		name string
+		c    *Container
+		want map[string]bool
+	}{
+		{"no rootfs", &Container{}, map[string]bool{
+			"mnt": false, "uts": false, "pid": false, "net": false, "user": false, "ipc": false,
+		}},
+		{"rootfs", &Container{Rootfs: "/"}, map[string]bool{
+			"mnt": true, "uts": true, "pid": true, "net": false, "user": false, "ipc": true,
+		}},
+		{"network none", &Container{Rootfs: "/", NetMode: netNone}, map[string]bool{
+			"mnt": true, "uts": true, "pid": true, "net": true, "user": false, "ipc": true,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newNamespace()
+			cmd := exec.Command("/bin/sleep", "10")
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: m.Cloneflags(tt.c)}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Wait()
+			defer cmd.Process.Kill()
+
+			tt.c.Pid = cmd.Process.Pid
+			got, err := m.Inspect(tt.c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Inspect = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The init process is gone, its namespaces can't be read.
+	cmd := exec.Command("/bin/true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newNamespace().Inspect(&Container{Rootfs: "/", Pid: cmd.Process.Pid}); err == nil {
+		t.Error("Inspect of a dead init succeeded")
+	}
+}
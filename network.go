@@ -0,0 +1,116 @@
+package tinybox
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// Network modes of --network, without one the container shares the host's
+// network namespace but keeps its own resolv.conf settings.
+const (
+	netHost = "host" // share the host's interfaces and resolv.conf
+	netNone = "none" // a new network namespace with only loopback
+)
+
+// validateNetwork checks the network mode, the dns options don't apply to
+// the host network. An external network is configured in the container's
+// own namespace, so it needs the none mode.
+func validateNetwork(mode string, dns *DNSOptions, netnsPath, hook string) error {
+	if netnsPath != "" || hook != "" {
+		if mode != netNone {
+			return fmt.Errorf("Netns path and network hook need --network none")
+		}
+		if netnsPath != "" && (!path.IsAbs(netnsPath) || path.Clean(netnsPath) != netnsPath) {
+			return fmt.Errorf("Invalid netns path %s, must be a clean absolute path", netnsPath)
+		}
+	}
+
+	switch mode {
+	case "", netNone:
+	case netHost:
+		if !dns.IsEmpty() {
+			return fmt.Errorf("Can't set dns options with host network")
+		}
+	default:
+		return fmt.Errorf("Invalid network mode %s, expect host or none", mode)
+	}
+	return nil
+}
+
+// netnsFile is where the network namespace of the container is bind
+// mounted for an external plugin, "" if it's not.
+func (c *Container) netnsFile() string {
+	if c.NetnsPath != "" {
+		return c.NetnsPath
+	}
+	if c.NetHook != "" {
+		return filepath.Join(c.Dir, "netns")
+	}
+	return ""
+}
+
+// setupNetwork bind mounts the network namespace of the init process on
+// netnsFile and runs the network hook to add the container, it's done
+// before the init process runs the container.
+func (c *Container) setupNetwork() error {
+	file := c.netnsFile()
+	if file == "" {
+		return nil
+	}
+
+	if err := ensureFile(file, 0, func(name string) error {
+		return WriteFileStr(name, "")
+	}); err != nil {
+		return err
+	}
+	ns := fmt.Sprintf("/proc/%d/ns/net", c.Pid)
+	if err := mount(ns, file, "bind", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Bind netns on %s: %v", file, err)
+	}
+	c.journal(journalRecord{Step: stepNetwork, Mounts: []string{file}})
+	return c.runNetHook("ADD")
+}
+
+// teardownNetwork runs the network hook to delete the container and
+// unmounts the netns, errors are only logged.
+func (c *Container) teardownNetwork() {
+	file := c.netnsFile()
+	if file == "" {
+		return
+	}
+
+	if err := c.runNetHook("DEL"); err != nil {
+		log.Printf("Network hook DEL error: %v \n", err)
+	}
+	if err := syscall.Unmount(file, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		log.Printf("Unmount netns %s error: %v \n", file, err)
+	}
+	if c.NetnsPath == "" {
+		os.Remove(file)
+	}
+}
+
+// runNetHook runs the network hook with the env of a CNI plugin, command
+// is ADD or DEL.
+func (c *Container) runNetHook(command string) error {
+	if c.NetHook == "" {
+		return nil
+	}
+
+	cmd := exec.Command(c.NetHook)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+c.Name,
+		"CNI_NETNS="+c.netnsFile(),
+		"CNI_IFNAME=eth0")
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", c.NetHook, command, err)
+	}
+	return nil
+}
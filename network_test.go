@@ -0,0 +1,185 @@
+package tinybox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestValidateNetwork(t *testing.T) {
+	dns := DNSOptions{Servers: []string{"10.0.0.2"}}
+	tests := []struct {
+		name      string
+		mode      string
+		dns       DNSOptions
+		netnsPath string
+		hook      string
+		ok        bool
+	}{
+		{"default", "", dns, "", "", true},
+		{"host", netHost, DNSOptions{}, "", "", true},
+		{"host with dns", netHost, dns, "", "", false},
+		{"none with dns", netNone, dns, "", "", true},
+		{"invalid mode", "bridge", DNSOptions{}, "", "", false},
+		{"netns path", netNone, DNSOptions{}, "/run/netns/box", "", true},
+		{"netns path on host", netHost, DNSOptions{}, "/run/netns/box", "", false},
+		{"relative netns path", netNone, DNSOptions{}, "netns/box", "", false},
+		{"hook without none", "", DNSOptions{}, "", "/bin/hook", false},
+	}
+	for _, tt := range tests {
+		err := validateNetwork(tt.mode, &tt.dns, tt.netnsPath, tt.hook)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: validateNetwork = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// netInterfaces returns the interface names in the /proc/net/dev data.
+func netInterfaces(data string) []string {
+	var names []string
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			names = append(names, strings.TrimSpace(line[:i]))
+		}
+	}
+	return names
+}
+
+// TestHostNetwork clones a process with the namespaces of a container in
+// each network mode, it sees the host's interfaces unless none.
+func TestHostNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to clone namespaces")
+	}
+	host, err := ioutil.ReadFile("/proc/self/net/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostNS, _ := os.Readlink("/proc/self/ns/net")
+
+	tests := []struct {
+		mode string
+		host bool
+	}{
+		{"", true},
+		{netHost, true},
+		{netNone, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			c := &Container{Rootfs: "/", NetMode: tt.mode}
+			cmd := exec.Command("/bin/sh", "-c", "readlink /proc/self/ns/net; cat /proc/self/net/dev")
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: newNamespace().Cloneflags(c)}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.SplitN(string(out), "\n", 2)
+			ns, dev := lines[0], lines[1]
+
+			if (ns == hostNS) != tt.host {
+				t.Errorf("netns %s, host's %s, want shared %v", ns, hostNS, tt.host)
+			}
+			want := netInterfaces(string(host))
+			if !tt.host {
+				want = []string{"lo"}
+			}
+			if got := netInterfaces(dev); !reflect.DeepEqual(got, want) {
+				t.Errorf("interfaces %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestNetHook runs a mock plugin on a container with its own network
+// namespace, it must get the bound netns and the container's name on ADD
+// and DEL.
+func TestNetHook(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to clone a network namespace")
+	}
+
+	tests := []struct {
+		name      string
+		netnsPath bool // the caller gives the path
+		hook      bool
+	}{
+		{"hook", false, true},
+		{"netns path and hook", true, true},
+		{"netns path only", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			calls := filepath.Join(dir, "calls")
+
+			sleep := exec.Command("/bin/sleep", "30")
+			sleep.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+			if err := sleep.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer sleep.Wait()
+			defer sleep.Process.Kill()
+
+			c := &Container{Name: "web", Dir: filepath.Join(dir, "web"), Pid: sleep.Process.Pid, NetMode: netNone}
+			if err := os.Mkdir(c.Dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			want := filepath.Join(c.Dir, "netns")
+			if tt.netnsPath {
+				c.NetnsPath = filepath.Join(dir, "run", "netns", "web")
+				if err := os.MkdirAll(filepath.Dir(c.NetnsPath), 0755); err != nil {
+					t.Fatal(err)
+				}
+				want = c.NetnsPath
+			}
+			if tt.hook {
+				c.NetHook = filepath.Join(dir, "plugin")
+				script := "#!/bin/sh\necho $CNI_COMMAND $CNI_CONTAINERID $CNI_NETNS $CNI_IFNAME $(stat -f -c %T $CNI_NETNS) >> " + calls + "\n"
+				if err := ioutil.WriteFile(c.NetHook, []byte(script), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			netns := c.netnsFile()
+			if netns != want {
+				t.Errorf("netns file %s, want %s", netns, want)
+			}
+
+			if err := c.setupNetwork(); err != nil {
+				t.Fatal(err)
+			}
+			var st, initNS syscall.Stat_t
+			syscall.Stat(netns, &st)
+			syscall.Stat(fmt.Sprintf("/proc/%d/ns/net", c.Pid), &initNS)
+			if st.Ino != initNS.Ino {
+				t.Errorf("netns file has inode %d, the netns of init %d", st.Ino, initNS.Ino)
+			}
+
+			c.teardownNetwork()
+			data, _ := ioutil.ReadFile(calls)
+			var wantCalls string
+			if tt.hook {
+				wantCalls = "ADD web " + netns + " eth0 nsfs\nDEL web " + netns + " eth0 nsfs\n"
+			}
+			if string(data) != wantCalls {
+				t.Errorf("plugin calls %q, want %q", data, wantCalls)
+			}
+
+			// A caller's file is kept for it, unbound.
+			var after syscall.Stat_t
+			err := syscall.Stat(netns, &after)
+			if tt.netnsPath && (err != nil || after.Ino == initNS.Ino) {
+				t.Errorf("netns path after teardown: inode %d, %v", after.Ino, err)
+			}
+			if !tt.netnsPath && !os.IsNotExist(err) {
+				t.Errorf("netns file left after teardown: %v", err)
+			}
+		})
+	}
+}
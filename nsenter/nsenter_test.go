@@ -0,0 +1,84 @@
+package nsenter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestNsenterClone re-execs the test binary with the env of nsexec, it
+// joins the namespaces of this process, which are already its own, and
+// clones the child on the mmap'd stack. The child must come up in Go and
+// exit cleanly instead of faulting.
+func TestNsenterClone(t *testing.T) {
+	tests := []struct {
+		name string
+		pid  string // __TINYBOX_INIT_PID__
+		ok   bool
+	}{
+		{"own namespaces", strconv.Itoa(os.Getpid()), true},
+		{"invalid pid", "1x", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			var out bytes.Buffer
+			cmd := exec.Command(os.Args[0], "-test.run=^TestNsenterChild$")
+			cmd.Env = append(os.Environ(),
+				"__TINYBOX_INIT_PID__="+tt.pid,
+				"__TINYBOX_PIPE__=3",
+				"TINYBOX_TEST_NSENTER_CHILD=1")
+			cmd.ExtraFiles = []*os.File{w}
+			cmd.Stdout, cmd.Stderr = &out, &out
+			if err := cmd.Start(); err != nil {
+				w.Close()
+				t.Fatal(err)
+			}
+			w.Close()
+
+			var msg struct{ Pid int }
+			decodeErr := json.NewDecoder(r).Decode(&msg)
+			err = cmd.Wait()
+			if (err == nil) != tt.ok {
+				t.Fatalf("nsexec = %v, want ok %v: %s", err, tt.ok, out.String())
+			}
+			if !tt.ok {
+				return
+			}
+			if decodeErr != nil {
+				t.Fatalf("read the child pid: %v", decodeErr)
+			}
+
+			// The child is cloned with CLONE_PARENT, it's a child of this
+			// process.
+			var ws syscall.WaitStatus
+			if _, err := syscall.Wait4(msg.Pid, &ws, 0, nil); err != nil {
+				t.Fatal(err)
+			}
+			if ws.Signaled() || ws.ExitStatus() != 0 {
+				t.Fatalf("child %d exited with %v: %s", msg.Pid, ws, out.String())
+			}
+			if want := fmt.Sprintf("child %d\n", msg.Pid); !bytes.Contains(out.Bytes(), []byte(want)) {
+				t.Errorf("output %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+// TestNsenterChild is the cloned child of TestNsenterClone.
+func TestNsenterChild(t *testing.T) {
+	if os.Getenv("TINYBOX_TEST_NSENTER_CHILD") == "" {
+		t.Skip("run by TestNsenterClone")
+	}
+	fmt.Printf("child %d\n", os.Getpid())
+}
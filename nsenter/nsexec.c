@@ -11,20 +11,21 @@
 #include <sys/types.h>
 #include <sys/stat.h>
 #include <sys/ioctl.h>
+#include <sys/mman.h>
 #include <fcntl.h>
 #include <signal.h>
 #include <setjmp.h>
 #include <sched.h>
 #include <signal.h>
 
-/* All arguments should be above stack, because it grows down */
+/*
+ * Stack of the cloned child, it only longjmps back, but signal handlers
+ * and the libc may need more than a page. The lowest page is a guard, so
+ * an overflow faults instead of corrupting memory.
+ */
+#define CLONE_STACK_SIZE (64 * 1024)
+
 struct clone_arg {
-	/*
-	 * Reserve some space for clone() to locate arguments
-	 * and retcode in this place
-	 */
-	char stack[4096] __attribute__ ((aligned(16)));
-	char stack_ptr[0];
 	jmp_buf *env;
 };
 
@@ -57,11 +58,24 @@ static int clone_parent(jmp_buf * env) __attribute__ ((noinline));
 static int clone_parent(jmp_buf * env)
 {
 	struct clone_arg ca;
+	long page = sysconf(_SC_PAGESIZE);
+	size_t size = CLONE_STACK_SIZE + page;
+	char *stack;
 	int child;
 
+	stack = mmap(NULL, size, PROT_READ | PROT_WRITE, MAP_PRIVATE | MAP_ANONYMOUS | MAP_STACK, -1, 0);
+	if (stack == MAP_FAILED)
+		return -1;
+	if (mprotect(stack, page, PROT_NONE) == -1) {
+		munmap(stack, size);
+		return -1;
+	}
+
 	ca.env = env;
-	child = clone(child_func, ca.stack_ptr, CLONE_PARENT | SIGCHLD, &ca);
+	/* The stack grows down from the top, which is 16 bytes aligned. */
+	child = clone(child_func, stack + size, CLONE_PARENT | SIGCHLD, &ca);
 
+	munmap(stack, size);
 	return child;
 }
 
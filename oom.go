@@ -0,0 +1,123 @@
+package tinybox
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// onOOMTimeout is how long the --on-oom command may run.
+const onOOMTimeout = time.Second * 10
+
+const (
+	efdCloexec  = 0x80000
+	efdNonblock = 0x800
+)
+
+// watchOOM registers an eventfd for the OOM notification of the memory
+// cgroup, and runs c.OnOOM on each OOM kill until the master stops.
+func (p *masterProcess) watchOOM(c *Container) error {
+	if c.OnOOM == "" {
+		return nil
+	}
+	dir := c.cgop.Paths()[subsysMEM]
+	if dir == "" {
+		return fmt.Errorf("No memory cgroup")
+	}
+
+	control, err := os.Open(filepath.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	fd, _, e := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, efdCloexec|efdNonblock, 0)
+	if e != 0 {
+		return fmt.Errorf("Create eventfd: %v", e)
+	}
+	// A nonblocking fd is read through the poller, so Close stops a Read.
+	events := os.NewFile(fd, "oom-eventfd")
+
+	reg := fmt.Sprintf("%d %d", fd, control.Fd())
+	if err := WriteFileStr(filepath.Join(dir, "cgroup.event_control"), reg); err != nil {
+		events.Close()
+		return err
+	}
+
+	// Cleanup removes the cgroup after the master stops, so a kill of the
+	// init process itself is still seen by the check at stop.
+	notify := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 8)
+		for {
+			if _, err := events.Read(buf); err != nil {
+				return
+			}
+			select {
+			case notify <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer events.Close()
+
+		var killed int64
+		check := func() {
+			// The event also fires when the cgroup is removed, only a new
+			// kill is an OOM.
+			n, err := oomKills(dir)
+			if err != nil || n <= killed {
+				return
+			}
+			killed = n
+
+			log.Printf("Container OOM, kills: %d \n", n)
+			cmd := exec.Command(c.OnOOM, c.Name, strconv.FormatInt(n, 10))
+			cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+			if err := p.runHelper(cmd, onOOMTimeout); err != nil {
+				log.Printf("Run on-oom command error: %v \n", err)
+			}
+		}
+
+		for {
+			select {
+			case <-notify:
+				check()
+			case <-p.stop:
+				check()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// oomKills reads the count of processes killed by OOM in the memory
+// cgroup dir.
+func oomKills(dir string) (int64, error) {
+	f, err := os.Open(filepath.Join(dir, "memory.oom_control"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("No oom_kill in %s", f.Name())
+}
@@ -0,0 +1,91 @@
+package tinybox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOnOOM drives an init process over the limit of its memory cgroup,
+// the on-oom command must run on the host with the name and kill count,
+// and the exit status must tell the OOM kill.
+func TestOnOOM(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to make a memory cgroup")
+	}
+	dir := fmt.Sprintf("/sys/fs/cgroup/memory/tinybox-test-%d", os.Getpid())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Skip("no memory cgroup: ", err)
+	}
+	defer os.Remove(dir)
+	if err := WriteFileStr(filepath.Join(dir, "memory.limit_in_bytes"), "16m"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := oomKills(dir); err != nil {
+		t.Skip("no oom_kill in memory.oom_control: ", err)
+	}
+
+	home := t.TempDir()
+	calls := filepath.Join(home, "calls")
+	hook := filepath.Join(home, "on-oom")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" $(cat /proc/self/cgroup | grep -c tinybox-test) >> "+calls+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Container{
+		Name:   "hog",
+		Dir:    filepath.Join(home, "hog"),
+		OnOOM:  hook,
+		CgOpts: &CGroupOptions{},
+		fsop:   &rootFs{},
+		cgop:   &CGroup{paths: map[string]string{subsysMEM: dir}},
+	}
+	if err := os.Mkdir(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell holds the output of the substitution, 64m over the limit.
+	hog := exec.Command("/bin/sh", "-c", `read go; x=$(head -c 67108864 /dev/zero | tr '\0' a); echo survived`)
+	stdin, err := hog.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hog.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hog.Process.Kill()
+	c.Pid = hog.Process.Pid
+	if err := joinCgroup(dir, c.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	p := master()
+	if err := p.watchOOM(c); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	stdin.Write([]byte("go\n"))
+	if err := p.wait(c); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > onOOMTimeout {
+		t.Errorf("the OOM kill took %s", time.Since(start))
+	}
+
+	if c.ExitStatus == nil || !c.ExitStatus.OOMKilled || c.ExitStatus.Code != 128+9 {
+		t.Errorf("exit status %+v, want OOM killed", c.ExitStatus)
+	}
+	// The command runs on the host, out of the container's cgroup.
+	data, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "hog 1 0" {
+		t.Errorf("on-oom called with %q, want %q", got, "hog 1 0")
+	}
+}
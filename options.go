@@ -3,9 +3,12 @@ package tinybox
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -13,36 +16,168 @@ var (
 	ErrOptNoRun       = fmt.Errorf("Not set run command or invalid")
 	ErrOptNoRoot      = fmt.Errorf("Not set root path or invalid")
 	ErrOptInvalidName = fmt.Errorf("Invalid container's name")
+	ErrOptInvalidWd   = fmt.Errorf("Working directory must be an absolute path")
+	ErrOptTimezone    = fmt.Errorf("Can't set both localtime and timezone")
+	ErrOptInvalidSize = fmt.Errorf("Invalid size, expect a number with an optional k, m or g suffix")
 )
 
 // tinybox --run='' --name='' --root=''
 // tinybox --exe='' --name=''
 
 type Options struct {
-	run      string
-	exec     string
-	argv     string
-	args     []string
-	name     string
-	root     string
-	wd       string
-	hostname string
-	cgopts   CGroupOptions
+	run           string
+	exec          string
+	argv          string
+	argv0         string
+	args          []string
+	name          string
+	root          string
+	wd            string
+	hostname      string
+	shmSize       string
+	localtime     bool
+	timezone      string
+	stopSig       string
+	labels        listValue
+	labelFile     string
+	nofile        string
+	coreDump      string
+	rlimits       []Rlimit
+	ulimits       []Rlimit
+	force         bool
+	rm            bool
+	tty           bool
+	traceSetup    bool
+	traceRedact   bool
+	dns           DNSOptions
+	fds           int
+	tmpfs         bool
+	noMtab        bool
+	procMode      string
+	rootfsSwitch  string
+	propagation   string
+	env           listValue
+	envPass       listValue
+	envUnset      listValue
+	envInherit    bool
+	noEnvInherit  bool
+	keepEnv       bool
+	nice          int
+	schedPolicy   string
+	schedPriority int
+	noSetsid      bool
+	rootfsTar     string
+	image         string
+	profile       string
+	pidfile       string
+	network       string
+	netnsPath     string
+	netHook       string
+	timeOffsets   map[string]int64
+	waitCmd       string
+	waitTCP       string
+	waitHTTP      string
+	execAuthzCmd  string
+	onOOM         string
+	waitTimeout   time.Duration
+	timeout       time.Duration
+	maxStarts     int
+	secrets       []Secret
+	volumes       []Volume
+	volumesFrom   []VolumesFrom
+	kernelIfaces  listValue
+	capProfile    string
+	capAdd        listValue
+	capDrop       listValue
+	cgopts        CGroupOptions
 }
 
 func (o *Options) register() {
 	flag.StringVar(&o.run, "run", "", "Container run command")
 	flag.StringVar(&o.exec, "exec", "", "")
+	flag.StringVar(&o.argv0, "argv0", "", "argv[0] of the run command, instead of the binary path")
 	flag.StringVar(&o.root, "root", "", "Container rootfs path")
-	flag.StringVar(&o.wd, "wd", "/", "Container working directory")
+	flag.StringVar(&o.rootfsTar, "rootfs-tar", "", "Extract the rootfs of the container from a tarball")
+	flag.StringVar(&o.image, "image", "", "Run a container from an image imported by tinybox image import, --run is optional")
+	flag.StringVar(&o.waitCmd, "wait-for-cmd", "", "Command run in the container until it succeeds before the container is ready")
+	flag.StringVar(&o.onOOM, "on-oom", "", "Host command run with the container name and OOM kill count when the container is OOM killed")
+	flag.StringVar(&o.execAuthzCmd, "exec-authz-cmd", "", "Host command run with the container name and the exec request as json on stdin, an exec runs only if it exits with 0")
+	flag.StringVar(&o.waitTCP, "wait-for-tcp", "", "host:port accepting a connection in the container's network before the container is ready")
+	flag.StringVar(&o.waitHTTP, "wait-for-http", "", "URL returning a 2xx or 3xx status to a GET in the container's network before the container is ready")
+	flag.DurationVar(&o.waitTimeout, "wait-timeout", time.Second*30, "How long to wait for the --wait-for probes to succeed")
+	flag.DurationVar(&o.timeout, "timeout", 0, "Stop the container after the duration, with the stop signal then SIGKILL, 0 for never")
+	flag.IntVar(&o.maxStarts, "max-concurrent-starts", 0, "Max containers of TINYBOX_HOME in setup at once, 0 for no limit, or TINYBOX_MAX_CONCURRENT_STARTS")
+	flag.Var((*secretValue)(&o.secrets), "secret", "Put the host file source at /run/secrets/name on a tmpfs, name=source, can be repeated")
+	flag.Var(&o.kernelIfaces, "expose-kernel-iface", "Bind a kernel interface like /sys/kernel/security read-only in the container, can be repeated")
+	flag.Var((*volumesFromValue)(&o.volumesFrom), "volumes-from", "Share the volumes of another container as name[:ro], can be repeated")
+	flag.Var((*volumeValue)(&o.volumes), "volume", "Mount a container-private dir kept across restarts at the container path, can be repeated")
+	flag.StringVar(&o.capProfile, "cap-profile", "", "Capabilities of the container process: none, default, docker-default or all")
+	flag.Var(&o.capAdd, "cap-add", "Add a capability to the profile, like NET_ADMIN or ALL, can be repeated")
+	flag.Var(&o.capDrop, "cap-drop", "Drop a capability from the profile, like NET_RAW or ALL, can be repeated")
+	flag.StringVar(&o.pidfile, "pidfile", "", "Write the host pid of the init process to the file")
+	flag.BoolVar(&o.force, "force", false, "Reset the state of a stopped container with the same name")
+	flag.BoolVar(&o.traceSetup, "trace-setup", false, "Record the mount, cgroup, clone and setns calls of the setup into the trace file of the container")
+	flag.BoolVar(&o.traceRedact, "trace-redact", false, "Replace the rootfs and the container's dir in the trace by placeholders")
+	flag.BoolVar(&o.rm, "rm", false, "Remove the container's dir and volumes once it exits")
+	flag.BoolVar(&o.tty, "tty", false, "Attach the terminal to a pty of the container, tinybox exits with the container's code")
+	flag.StringVar(&o.wd, "wd", "", "Container working directory, / by default")
 	flag.StringVar(&o.hostname, "hostname", "", "Container host name")
+	flag.StringVar(&o.shmSize, "shm-size", "64m", "Size of /dev/shm, e.g. 64m, 1g")
+	flag.StringVar(&o.procMode, "proc-mode", procMasked, "Mode of /proc: masked, rw or ro")
+	flag.StringVar(&o.propagation, "mount-propagation", propSlave, "Propagation of the container's root: slave for the host mounts to appear in the container, or private")
+	flag.StringVar(&o.rootfsSwitch, "rootfs-switch-method", switchAuto, "How to switch to the rootfs: pivot, move (MS_MOVE and chroot), or auto for pivot falling back to move")
+	flag.BoolVar(&o.tmpfs, "tmp-as-tmpfs", false, "Mount tmpfs on /tmp, /run and /var/run")
+	flag.BoolVar(&o.noMtab, "no-mtab", false, "Don't link a missing /etc/mtab of the rootfs to /proc/self/mounts")
+	flag.BoolVar(&o.localtime, "localtime", false, "Bind mount the host /etc/localtime read-only")
+	flag.StringVar(&o.timezone, "timezone", "", "Container time zone, e.g. Asia/Shanghai")
+	flag.Var((*timeOffsetValue)(&o.timeOffsets), "time-offset", "Offset a clock in a time namespace, monotonic=SECS or boottime=SECS, can be repeated")
+	flag.StringVar(&o.stopSig, "stop-signal", "SIGTERM", "Signal sent to the init process to stop the container")
+	flag.Var(&o.labels, "label", "Container label key=value, can be repeated")
+	flag.StringVar(&o.labelFile, "label-file", "", "File of key=value labels, one per line")
+	flag.StringVar(&o.network, "network", "", "Network mode of the container: host or none")
+	flag.StringVar(&o.netnsPath, "netns-path", "", "Bind mount the network namespace of the container on the file, needs --network none")
+	flag.StringVar(&o.netHook, "network-hook", "", "Plugin run with CNI_COMMAND ADD and DEL to configure the network namespace, needs --network none")
+	flag.Var((*listValue)(&o.dns.Servers), "dns-server", "DNS server of the container, can be repeated")
+	flag.Var((*listValue)(&o.dns.Search), "dns-search", "DNS search domain of the container, can be repeated")
+	flag.Var((*listValue)(&o.dns.Options), "dns-option", "DNS resolver option of the container, can be repeated")
+	flag.Var(&o.env, "env", "Container env KEY=VALUE, can be repeated")
+	flag.Var(&o.envPass, "env-passthrough", "Copy the env NAME from the current environment, can be repeated")
+	flag.Var(&o.envUnset, "env-unset", "Remove the env NAME from the container, can be repeated")
+	flag.BoolVar(&o.envInherit, "env-inherit", true, "Exec with the container's env as the base")
+	flag.BoolVar(&o.keepEnv, "keep-env", false, "Pass the current environment into the container, instead of only PATH, HOME, TERM and HOSTNAME")
+	flag.BoolVar(&o.noEnvInherit, "no-env-inherit", false, "Exec without the container's env, same as --env-inherit=false")
+	flag.IntVar(&o.fds, "preserve-fds", 0, "Pass fds 3 to 3+N-1 into the container process")
+	flag.BoolVar(&o.noSetsid, "no-setsid", false, "Don't run the container process in a new session")
+	flag.IntVar(&o.nice, "nice", 0, "Nice value of the container process")
+	flag.StringVar(&o.schedPolicy, "sched-policy", "", "Scheduling policy: SCHED_BATCH, SCHED_IDLE, SCHED_FIFO or SCHED_RR")
+	flag.IntVar(&o.schedPriority, "sched-priority", 0, "Scheduling priority of a real-time policy")
+	flag.Var((*ulimitValue)(&o.ulimits), "ulimit", "Rlimit of the container process name=soft[:hard], like nproc=100, can be repeated")
+	flag.StringVar(&o.nofile, "nofile", "", "Max open files of the container process, soft[:hard]")
+	flag.StringVar(&o.coreDump, "core-dump", "0", "Max core dump size, 0 disables core dumps")
 
 	// cgroup options
 	flag.StringVar(&o.cgopts.CpuShares, "cpu-shares", "0", "")
 	flag.StringVar(&o.cgopts.CpuCfsPeriod, "cpu-cfs-period", "0", "")
 	flag.StringVar(&o.cgopts.CpuCfsquota, "cpu-cfs-quota", "0", "")
+	flag.StringVar(&o.cgopts.CpuRtRuntime, "cpu-rt-runtime", "0", "")
+	flag.StringVar(&o.cgopts.CpuRtPeriod, "cpu-rt-period", "0", "")
+	flag.StringVar(&o.cgopts.Memory, "memory", "", "Memory limit of the container, e.g. 512m")
+	flag.StringVar(&o.cgopts.MemoryReservation, "memory-reservation", "", "Memory soft limit of the container, reclaimed first under pressure")
+	flag.BoolVar(&o.cgopts.StrictLimits, "strict-limits", false, "Reject the cpuset and memory limits beyond the host's capacity, instead of clamping them")
+	flag.Var(throttleValue{&o.cgopts.Blkio.ReadBps, false}, "device-read-bps", "Limit the read rate of a block device as path:rate, like /dev/sda:10mb, can be repeated")
+	flag.Var(throttleValue{&o.cgopts.Blkio.WriteBps, false}, "device-write-bps", "Limit the write rate of a block device as path:rate, like /dev/sda:10mb, can be repeated")
+	flag.Var(throttleValue{&o.cgopts.Blkio.ReadIOPS, true}, "device-read-iops", "Limit the read IOs per second of a block device as path:count, can be repeated")
+	flag.Var(throttleValue{&o.cgopts.Blkio.WriteIOPS, true}, "device-write-iops", "Limit the write IOs per second of a block device as path:count, can be repeated")
+	flag.StringVar(&o.profile, "resource-profile", "", "Cpu and memory limits preset: small, medium, large or one of TINYBOX_HOME/profiles.json, the limit flags override it")
+	flag.StringVar(&o.cgopts.Reuse, "cgroup-reuse", "fail", "Policy for a cgroup left with tasks by a previous run: fail, reuse, or clean to kill them")
 	flag.StringVar(&o.cgopts.CpusetCpus, "cpuset-cpus", "", "")
 	flag.StringVar(&o.cgopts.CpusetMems, "cpuset-mems", "", "")
+	flag.StringVar(&o.cgopts.Root, "cgroup-root", "", "Dir of the cgroup hierarchies like cpu and memory, instead of the mounts found in mountinfo")
+	flag.StringVar(&o.cgopts.Parent, "cgroup-parent", "", "Parent cgroup of the container, a path or systemd slice:prefix:name")
+	flag.StringVar(&o.cgopts.Existing, "cgroup-existing", "", "Join the existing cgroup path of each hierarchy instead of creating one")
+	flag.BoolVar(&o.cgopts.Strict, "cgroup-strict", false, "Fail if an optional cgroup limit can't be written")
+	flag.Var((*deviceValue)(&o.cgopts.Devices), "device", "Add a host device path[:rwm] to the container, can be repeated")
+	flag.Var((*cgroupRawValue)(&o.cgopts.Raw), "cgroup-raw", "Write value into a cgroup file after the limits, controller:file=value, can be repeated")
 }
 
 func (o *Options) Parse() error {
@@ -55,6 +190,9 @@ func (o *Options) Parse() error {
 	if o.name = os.Args[1]; o.name == "" {
 		return ErrOptInvalidName
 	}
+	if err := validateName(o.name); err != nil {
+		return err
+	}
 
 	if os.Args[0] == "init" || os.Args[0] == "setns" {
 		return nil
@@ -72,21 +210,226 @@ func (o *Options) Parse() error {
 
 	var err error
 
-	if o.run != "" {
-		if o.argv, o.args, err = parseRun(o.run); err != nil {
-			return err
+	if o.IsRun() {
+		if o.run != "" {
+			if o.argv, o.args, err = parseRun(o.run); err != nil {
+				return err
+			}
+		} else {
+			o.argv = ""
+		}
+
+		if o.root != "" {
+			if o.root, err = parseRoot(o.root); err != nil {
+				return err
+			}
 		}
 
-		if o.root != "" && !path.IsAbs(o.root) {
-			return ErrOptNoRoot
+		if o.pidfile != "" {
+			if o.pidfile, err = filepath.Abs(o.pidfile); err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.maxStarts == 0 {
+		if v := os.Getenv("TINYBOX_MAX_CONCURRENT_STARTS"); v != "" {
+			if o.maxStarts, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("Invalid TINYBOX_MAX_CONCURRENT_STARTS %s", v)
+			}
+		}
+	}
+
+	if err := o.parseLabels(); err != nil {
+		return err
+	}
+
+	if o.env, err = buildEnv(o.envPass, o.env); err != nil {
+		return err
+	}
+
+	core, err := parseCoreDump(o.coreDump)
+	if err != nil {
+		return err
+	}
+	o.rlimits = append(o.rlimits, core)
+
+	if o.nofile != "" {
+		nofile, err := parseRlimit("nofile", o.nofile)
+		if err != nil {
+			return err
 		}
+		o.rlimits = append(o.rlimits, nofile)
 	}
+	o.rlimits = append(o.rlimits, o.ulimits...)
 
 	return nil
 }
 
+// Config returns the container config of the options, except Home.
+func (o *Options) Config() Config {
+	return Config{
+		Name:            o.name,
+		Run:             o.IsRun(),
+		Exec:            o.IsExec(),
+		Force:           o.force,
+		Rm:              o.rm,
+		Tty:             o.tty,
+		TraceSetup:      o.traceSetup,
+		TraceRedact:     o.traceRedact,
+		Rootfs:          o.root,
+		RootfsTar:       o.rootfsTar,
+		Image:           o.image,
+		ResourceProfile: o.profile,
+		Path:            o.argv,
+		Argv:            o.args,
+		Argv0:           o.argv0,
+		Cwd:             o.wd,
+		Env:             o.env,
+		EnvUnset:        o.envUnset,
+		NoEnvInherit:    !o.envInherit || o.noEnvInherit,
+		KeepEnv:         o.keepEnv,
+		Hostname:        o.hostname,
+		ShmSize:         o.shmSize,
+		TmpAsTmpfs:      o.tmpfs,
+		NoMtab:          o.noMtab,
+		ProcMode:        o.procMode,
+		RootfsSwitch:    o.rootfsSwitch,
+		Propagation:     o.propagation,
+		Localtime:       o.localtime,
+		Timezone:        o.timezone,
+		StopSig:         o.stopSig,
+		Labels:          o.Labels(),
+		Rlimits:         o.rlimits,
+		DNS:             o.dns,
+		NetMode:         o.network,
+		NetnsPath:       o.netnsPath,
+		NetHook:         o.netHook,
+		TimeOffsets:     o.timeOffsets,
+		Fds:             o.fds,
+		Nice:            o.nice,
+		SchedPolicy:     o.schedPolicy,
+		SchedPriority:   o.schedPriority,
+		NoSetsid:        o.noSetsid,
+		Pidfile:         o.pidfile,
+		WaitCmd:         o.waitCmd,
+		WaitTCP:         o.waitTCP,
+		WaitHTTP:        o.waitHTTP,
+		ExecAuthzCmd:    o.execAuthzCmd,
+		OnOOM:           o.onOOM,
+		WaitTimeout:     o.waitTimeout,
+		Timeout:         o.timeout,
+		MaxStarts:       o.maxStarts,
+		Secrets:         o.secrets,
+		Volumes:         o.volumes,
+		VolumesFrom:     o.volumesFrom,
+		KernelIfaces:    o.kernelIfaces,
+		CapProfile:      o.capProfile,
+		CapAdd:          o.capAdd,
+		CapDrop:         o.capDrop,
+		CgOpts:          o.cgopts,
+	}
+}
+
+func (o *Options) IsRun() bool {
+	return o.run != "" || o.image != ""
+}
+
 func (o *Options) IsExec() bool {
-	return o.run == "" && o.exec != ""
+	return !o.IsRun() && o.exec != ""
+}
+
+// parseLabels puts the labels of the label file before the ones of the
+// command line, so those override the file, and checks each is key=value.
+func (o *Options) parseLabels() error {
+	if o.labelFile != "" {
+		lines, err := readLines(o.labelFile)
+		if err != nil {
+			return err
+		}
+		o.labels = append(lines, o.labels...)
+	}
+	for _, label := range o.labels {
+		if _, _, err := parseKV(label); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Labels returns the labels as a map, later ones override earlier ones.
+func (o *Options) Labels() map[string]string {
+	if len(o.labels) == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string, len(o.labels))
+	for _, label := range o.labels {
+		k, v, _ := parseKV(label)
+		labels[k] = v
+	}
+	return labels
+}
+
+// listValue is a flag can be set by more than once.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseKV parses key=value.
+func parseKV(s string) (string, string, error) {
+	ix := strings.Index(s, "=")
+	if ix <= 0 {
+		return "", "", fmt.Errorf("Invalid key=value: %s", s)
+	}
+	return s[:ix], s[ix+1:], nil
+}
+
+// readLines reads non-empty lines of a file, skipping # comments.
+func readLines(file string) ([]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// parseRoot resolves the rootfs to an absolute path, so it stays valid
+// after the working directory changes, and checks it is a directory.
+func parseRoot(root string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("Rootfs %s does not exist", abs)
+		}
+		return "", fmt.Errorf("Rootfs %s: %v", abs, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("Rootfs %s is not a directory", abs)
+	}
+
+	return abs, nil
 }
 
 func parseRun(run string) (string, []string, error) {
@@ -0,0 +1,97 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseRoot resolves a relative rootfs against the working directory,
+// a missing one or a file is an error naming the path.
+func TestParseRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "rootfs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		root string
+		want string
+		err  string
+	}{
+		{"rootfs", filepath.Join(dir, "rootfs"), ""},
+		{"./rootfs/", filepath.Join(dir, "rootfs"), ""},
+		{filepath.Join(dir, "rootfs"), filepath.Join(dir, "rootfs"), ""},
+		{"missing", "", filepath.Join(dir, "missing") + " does not exist"},
+		{"file", "", filepath.Join(dir, "file") + " is not a directory"},
+	}
+	for _, tt := range tests {
+		got, err := parseRoot(tt.root)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseRoot(%q) = %v, want an error with %q", tt.root, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseRoot(%q) = %s, %v, want %s", tt.root, got, err, tt.want)
+		}
+	}
+}
+
+// TestLabels merges the labels of a file and of the command line, the
+// command line wins.
+func TestLabels(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "labels")
+	data := "# team labels\napp=web\n\nteam=infra\nenv=dev\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		labels listValue
+		file   string
+		want   map[string]string
+		ok     bool
+	}{
+		{"none", nil, "", nil, true},
+		{"flags", listValue{"app=db", "tier=back=end"}, "", map[string]string{"app": "db", "tier": "back=end"}, true},
+		{"empty value", listValue{"app="}, "", map[string]string{"app": ""}, true},
+		{"file", nil, file, map[string]string{"app": "web", "team": "infra", "env": "dev"}, true},
+		{"flag overrides file", listValue{"env=prod"}, file, map[string]string{"app": "web", "team": "infra", "env": "prod"}, true},
+		{"last flag wins", listValue{"env=a", "env=b"}, "", map[string]string{"env": "b"}, true},
+		{"no value", listValue{"app"}, "", nil, false},
+		{"no key", listValue{"=web"}, "", nil, false},
+		{"missing file", nil, file + ".missing", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Options{labels: tt.labels, labelFile: tt.file}
+			err := o.parseLabels()
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseLabels = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if got := o.Labels(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
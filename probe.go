@@ -0,0 +1,139 @@
+package tinybox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// probeTimeout bounds one run of a network probe.
+const probeTimeout = time.Second
+
+// readinessProbe is one check of waitReady, it's run until it succeeds.
+type readinessProbe struct {
+	name  string
+	check func() error
+}
+
+// readinessProbes are the probes of the container, in the order they're
+// waited.
+func (p *masterProcess) readinessProbes(c *Container) []readinessProbe {
+	var probes []readinessProbe
+	if c.WaitCmd != "" {
+		probes = append(probes, readinessProbe{c.WaitCmd, func() error {
+			status, err := p.execIn(c, c.WaitCmd, nil)
+			if err != nil {
+				return err
+			}
+			if !status.Success() {
+				return fmt.Errorf("%s", status)
+			}
+			return nil
+		}})
+	}
+	if c.WaitTCP != "" {
+		probes = append(probes, readinessProbe{"tcp " + c.WaitTCP, func() error {
+			conn, err := dialNetns(c.Pid, "tcp", c.WaitTCP)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}})
+	}
+	if c.WaitHTTP != "" {
+		probes = append(probes, readinessProbe{"http " + c.WaitHTTP, func() error {
+			return httpProbe(c.Pid, c.WaitHTTP)
+		}})
+	}
+	return probes
+}
+
+// dialNetns dials addr from the network namespace of the process pid. A
+// host name is resolved on the host.
+func dialNetns(pid int, network, addr string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// instead of running others in the container's namespace.
+		runtime.LockOSThread()
+
+		ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		defer ns.Close()
+
+		_, _, e := syscall.RawSyscall(sysSetns, ns.Fd(), syscall.CLONE_NEWNET, 0)
+		if e != 0 {
+			err = e
+		}
+		trace("setns", err, strconv.Itoa(pid), "net")
+		if err != nil {
+			done <- result{nil, fmt.Errorf("Enter network namespace of %d: %v", pid, err)}
+			return
+		}
+
+		conn, err := net.DialTimeout(network, addr, probeTimeout)
+		done <- result{conn, err}
+	}()
+
+	r := <-done
+	return r.conn, r.err
+}
+
+// httpProbe succeeds if a GET of rawurl from the network namespace of
+// the process pid returns a 2xx or 3xx status, a redirect isn't followed.
+func httpProbe(pid int, rawurl string) error {
+	client := &http.Client{
+		Timeout: probeTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialNetns(pid, network, addr)
+			},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// validateProbes checks the addresses of the network probes.
+func validateProbes(tcp, rawurl string) error {
+	if tcp != "" {
+		if _, port, err := net.SplitHostPort(tcp); err != nil || port == "" {
+			return fmt.Errorf("Invalid wait for tcp %s, expect host:port", tcp)
+		}
+	}
+	if rawurl != "" {
+		u, err := url.Parse(rawurl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid wait for http %s, expect an http or https url", rawurl)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package tinybox
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestValidateProbes(t *testing.T) {
+	tests := []struct {
+		tcp, url string
+		ok       bool
+	}{
+		{"127.0.0.1:8080", "", true},
+		{"localhost:80", "", true},
+		{"[::1]:80", "", true},
+		{"127.0.0.1", "", false},
+		{"127.0.0.1:", "", false},
+		{"", "http://127.0.0.1:8080/health", true},
+		{"", "https://localhost/", true},
+		{"", "ftp://localhost/", false},
+		{"", "/health", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		err := validateProbes(tt.tcp, tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("validateProbes(%q, %q) = %v, want ok %v", tt.tcp, tt.url, err, tt.ok)
+		}
+	}
+}
+
+// listenNetns listens on the loopback of a new network namespace, which
+// only the returned thread id is in.
+func listenNetns(t *testing.T) (int, net.Listener) {
+	t.Helper()
+	if syscall.Geteuid() != 0 {
+		t.Skip("needs root to create a network namespace")
+	}
+
+	type result struct {
+		tid int
+		ln  net.Listener
+		err error
+	}
+	done := make(chan result)
+	hold := make(chan struct{})
+	t.Cleanup(func() { close(hold) })
+
+	go func() {
+		// The thread is never unlocked, it exits with the goroutine.
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			done <- result{err: err}
+			return
+		}
+		if err := loopbackUp(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		done <- result{syscall.Gettid(), ln, err}
+		<-hold
+	}()
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	t.Cleanup(func() { r.ln.Close() })
+	return r.tid, r.ln
+}
+
+// loopbackUp sets lo up in the network namespace of the thread.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	ifr.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	return ioctl(uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+}
+
+func TestDialNetns(t *testing.T) {
+	tid, ln := listenNetns(t)
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	// Nothing listens on the port yet.
+	if conn, err := dialNetns(tid, "tcp", "127.0.0.1:1"); err == nil {
+		conn.Close()
+		t.Error("TCP probe succeeded without a listener")
+	}
+
+	conn, err := dialNetns(tid, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("TCP probe in the namespace: %v", err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener isn't in the host's network.
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("TCP probe from the host reached %s", ln.Addr())
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	tid, ln := listenNetns(t)
+
+	// The path is the status to answer.
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if status == http.StatusFound {
+			http.Redirect(w, r, "/elsewhere", status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+
+	tests := []struct {
+		status int
+		ok     bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNoContent, true},
+		{http.StatusFound, true},
+		{http.StatusNotFound, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		err := httpProbe(tid, fmt.Sprintf("http://%s/%d", ln.Addr(), tt.status))
+		if (err == nil) != tt.ok {
+			t.Errorf("httpProbe with status %d = %v, want ok %v", tt.status, err, tt.ok)
+		}
+	}
+}
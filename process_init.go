@@ -1,37 +1,229 @@
 package tinybox
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type initProcess struct {
 }
 
+// Start sets up the container and execs its process, a setup error is
+// recorded in the journal for the master to report it.
 func (p *initProcess) Start(c *Container) error {
+	// It's opened before chroot hides the container's dir.
+	journal, jerr := os.OpenFile(c.JournalFile(), os.O_WRONLY|os.O_APPEND, 0)
+	if jerr == nil {
+		defer journal.Close()
+	}
+
+	err := p.setup(c)
+	if err != nil && jerr == nil {
+		rec := journalRecord{Step: stepInitFailed, Time: time.Now(), Error: err.Error()}
+		if err := json.NewEncoder(journal).Encode(&rec); err != nil {
+			log.Printf("Write journal %s error: %v \n", rec.Step, err)
+		}
+	}
+	return err
+}
+
+func (p *initProcess) setup(c *Container) error {
+	// Close the start slot on exec, so it's held during the setup only.
+	if fd, err := strconv.Atoi(os.Getenv(startLockEnv)); err == nil {
+		syscall.CloseOnExec(fd)
+	}
+
 	if err := c.WaitJson(); err != nil {
 		return fmt.Errorf("Init process load container error: %v", err)
 	}
+	startTrace(c, "init")
 
 	if debug {
 		log.Printf("Container info: %+v \n", c)
 	}
 
+	c.journal(journalRecord{Step: stepNamespaces})
+
 	// Mount filesystem
 	if err := c.fsop.Mount(c); err != nil {
-		return err
+		return setupErr("mount", err)
+	}
+
+	// The mounts are in the container's mount namespace and go with it,
+	// they aren't recorded for a rollback.
+	c.journal(journalRecord{Step: stepMounts})
+
+	// The hostname is only set in a new uts namespace, which the container
+	// has with a rootfs.
+	if c.Hostname != "" {
+		if err := syscall.Sethostname([]byte(c.Hostname)); err != nil {
+			return setupErr("hostname", err)
+		}
 	}
 
 	// Chroot, if have root path.
 	if c.Rootfs != "" {
 		if err := c.fsop.Chroot(c); err != nil {
-			return err
+			return setupErr("chroot", err)
+		}
+
+		if err := chdirCwd(c.Cwd); err != nil {
+			return setupErr("cwd", err)
+		}
+	}
+
+	if err := setRlimits(c); err != nil {
+		return setupErr("rlimit", err)
+	}
+
+	if err := setSched(c); err != nil {
+		return setupErr("sched", err)
+	}
+
+	if err := setTimens(c); err != nil {
+		return setupErr("time namespace", err)
+	}
+
+	// Lead a new session and process group, so signals sent to the group
+	// reach all processes of the container.
+	if !c.NoSetsid {
+		if _, err := syscall.Setsid(); err != nil {
+			return setupErr("setsid", err)
+		}
+	}
+
+	// The pty on stdin is the controlling terminal of the new session.
+	if c.Tty {
+		if err := ioctl(0, syscall.TIOCSCTTY, 0); err != nil {
+			return setupErr("tty", err)
 		}
 	}
 
-	log.Printf("Run init process: %s, %v", c.Path, c.Argv)
+	if err := setCaps(c); err != nil {
+		return setupErr("capabilities", err)
+	}
+
+	env := mergeEnv(baseEnv(c.KeepEnv, c.Hostname), c.Env, c.EnvUnset)
+	if c.Fds > 0 {
+		if err := preserveFds(c.Fds); err != nil {
+			return setupErr("fds", err)
+		}
+		env = append(env,
+			fmt.Sprintf("LISTEN_FDS=%d", c.Fds),
+			fmt.Sprintf("LISTEN_PID=%d", os.Getpid()))
+	}
+
+	path, err := lookPath(c.Path, env)
+	if err != nil {
+		return setupErr("exec", err)
+	}
+	if err := checkExecutable(path); err != nil {
+		return setupErr("exec", err)
+	}
+
+	log.Printf("Run init process: %s, %v", path, c.Argv)
+
+	if err := syscall.Exec(path, c.Argv, env); err != nil {
+		return setupErr("exec", fmt.Errorf("%s: %v", path, err))
+	}
+	return nil
+}
+
+// checkExecutable checks path is an executable file, so a missing binary
+// isn't reported as a bare ENOENT of execve.
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrExecNotFound, path)
+		}
+		return err
+	}
+	if !info.Mode().IsRegular() || syscall.Access(path, 1) != nil {
+		return fmt.Errorf("%w: %s", ErrExecPermission, path)
+	}
+	return nil
+}
+
+// defaultPath is searched if the container's env has no PATH.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// lookPath searches file in PATH of env, it must be called after chroot
+// to search the rootfs. A file with a slash is used as it is.
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+
+	dirs := defaultPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			dirs = kv[len("PATH="):]
+		}
+	}
+
+	for _, dir := range filepath.SplitList(dirs) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, file)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s in %s", ErrExecNotFound, file, dirs)
+}
+
+// preserveFds keeps fds 3 to 3+n-1 open across exec, all other fds above
+// stderr are closed on exec.
+func preserveFds(n int) error {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil || fd < 3 {
+			continue
+		}
+		if fd < 3+n {
+			if _, err := fcntl(fd, syscall.F_SETFD, 0); err != nil {
+				return fmt.Errorf("Preserve fd %d: %v", fd, err)
+			}
+			continue
+		}
+		syscall.CloseOnExec(fd)
+	}
+	return nil
+}
+
+// chdirCwd changes into the container's working directory, it must be
+// called after chroot.
+func chdirCwd(cwd string) error {
+	if cwd == "" {
+		return nil
+	}
+
+	info, err := os.Stat(cwd)
+	if err != nil {
+		return fmt.Errorf("Working directory %s not found in rootfs: %v", cwd, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Working directory %s is not a directory", cwd)
+	}
 
-	return syscall.Exec(c.Path, c.Argv, os.Environ())
+	return syscall.Chdir(cwd)
 }
@@ -0,0 +1,280 @@
+package tinybox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestChdirCwd starts in the working directory of a rootfs, after the
+// chroot its paths are absolute in it.
+func TestChdirCwd(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "srv", "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	tests := []struct {
+		cwd  string
+		want string // the directory after, an error if ""
+	}{
+		{"", wd},
+		{filepath.Join(root, "srv", "app"), filepath.Join(root, "srv", "app")},
+		{filepath.Join(root, "missing"), ""},
+		{filepath.Join(root, "file"), ""},
+	}
+	for _, tt := range tests {
+		os.Chdir(wd)
+		err := chdirCwd(tt.cwd)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("chdirCwd(%q) succeeded, want an error", tt.cwd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("chdirCwd(%q) = %v", tt.cwd, err)
+			continue
+		}
+		if got, _ := os.Getwd(); got != tt.want {
+			t.Errorf("chdirCwd(%q) changed into %s, want %s", tt.cwd, got, tt.want)
+		}
+	}
+}
+
+// TestPreserveFds passes two pipes into a child of the test, which keeps
+// the first n across an exec of sh, and closes the others.
+func TestPreserveFds(t *testing.T) {
+	if os.Getenv("TINYBOX_TEST_FDS") != "" {
+		n, _ := strconv.Atoi(os.Getenv("TINYBOX_TEST_FDS"))
+		if err := preserveFds(n); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		script := `for fd in 3 4; do [ -e /proc/self/fd/$fd ] && read line <&$fd && echo $line; done; exit 0`
+		err := syscall.Exec("/bin/sh", []string{"sh", "-c", script}, os.Environ())
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{0, ""},
+		{1, "fd3\n"},
+		{2, "fd3\nfd4\n"},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPreserveFds$")
+		cmd.Env = append(os.Environ(), "TINYBOX_TEST_FDS="+strconv.Itoa(tt.n))
+		for _, line := range []string{"fd3\n", "fd4\n"} {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.WriteString(line)
+			w.Close()
+			defer r.Close()
+			cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		}
+
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		if string(out) != tt.want {
+			t.Errorf("preserveFds(%d) passed %q, want %q", tt.n, out, tt.want)
+		}
+	}
+}
+
+// TestLookPath resolves a bare command name in PATH of the container's env
+// and runs it, a file not executable is passed over.
+func TestLookPath(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	os.Mkdir(first, 0755)
+	os.Mkdir(second, 0755)
+	ioutil.WriteFile(filepath.Join(first, "hello"), []byte("#!/bin/sh\necho first\n"), 0644)
+	ioutil.WriteFile(filepath.Join(second, "hello"), []byte("#!/bin/sh\necho second\n"), 0755)
+	path := "PATH=" + first + ":" + second
+
+	tests := []struct {
+		name string
+		file string
+		env  []string
+		want string // the output of the resolved binary, an error if ""
+	}{
+		{"in PATH", "hello", []string{"HOME=/root", path}, "second\n"},
+		{"default PATH", "sh", []string{"HOME=/root"}, "default\n"},
+		{"not found", "hello", []string{"PATH=" + first}, ""},
+		{"with a slash", filepath.Join(second, "hello"), nil, "second\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := lookPath(tt.file, tt.env)
+			if tt.want == "" {
+				if !errors.Is(err, ErrExecNotFound) || !strings.Contains(err.Error(), first) {
+					t.Fatalf("lookPath = %s, %v, want %v listing %s", resolved, err, ErrExecNotFound, first)
+				}
+				return
+			}
+			if err != nil || !filepath.IsAbs(resolved) {
+				t.Fatalf("lookPath = %s, %v", resolved, err)
+			}
+
+			cmd := exec.Command(resolved)
+			if tt.file == "sh" {
+				cmd.Args = append(cmd.Args, "-c", "echo default")
+			}
+			out, err := cmd.Output()
+			if err != nil || string(out) != tt.want {
+				t.Errorf("%s printed %q, %v, want %q", resolved, out, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckExecutable(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "exe")
+	noexec := filepath.Join(dir, "noexec")
+	fifo := filepath.Join(dir, "fifo")
+	if err := ioutil.WriteFile(exe, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(noexec, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(fifo, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		err  error // nil for executable
+	}{
+		{"executable", exe, nil},
+		{"missing", filepath.Join(dir, "missing"), ErrExecNotFound},
+		{"missing dir", filepath.Join(dir, "missing", "exe"), ErrExecNotFound},
+		{"no exec permission", noexec, ErrExecPermission},
+		{"dir", dir, ErrExecPermission},
+		{"fifo", fifo, ErrExecPermission},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkExecutable(tt.path)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("checkExecutable = %v, want %v", err, tt.err)
+			}
+			if err != nil && err.Error() != tt.err.Error()+": "+tt.path {
+				t.Errorf("error %q, want the path in it", err)
+			}
+		})
+	}
+}
+
+// TestInitExecMissing runs the init process in a child of the test with a
+// binary that can't be run, the master reports why and the exit is
+// non-zero.
+func TestInitExecMissing(t *testing.T) {
+	if dir := os.Getenv("TINYBOX_TEST_INIT_DIR"); dir != "" {
+		path := os.Getenv("TINYBOX_TEST_INIT_PATH")
+		c := &Container{
+			Name:     filepath.Base(dir),
+			Dir:      dir,
+			Path:     path,
+			Argv:     []string{path},
+			CgOpts:   &CGroupOptions{},
+			fsop:     &rootFs{},
+			cgop:     &CGroup{paths: map[string]string{}},
+			NoSetsid: true, // the test binary may lead its group already
+		}
+		if err := c.createPipe(); err != nil {
+			fmt.Println(err)
+			os.Exit(100)
+		}
+		go c.writePipe(context.Background())
+		if err := (&initProcess{}).Start(c); err != nil {
+			fmt.Println(err)
+			os.Exit(100)
+		}
+		os.Exit(0)
+	}
+
+	noexec := filepath.Join(t.TempDir(), "noexec")
+	if err := ioutil.WriteFile(noexec, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"not found", "/nonexistent/app", "Init process: Setup exec: executable file not found: /nonexistent/app"},
+		{"permission", noexec, "Init process: Setup exec: permission denied: " + noexec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			c := &Container{
+				Name:   "app",
+				Dir:    filepath.Join(home, "app"),
+				CgOpts: &CGroupOptions{},
+				fsop:   &rootFs{},
+				cgop:   &CGroup{paths: map[string]string{}},
+			}
+			if err := os.Mkdir(c.Dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			c.journal(journalRecord{Step: stepCreateBegin})
+
+			out, err := os.Create(filepath.Join(home, "out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			cmd := exec.Command(os.Args[0], "-test.run=^TestInitExecMissing$")
+			cmd.Env = append(os.Environ(), "TINYBOX_TEST_INIT_DIR="+c.Dir, "TINYBOX_TEST_INIT_PATH="+tt.path)
+			cmd.Stdout, cmd.Stderr = out, out
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			c.Pid = cmd.Process.Pid
+
+			// Like Start, the master waits the init process to exit.
+			p := master()
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.events(c)
+			}()
+			err = p.wait(c)
+			output, _ := ioutil.ReadFile(out.Name())
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("wait = %v, want %q: %s", err, tt.want, output)
+			}
+			if c.ExitStatus == nil || c.ExitStatus.Code == 0 {
+				t.Errorf("exit status %+v, want non-zero", c.ExitStatus)
+			}
+		})
+	}
+}
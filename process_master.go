@@ -1,13 +1,16 @@
 package tinybox
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -15,20 +18,42 @@ import (
 	"github.com/skoo87/tinybox/pipe"
 )
 
+// stopTimeout is how long the init process has to exit on the stop
+// signal before it is killed.
+var stopTimeout = time.Second * 10
+
+// probeInterval is the delay between two runs of the readiness probe.
+const probeInterval = time.Millisecond * 500
+
 const (
-	evStop  = "stop"
-	evChild = "child"
-	evExec  = "exec"
-	evInfo  = "info"
+	evStop    = "stop"
+	evChild   = "child"
+	evExec    = "exec"
+	evInfo    = "info"
+	evTimeout = "timeout"
+	evResize  = "resize"
 )
 
 type masterProcess struct {
-	cmd  *exec.Cmd
-	opt  Options
-	ec   chan event
-	sigs map[os.Signal]func(os.Signal, chan event)
-	stop chan struct{}
-	wg   sync.WaitGroup
+	cmd    *exec.Cmd
+	status syscall.WaitStatus // exit status of the init process
+	opt    Options
+	ec     chan event
+	sigs   map[os.Signal]func(os.Signal, chan event)
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	reason string // why the master stopped the init process
+
+	// The pty of the container with --tty, and the state of the host
+	// terminal before raw mode.
+	pty     *os.File
+	term    *syscall.Termios
+	ptyDone chan struct{}
+
+	// helpers are the commands the master runs on the host while the
+	// reaper waits all children, their status is handed over by the pid.
+	helpersMu sync.Mutex
+	helpers   map[int]chan syscall.WaitStatus
 }
 
 func master() *masterProcess {
@@ -38,45 +63,65 @@ func master() *masterProcess {
 			syscall.SIGINT:  stopHandle,
 			syscall.SIGTERM: stopHandle,
 		},
-		stop: make(chan struct{}),
+		stop:    make(chan struct{}),
+		helpers: make(map[int]chan syscall.WaitStatus),
 	}
 }
 
 func (p *masterProcess) eStart(c *Container) error {
-	parent, child, err := pipe.New()
+	if err := c.authorizeExec(execArgv(c.Path)); err != nil {
+		return err
+	}
+
+	status, err := p.execIn(c, c.Path, os.Stdin)
 	if err != nil {
 		return err
 	}
+
+	log.Printf("Exec process: %d exit \n", status.Pid())
+	return nil
+}
+
+// execIn runs cmd in the namespaces of the running container c through
+// the setns process, and waits it.
+func (p *masterProcess) execIn(c *Container, cmd string, stdin *os.File) (*os.ProcessState, error) {
+	parent, child, err := pipe.New()
+	if err != nil {
+		return nil, err
+	}
 	defer parent.Close()
 	defer child.Close()
 
 	// lock file
 	lock, err := Flock(c.LockFile())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cmd := &exec.Cmd{
+	setns := &exec.Cmd{
 		Dir:    "/",
 		Path:   "/proc/self/exe",
 		Args:   []string{"setns", c.Name},
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
-		Stdin:  os.Stdin,
+		Stdin:  stdin,
 	}
-	if cmd.SysProcAttr == nil {
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if setns.SysProcAttr == nil {
+		setns.SysProcAttr = &syscall.SysProcAttr{}
 	}
-	cmd.ExtraFiles = append(cmd.ExtraFiles, child)
+	setns.ExtraFiles = append(setns.ExtraFiles, child)
 
-	cmd.Env = append(cmd.Env, os.Environ()...)
-	cmd.Env = append(cmd.Env, fmt.Sprintf("__TINYBOX_INIT_PID__=%d", c.Pid))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("__TINYBOX_PIPE__=%d", 2+len(cmd.ExtraFiles)))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("__TINYBOX_CMD__=%s", c.Path))
+	setns.Env = append(setns.Env, mergeEnv(baseEnv(c.KeepEnv, ""), c.Env, c.EnvUnset)...)
+	setns.Env = append(setns.Env, fmt.Sprintf("%s=%s", homeEnv, filepath.Dir(c.Dir)))
+	setns.Env = append(setns.Env, fmt.Sprintf("__TINYBOX_INIT_PID__=%d", c.Pid))
+	setns.Env = append(setns.Env, fmt.Sprintf("__TINYBOX_PIPE__=%d", 2+len(setns.ExtraFiles)))
+	setns.Env = append(setns.Env, fmt.Sprintf("__TINYBOX_CMD__=%s", cmd))
 
-	if err := cmd.Start(); err != nil {
+	err = setns.Start()
+	trace("setns", err, strconv.Itoa(c.Pid), cmd)
+	if err != nil {
 		Funlock(lock)
-		return fmt.Errorf("Start setns process error: %v", err)
+		return nil, fmt.Errorf("Start setns process error: %v", err)
 	}
 
 	pid := struct {
@@ -84,16 +129,16 @@ func (p *masterProcess) eStart(c *Container) error {
 	}{}
 	if err := json.NewDecoder(parent).Decode(&pid); err != nil {
 		Funlock(lock)
-		return err
+		return nil, err
 	}
 
 	if debug {
 		log.Printf("Exec process pid: %d \n", pid.Pid)
 	}
 
-	if status, err := cmd.Process.Wait(); err != nil {
+	if status, err := setns.Process.Wait(); err != nil {
 		Funlock(lock)
-		return err
+		return nil, err
 	} else {
 		log.Printf("setns process: %d exit \n", status.Pid())
 	}
@@ -101,18 +146,37 @@ func (p *masterProcess) eStart(c *Container) error {
 	process, err := os.FindProcess(pid.Pid)
 	if err != nil {
 		Funlock(lock)
-		return err
+		return nil, err
 	}
 
 	// unlock file
 	Funlock(lock)
 
-	if status, err := process.Wait(); err != nil {
-		return err
-	} else {
-		log.Printf("Exec process: %d exit \n", status.Pid())
-	}
+	return process.Wait()
+}
+
+// waitReady runs c.WaitCmd in the container until it exits with 0, it
+// fails if that doesn't happen in c.WaitTimeout or the init process exits
+// first. It must run before the reaper, which would wait the probes.
+func (p *masterProcess) waitReady(c *Container) error {
+	deadline := time.Now().Add(c.WaitTimeout)
+	for _, probe := range p.readinessProbes(c) {
+		for {
+			err := probe.check()
+			if err == nil {
+				log.Printf("Container is ready: %s \n", probe.name)
+				break
+			}
 
+			if processExited(c.Pid) {
+				return fmt.Errorf("Init process exited before %s succeeded", probe.name)
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Wait for %s timeout after %s: %v", probe.name, c.WaitTimeout, err)
+			}
+			time.Sleep(probeInterval)
+		}
+	}
 	return nil
 }
 
@@ -121,6 +185,10 @@ func (p *masterProcess) Start(c *Container) error {
 		return p.eStart(c)
 	}
 
+	if c.Tty {
+		p.sigs[syscall.SIGWINCH] = resizeHandle
+	}
+
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
@@ -148,69 +216,325 @@ func (p *masterProcess) Start(c *Container) error {
 	}
 	p.cmd.SysProcAttr.Cloneflags = c.nsop.Cloneflags(c)
 
+	var pts *os.File
+	if c.Tty {
+		ptm, slave, err := openPty()
+		if err != nil {
+			return setupErr("tty", err)
+		}
+		defer ptm.Close()
+		pts = slave
+		p.cmd.Stdin, p.cmd.Stdout, p.cmd.Stderr = pts, pts, pts
+		p.attachTTY(ptm)
+		defer p.restoreTerminal()
+	}
+
+	for i := 0; i < c.Fds; i++ {
+		fd := 3 + i
+		if _, err := fcntl(fd, syscall.F_GETFD, 0); err != nil {
+			return fmt.Errorf("Preserve fd %d: %v", fd, err)
+		}
+		p.cmd.ExtraFiles = append(p.cmd.ExtraFiles, os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)))
+	}
+
 	p.cmd.Env = append(p.cmd.Env, os.Environ()...)
 
-	if err := p.cmd.Start(); err != nil {
+	// The init process holds the start slot until it execs the container
+	// process, the slot is closed on exec there.
+	var slot *os.File
+	if c.MaxStarts > 0 {
+		var err error
+		if slot, err = acquireStartSlot(filepath.Dir(c.Dir), c.MaxStarts); err != nil {
+			return setupErr("start slot", err)
+		}
+
+		p.cmd.ExtraFiles = append(p.cmd.ExtraFiles, slot)
+		p.cmd.Env = append(p.cmd.Env, fmt.Sprintf("%s=%d", startLockEnv, 2+len(p.cmd.ExtraFiles)))
+	}
+
+	// Become the reaper of all container processes, even the ones
+	// reparented after their parent exits.
+	if err := setSubreaper(); err != nil {
+		return setupErr("subreaper", err)
+	}
+
+	c.journal(journalRecord{Step: stepCreateBegin})
+	startTrace(c, "master")
+	if err := os.Remove(c.ExitStatusFile()); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
+	err := p.cmd.Start()
+	if slot != nil {
+		slot.Close()
+	}
+	if pts != nil {
+		pts.Close()
+	}
+	pid := 0
+	if err == nil {
+		pid = p.cmd.Process.Pid
+	}
+	trace("clone", err, fmt.Sprintf("%#x", p.cmd.SysProcAttr.Cloneflags), strconv.Itoa(pid))
+	if err != nil {
+		return setupErr("init process", err)
+	}
+
 	// Save container pid.
 	c.Pid = p.cmd.Process.Pid
 
 	// Set cgroup before init process.
 	if err := p.cgroup(c); err != nil {
-		log.Println(err)
-		return p.failToWait(c)
+		return p.failToWait(c, setupErr("cgroup", err))
+	}
+
+	// An existing cgroup isn't the container's to roll back.
+	var cgroups []string
+	if c.CgOpts.Existing == "" {
+		for _, path := range c.cgop.Paths() {
+			cgroups = append(cgroups, path)
+		}
+	}
+	sort.Strings(cgroups)
+	c.journal(journalRecord{Step: stepCgroups, Cgroups: cgroups})
+
+	if err := p.watchOOM(c); err != nil {
+		log.Printf("Watch OOM error: %v \n", err)
+	}
+
+	if c.Namespaces, err = c.nsop.Inspect(c); err != nil {
+		log.Printf("Inspect namespaces error: %v \n", err)
+	}
+
+	if err := c.setupNetwork(); err != nil {
+		return p.failToWait(c, setupErr("network", err))
 	}
 
 	// Send info to container init process.
-	c.writePipe()
+	if err := c.writePipe(context.Background()); err != nil {
+		return p.failToWait(c, setupErr("sync", err))
+	}
+
+	// The secrets are only for the init process, never on disk.
+	for i := range c.Secrets {
+		c.Secrets[i].Data = nil
+	}
 
 	// write container's info into disk
-	info, err := json.Marshal(c)
-	if err != nil {
+	if err := c.saveJson(); err != nil {
 		log.Println(err)
-	} else {
-		if err = ioutil.WriteFile(c.JsonFile(), info, 0644); err != nil {
-			log.Println(err)
+	}
+	if err := c.writePidfile(); err != nil {
+		return p.failToWait(c, setupErr("pidfile", err))
+	}
+	c.journal(journalRecord{Step: stepStarted, Pid: c.Pid})
+
+	if c.Timeout > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.deadline(c)
+		}()
+	}
+
+	if c.WaitCmd != "" || c.WaitTCP != "" || c.WaitHTTP != "" {
+		if err := p.waitReady(c); err != nil {
+			return p.failToWait(c, setupErr("readiness", err))
 		}
 	}
+	stopTrace()
 
 	return p.wait(c)
 }
 
-func (p *masterProcess) failToWait(c *Container) error {
+// failToWait kills the init process of a failed setup and waits it, the
+// setup error is returned after the cleanup.
+func (p *masterProcess) failToWait(c *Container, err error) error {
 	syscall.Kill(c.Pid, syscall.SIGKILL)
-	return p.wait(c)
+	p.wait(c)
+	return err
 }
 
 func (p *masterProcess) wait(c *Container) error {
 	go func() {
-		p.cmd.Wait()
+		p.reap(c)
 		close(p.stop)
 		log.Println("Stop master process")
 	}()
 
 	p.wg.Wait()
+
+	// Drain what the container wrote to its tty, an orphan still holding
+	// the tty doesn't block the exit.
+	if p.ptyDone != nil {
+		select {
+		case <-p.ptyDone:
+		case <-time.After(time.Second):
+		}
+	}
+
+	// Read before cleanup, which removes the journal with --rm.
+	failed := c.initFailure()
 	p.cleanup(c)
 
+	if failed != "" {
+		return fmt.Errorf("Init process: %s", failed)
+	}
+	return nil
+}
+
+// reap waits all children until the init process exits, as the master is
+// a subreaper, the orphaned descendants of the container are reaped here
+// too. Except the init process, the master has no other children, so any
+// other pid belongs to the container.
+func (p *masterProcess) reap(c *Container) {
+	options := 0
+	for {
+		var ws syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &ws, options, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid == 0 {
+			if err != nil && err != syscall.ECHILD {
+				log.Printf("Wait children error: %v \n", err)
+			}
+			return
+		}
+
+		if pid == c.Pid {
+			p.status = ws
+			log.Printf("Init process: %d exit, status: %d \n", pid, ws.ExitStatus())
+
+			// Don't block on the remaining children.
+			options = syscall.WNOHANG
+			continue
+		}
+
+		p.helpersMu.Lock()
+		ch, ok := p.helpers[pid]
+		delete(p.helpers, pid)
+		p.helpersMu.Unlock()
+		if ok {
+			ch <- ws
+			continue
+		}
+
+		log.Printf("Reap container process: %d \n", pid)
+	}
+}
+
+// runHelper runs cmd on the host and waits it, it's killed after timeout.
+// The reaper hands its status over, or if the reaper has returned, it's
+// waited here.
+func (p *masterProcess) runHelper(cmd *exec.Cmd, timeout time.Duration) error {
+	ch := make(chan syscall.WaitStatus, 1)
+
+	// The reaper looks up the pid under the lock, so it can't miss it.
+	p.helpersMu.Lock()
+	if err := cmd.Start(); err != nil {
+		p.helpersMu.Unlock()
+		return err
+	}
+	pid := cmd.Process.Pid
+	p.helpers[pid] = ch
+	p.helpersMu.Unlock()
+
+	kill := time.AfterFunc(timeout, func() {
+		log.Printf("Kill helper %s: %d after %s \n", cmd.Path, pid, timeout)
+		syscall.Kill(pid, syscall.SIGKILL)
+	})
+	defer kill.Stop()
+
+	var ws syscall.WaitStatus
+	select {
+	case ws = <-ch:
+	case <-p.stop:
+		if state, err := cmd.Process.Wait(); err == nil {
+			ws = state.Sys().(syscall.WaitStatus)
+		} else {
+			ws = <-ch
+		}
+	}
+
+	p.helpersMu.Lock()
+	delete(p.helpers, pid)
+	p.helpersMu.Unlock()
+
+	if ws.Signaled() {
+		return fmt.Errorf("%s killed by %s", cmd.Path, ws.Signal())
+	}
+	if ws.ExitStatus() != 0 {
+		return fmt.Errorf("%s exit status %d", cmd.Path, ws.ExitStatus())
+	}
 	return nil
 }
 
 func (p *masterProcess) cleanup(c *Container) {
 	c.fsop.Unmount(c)
 
-	if err := os.Remove(c.PipeFile()); err != nil {
-		log.Printf("Remove pipe %s error: %v \n", err)
+	// The kill count is gone with the memory cgroup.
+	var kills int64
+	if dir := c.cgop.Paths()[subsysMEM]; dir != "" {
+		kills, _ = oomKills(dir)
 	}
 
-	for _, path := range c.cgop.Paths() {
-		if err := os.Remove(path); err != nil {
-			if !os.IsNotExist(err) {
-				log.Printf("Remove %s error: %v \n", path, err)
+	// The rootfs extracted from a tarball or an image belongs to the
+	// container.
+	if c.RootfsTar != "" || c.Image != "" {
+		if err := os.RemoveAll(c.Rootfs); err != nil {
+			log.Printf("Remove rootfs %s error: %v \n", c.Rootfs, err)
+		}
+	}
+
+	if err := os.Remove(c.PipeFile()); err != nil && !os.IsNotExist(err) {
+		log.Printf("Remove pipe %s error: %v \n", c.PipeFile(), err)
+	}
+
+	// An existing cgroup belongs to others.
+	if c.CgOpts.Existing == "" {
+		for _, path := range c.cgop.Paths() {
+			if err := os.Remove(path); err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("Remove %s error: %v \n", path, err)
+				}
 			}
 		}
 	}
+
+	c.teardownNetwork()
+
+	if c.Pidfile != "" {
+		if err := os.Remove(c.Pidfile); err != nil && !os.IsNotExist(err) {
+			log.Printf("Remove pidfile %s error: %v \n", c.Pidfile, err)
+		}
+	}
+
+	c.ExitStatus = newExitStatus(p.status, p.reason, kills)
+	if err := c.writeExitStatus(c.ExitStatus); err != nil {
+		log.Printf("Write exit status error: %v \n", err)
+	}
+	if err := c.saveJson(); err != nil {
+		log.Printf("Save exit status in json error: %v \n", err)
+	}
+
+	c.journal(journalRecord{Step: stepStopped})
+
+	// Never remove the dir through a mount point or with the volumes
+	// other containers share, gc cleans it then.
+	if c.Rm {
+		var users []string
+		if len(c.Volumes) > 0 {
+			users, _ = volumeUsers(filepath.Dir(c.Dir), c.Name)
+		}
+		if mounts, err := mountsUnder(c.Dir, true); err != nil || len(mounts) > 0 {
+			log.Printf("Keep dir %s, it still has mounts \n", c.Dir)
+		} else if len(users) > 0 {
+			log.Printf("Keep dir %s, its volumes are used by %v \n", c.Dir, users)
+		} else if err := os.RemoveAll(c.Dir); err != nil {
+			log.Printf("Remove dir %s error: %v \n", c.Dir, err)
+		}
+	}
 }
 
 func (p *masterProcess) cgroup(c *Container) error {
@@ -226,6 +550,12 @@ func (p *masterProcess) cgroup(c *Container) error {
 	if err := c.cgop.CPU(c); err != nil {
 		return err
 	}
+	if err := c.cgop.Devices(c); err != nil {
+		return err
+	}
+	if err := c.cgop.BlkIO(c); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -248,7 +578,7 @@ func stopHandle(sig os.Signal, c chan event) {
 	select {
 	case c <- ev:
 	case <-time.After(time.Second * 5):
-		log.Printf("Send event timeout: %ss \n", 5)
+		log.Printf("Send event timeout: %ds \n", 5)
 	}
 }
 
@@ -292,8 +622,22 @@ func (p *masterProcess) events(c *Container) {
 
 		switch ev.action {
 		case evStop:
-			log.Printf("Kill init process: %d \n", c.Pid)
-			syscall.Kill(c.Pid, syscall.SIGKILL)
+			p.stopInit(c)
+
+		case evTimeout:
+			p.reason = stopTimedOut
+			c.StopReason = stopTimedOut
+			if err := c.saveJson(); err != nil {
+				log.Println(err)
+			}
+			p.stopInit(c)
+
+		case evResize:
+			if p.pty != nil {
+				if err := copyWinsize(0, p.pty.Fd()); err != nil {
+					log.Printf("Copy window size error: %v \n", err)
+				}
+			}
 
 		case evChild:
 
@@ -307,3 +651,44 @@ func (p *masterProcess) events(c *Container) {
 		}
 	}
 }
+
+// deadline sends a timeout event once c.Timeout passes, unless the init
+// process exits first.
+func (p *masterProcess) deadline(c *Container) {
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		log.Printf("Container timed out after %s \n", c.Timeout)
+		select {
+		case p.ec <- event{action: evTimeout}:
+		case <-p.stop:
+		}
+	case <-p.stop:
+	}
+}
+
+// stopInit sends the container's stop signal to the init process, and
+// kills it if it's still alive after stopTimeout.
+func (p *masterProcess) stopInit(c *Container) {
+	sig, err := ParseSignal(c.StopSig)
+	if err != nil {
+		sig = syscall.SIGTERM
+	}
+
+	log.Printf("Stop init process: %d with %s \n", c.Pid, sig)
+	c.kill(sig)
+	if sig == syscall.SIGKILL {
+		return
+	}
+
+	go func() {
+		select {
+		case <-p.stop:
+		case <-time.After(stopTimeout):
+			log.Printf("Kill init process: %d \n", c.Pid)
+			c.kill(syscall.SIGKILL)
+		}
+	}()
+}
@@ -0,0 +1,395 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStopInit stops a process trapping the signals, the stop signal must
+// come first and SIGKILL only once it's ignored for stopTimeout.
+func TestStopInit(t *testing.T) {
+	defer func(d time.Duration) { stopTimeout = d }(stopTimeout)
+	stopTimeout = time.Millisecond * 300
+
+	tests := []struct {
+		stopSig string
+		trapped string             // the signal the trap logged
+		status  syscall.WaitStatus // how the process ended
+	}{
+		{"USR1", "USR1\n", syscall.WaitStatus(syscall.SIGKILL)},
+		{"SIGTERM", "TERM\n", 3 << 8},
+		{"", "TERM\n", 3 << 8},
+		{"9", "", syscall.WaitStatus(syscall.SIGKILL)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stopSig, func(t *testing.T) {
+			log := filepath.Join(t.TempDir(), "trap")
+			cmd := exec.Command("/bin/sh", "-c", `
+				trap 'echo USR1 >> `+log+`' USR1
+				trap 'echo TERM >> `+log+`; exit 3' TERM
+				touch `+log+`
+				while :; do sleep 0.05; done`)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if _, err := ioutil.ReadFile(log); err == nil {
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			p := master()
+			defer close(p.stop)
+			c := &Container{Pid: cmd.Process.Pid, StopSig: tt.stopSig}
+			start := time.Now()
+			p.stopInit(c)
+
+			cmd.Wait()
+			status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+			if status != tt.status {
+				t.Errorf("the process ended with %#x, want %#x", status, tt.status)
+			}
+			if status.Signaled() && tt.trapped != "" && time.Since(start) < stopTimeout {
+				t.Errorf("killed after %s, before stopTimeout", time.Since(start))
+			}
+			if data, _ := ioutil.ReadFile(log); string(data) != tt.trapped {
+				t.Errorf("trapped %q, want %q", data, tt.trapped)
+			}
+		})
+	}
+}
+
+// TestReap runs an init process whose child daemonizes, the master must
+// reap the orphan as a subreaper rather than leave a zombie. It runs in a
+// child of the test, a subreaper is for the whole process.
+func TestReap(t *testing.T) {
+	if os.Getenv("TINYBOX_TEST_REAP") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReap$", "-test.v")
+		cmd.Env = append(os.Environ(), "TINYBOX_TEST_REAP=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, out)
+		}
+		return
+	}
+
+	if err := setSubreaper(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		script string // $D is the daemon writing its pid and parent to $F
+		status syscall.WaitStatus
+	}{
+		{"daemon exits first", `(sh -c "$D" &); sleep 0.5; exit 5`, 5 << 8},
+		{"init killed", `(sh -c "$D" &); sleep 0.5; kill -9 $$`, syscall.WaitStatus(syscall.SIGKILL)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "daemon")
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			daemon := `sleep 0.1; echo $$ $(grep PPid /proc/$$/status | cut -f2) > $F`
+			cmd.Env = append(os.Environ(), "F="+file, "D="+daemon)
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			p := master()
+			p.reap(&Container{Pid: cmd.Process.Pid})
+			if p.status != tt.status {
+				t.Errorf("init status %#x, want %#x", p.status, tt.status)
+			}
+
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := strings.Fields(string(data))
+			if len(fields) != 2 {
+				t.Fatalf("daemon wrote %q", data)
+			}
+			if fields[1] != strconv.Itoa(os.Getpid()) {
+				t.Errorf("daemon reparented to %s, not the master", fields[1])
+			}
+			if stat, err := ioutil.ReadFile("/proc/" + fields[0] + "/stat"); err == nil {
+				t.Errorf("daemon %s not reaped: %s", fields[0], stat)
+			}
+		})
+	}
+}
+
+// TestPidfile writes the pidfile of a started container, it must hold the
+// pid alone and be gone once the container exits.
+func TestPidfile(t *testing.T) {
+	dir := t.TempDir()
+	c := &Container{
+		Name:    "pidfile",
+		Dir:     dir,
+		Pid:     os.Getpid(),
+		Pidfile: filepath.Join(dir, "run", "box.pid"),
+		CgOpts:  &CGroupOptions{},
+		fsop:    &rootFs{},
+		cgop:    &CGroup{paths: map[string]string{}},
+	}
+	if err := c.writePidfile(); err == nil {
+		t.Fatal("wrote a pidfile into a missing dir")
+	}
+
+	os.Mkdir(filepath.Dir(c.Pidfile), 0755)
+	if err := c.writePidfile(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(c.Pidfile); err != nil || string(data) != strconv.Itoa(c.Pid)+"\n" {
+		t.Errorf("pidfile = %q, %v, want %d", data, err, c.Pid)
+	}
+	if names, _ := readDirNames(filepath.Dir(c.Pidfile)); len(names) != 1 {
+		t.Errorf("temp files left by the write: %v", names)
+	}
+
+	master().cleanup(c)
+	if _, err := os.Stat(c.Pidfile); !os.IsNotExist(err) {
+		t.Errorf("pidfile not removed on exit: %v", err)
+	}
+}
+
+// TestWaitReady waits a probe which passes only after a delay, the wait
+// must return once it passes, and fail at the timeout or if init exits.
+func TestWaitReady(t *testing.T) {
+	sleep := exec.Command("/bin/sleep", "30")
+	if err := sleep.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sleep.Wait()
+	defer sleep.Process.Kill()
+	exited := exec.Command("/bin/true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pid     int
+		delay   time.Duration // the listener starts after it, never if 0
+		timeout time.Duration
+		ok      bool
+	}{
+		{"passes after a delay", sleep.Process.Pid, time.Millisecond * 700, time.Second * 5, true},
+		{"timeout", sleep.Process.Pid, 0, time.Second, false},
+		{"init exited", exited.Process.Pid, 0, time.Second * 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := ln.Addr().String()
+			ln.Close()
+			if tt.delay > 0 {
+				listening := make(chan net.Listener, 1)
+				go func() {
+					time.Sleep(tt.delay)
+					ln, err := net.Listen("tcp", addr)
+					if err != nil {
+						close(listening)
+						return
+					}
+					listening <- ln
+					for {
+						conn, err := ln.Accept()
+						if err != nil {
+							return
+						}
+						conn.Close()
+					}
+				}()
+				defer func() {
+					if ln, ok := <-listening; ok {
+						ln.Close()
+					}
+				}()
+			}
+
+			c := &Container{Pid: tt.pid, WaitTCP: addr, WaitTimeout: tt.timeout}
+			start := time.Now()
+			err = master().waitReady(c)
+			elapsed := time.Since(start)
+			if (err == nil) != tt.ok {
+				t.Fatalf("waitReady = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && elapsed < tt.delay {
+				t.Errorf("ready after %s, before the probe passed at %s", elapsed, tt.delay)
+			}
+			if !tt.ok && tt.pid == sleep.Process.Pid && elapsed < tt.timeout {
+				t.Errorf("failed after %s, before the timeout", elapsed)
+			}
+			if tt.pid == exited.Process.Pid && elapsed >= tt.timeout {
+				t.Errorf("waited the timeout with init exited")
+			}
+		})
+	}
+}
+
+// TestTimeout runs init processes under the event loop of the master with
+// a deadline, one outliving it must be stopped at the deadline with the
+// timeout reason, one exiting before must not.
+func TestTimeout(t *testing.T) {
+	defer func(d time.Duration) { stopTimeout = d }(stopTimeout)
+	stopTimeout = time.Millisecond * 300
+
+	tests := []struct {
+		name   string
+		script string
+		reason string
+		code   int
+		min    time.Duration // the least time to the exit
+	}{
+		{"killed at the deadline", "exec sleep 30", stopTimedOut, 128 + 15, time.Millisecond * 500},
+		{"ignores the stop signal", "trap '' TERM; sleep 30 & wait; wait", stopTimedOut, 128 + 9, time.Millisecond * 800},
+		{"exits first", "exit 4", "", 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			c := &Container{
+				Name:    "job",
+				Dir:     filepath.Join(home, "job"),
+				Timeout: time.Millisecond * 500,
+				CgOpts:  &CGroupOptions{},
+				fsop:    &rootFs{},
+				cgop:    &CGroup{paths: map[string]string{}},
+			}
+			if err := os.Mkdir(c.Dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+			start := time.Now()
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			c.Pid = cmd.Process.Pid
+
+			// Like Start, after the init process runs.
+			p := master()
+			p.wg.Add(2)
+			go func() {
+				defer p.wg.Done()
+				p.events(c)
+			}()
+			go func() {
+				defer p.wg.Done()
+				p.deadline(c)
+			}()
+			if err := p.wait(c); err != nil {
+				t.Fatal(err)
+			}
+			elapsed := time.Since(start)
+
+			if elapsed < tt.min || elapsed > tt.min+time.Second*2 {
+				t.Errorf("exited after %s, want %s", elapsed, tt.min)
+			}
+			if c.ExitStatus == nil || c.ExitStatus.Reason != tt.reason || c.ExitStatus.Code != tt.code {
+				t.Fatalf("exit status %+v, want code %d reason %q", c.ExitStatus, tt.code, tt.reason)
+			}
+			st, err := WaitExit(home, c.Name)
+			if err != nil || st.Reason != tt.reason {
+				t.Errorf("exit_status %+v, %v, want reason %q", st, err, tt.reason)
+			}
+			saved, err := loadContainer(home, c.Name)
+			if err != nil || saved.StopReason != tt.reason {
+				t.Errorf("container.json stop reason %q, %v, want %q", saved.StopReason, err, tt.reason)
+			}
+		})
+	}
+}
+
+// TestRemoveOnExit runs an init process to its exit, with --rm the dir of
+// the container and its volumes are gone after, even killed by a signal.
+// A dir still having a mount is kept for gc.
+func TestRemoveOnExit(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		rm     bool
+		mount  bool // a tmpfs is left mounted in the dir
+		code   int
+		gone   bool
+	}{
+		{"rm", "exit 0", true, false, 0, true},
+		{"rm killed", "kill -KILL $$", true, false, 128 + 9, true},
+		{"rm failed", "exit 3", true, false, 3, true},
+		{"no rm", "exit 0", false, false, 0, false},
+		{"rm with a mount", "exit 0", true, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mount && os.Geteuid() != 0 {
+				t.Skip("needs root to mount")
+			}
+			home := t.TempDir()
+			c := &Container{
+				Name:   "rm",
+				Dir:    filepath.Join(home, "rm"),
+				Rm:     tt.rm,
+				CgOpts: &CGroupOptions{},
+				fsop:   &rootFs{},
+				cgop:   &CGroup{paths: map[string]string{}},
+			}
+			volume := filepath.Join(c.Dir, "volumes", "data")
+			if err := os.MkdirAll(volume, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(volume, "f"), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.mount {
+				if err := syscall.Mount("tmpfs", volume, "tmpfs", 0, "size=64k"); err != nil {
+					t.Fatal(err)
+				}
+				defer syscall.Unmount(volume, syscall.MNT_DETACH)
+			}
+
+			cmd := exec.Command("/bin/sh", "-c", tt.script)
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			c.Pid = cmd.Process.Pid
+
+			// Like Start, the master waits the init process to exit.
+			p := master()
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.events(c)
+			}()
+			if err := p.wait(c); err != nil {
+				t.Fatal(err)
+			}
+			if c.ExitStatus == nil || c.ExitStatus.Code != tt.code {
+				t.Errorf("exit status %+v, want code %d", c.ExitStatus, tt.code)
+			}
+
+			_, err := os.Stat(c.Dir)
+			if gone := os.IsNotExist(err); gone != tt.gone {
+				t.Errorf("dir removed %v, want %v", gone, tt.gone)
+			}
+			if !tt.gone {
+				if _, err := loadContainer(home, c.Name); err != nil {
+					t.Errorf("container.json of the kept dir: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -15,6 +15,12 @@ func setns() *setnsProcess {
 	return new(setnsProcess)
 }
 
+// execArgv splits the command of an exec into the argv it runs, the
+// authorization hook is asked for the same argv.
+func execArgv(cmd string) []string {
+	return strings.Fields(cmd)
+}
+
 func (p *setnsProcess) Start(c *Container) error {
 	cmd := os.Getenv("__TINYBOX_CMD__")
 	if cmd == "" {
@@ -31,7 +37,7 @@ func (p *setnsProcess) Start(c *Container) error {
 	}
 	Funlock(lock)
 
-	argv := strings.Fields(cmd)
+	argv := execArgv(cmd)
 	if len(argv) == 0 {
 		return nil
 	}
@@ -41,5 +47,11 @@ func (p *setnsProcess) Start(c *Container) error {
 		return err
 	}
 
-	return syscall.Exec(path, argv, os.Environ())
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, internalEnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	return syscall.Exec(path, argv, env)
 }
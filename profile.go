@@ -0,0 +1,90 @@
+package tinybox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// resourceProfiles are the built-in presets of --resource-profile, the
+// cpu is a cfs quota of the default 100ms period.
+var resourceProfiles = map[string]CGroupOptions{
+	"small": {
+		Memory:       "256m",
+		CpuShares:    "512",
+		CpuCfsPeriod: "100000",
+		CpuCfsquota:  "50000",
+	},
+	"medium": {
+		Memory:       "1g",
+		CpuShares:    "1024",
+		CpuCfsPeriod: "100000",
+		CpuCfsquota:  "100000",
+	},
+	"large": {
+		Memory:       "4g",
+		CpuShares:    "2048",
+		CpuCfsPeriod: "100000",
+		CpuCfsquota:  "400000",
+	},
+}
+
+// profilesFile is in the home, it maps a name to the limits of
+// CGroupOptions in json, a profile of it replaces the built-in one.
+const profilesFile = "profiles.json"
+
+// loadProfile returns the resource profile name of home.
+func loadProfile(home, name string) (*CGroupOptions, error) {
+	data, err := ioutil.ReadFile(filepath.Join(home, profilesFile))
+	if err == nil {
+		var profiles map[string]CGroupOptions
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", profilesFile, err)
+		}
+		if p, ok := profiles[name]; ok {
+			return &p, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if p, ok := resourceProfiles[name]; ok {
+		return &p, nil
+	}
+	return nil, fmt.Errorf("Unknown resource profile %s", name)
+}
+
+// applyProfile fills the limits of cfg not set from its resource profile,
+// a cpu limit of "0" is not set.
+func (cfg *Config) applyProfile() error {
+	if cfg.ResourceProfile == "" || !cfg.Run {
+		return nil
+	}
+
+	p, err := loadProfile(cfg.Home, cfg.ResourceProfile)
+	if err != nil {
+		return err
+	}
+
+	limits := []struct {
+		v, def *string
+	}{
+		{&cfg.CgOpts.Memory, &p.Memory},
+		{&cfg.CgOpts.MemoryReservation, &p.MemoryReservation},
+		{&cfg.CgOpts.CpuShares, &p.CpuShares},
+		{&cfg.CgOpts.CpuCfsPeriod, &p.CpuCfsPeriod},
+		{&cfg.CgOpts.CpuCfsquota, &p.CpuCfsquota},
+		{&cfg.CgOpts.CpuRtRuntime, &p.CpuRtRuntime},
+		{&cfg.CgOpts.CpuRtPeriod, &p.CpuRtPeriod},
+		{&cfg.CgOpts.CpusetCpus, &p.CpusetCpus},
+		{&cfg.CgOpts.CpusetMems, &p.CpusetMems},
+	}
+	for _, l := range limits {
+		if *l.v == "" || *l.v == "0" {
+			*l.v = *l.def
+		}
+	}
+	return nil
+}
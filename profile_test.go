@@ -0,0 +1,70 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestApplyProfile expands a resource profile into the limits, a limit set
+// on the command line overrides only its own field.
+func TestApplyProfile(t *testing.T) {
+	small := CGroupOptions{Memory: "256m", CpuShares: "512", CpuCfsPeriod: "100000", CpuCfsquota: "50000"}
+	profiles := `{"small": {"memory": "128m", "cpushares": "256"}, "tiny": {"memory": "32m"}}`
+
+	tests := []struct {
+		name     string
+		profile  string
+		profiles string // the profiles file of the home, "" for none
+		cgOpts   CGroupOptions
+		want     CGroupOptions
+		err      string // "" for no error
+	}{
+		{"small", "small", "", CGroupOptions{}, small, ""},
+		{"large", "large", "", CGroupOptions{},
+			CGroupOptions{Memory: "4g", CpuShares: "2048", CpuCfsPeriod: "100000", CpuCfsquota: "400000"}, ""},
+		{"memory overridden", "small", "", CGroupOptions{Memory: "512m"},
+			CGroupOptions{Memory: "512m", CpuShares: "512", CpuCfsPeriod: "100000", CpuCfsquota: "50000"}, ""},
+		{"cpu overridden", "small", "", CGroupOptions{CpuCfsquota: "20000", CpuShares: "0"},
+			CGroupOptions{Memory: "256m", CpuShares: "512", CpuCfsPeriod: "100000", CpuCfsquota: "20000"}, ""},
+		{"file replaces a preset", "small", profiles, CGroupOptions{},
+			CGroupOptions{Memory: "128m", CpuShares: "256"}, ""},
+		{"file adds a profile", "tiny", profiles, CGroupOptions{}, CGroupOptions{Memory: "32m"}, ""},
+		{"preset beside the file", "medium", profiles, CGroupOptions{},
+			CGroupOptions{Memory: "1g", CpuShares: "1024", CpuCfsPeriod: "100000", CpuCfsquota: "100000"}, ""},
+		{"unknown", "huge", "", CGroupOptions{}, CGroupOptions{}, "Unknown resource profile huge"},
+		{"invalid file", "small", "{", CGroupOptions{}, CGroupOptions{}, "Invalid profiles.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			if tt.profiles != "" {
+				if err := ioutil.WriteFile(filepath.Join(home, profilesFile), []byte(tt.profiles), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := Config{Home: home, Run: true, ResourceProfile: tt.profile, CgOpts: tt.cgOpts}
+			err := cfg.applyProfile()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("applyProfile = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.CgOpts, tt.want) {
+				t.Errorf("limits %+v, want %+v", cfg.CgOpts, tt.want)
+			}
+		})
+	}
+
+	// Only a new container gets the profile, an exec has its limits.
+	cfg := Config{Home: t.TempDir(), Exec: true, ResourceProfile: "small"}
+	if err := cfg.applyProfile(); err != nil || cfg.CgOpts.Memory != "" {
+		t.Errorf("applyProfile of an exec = %v, memory %q", err, cfg.CgOpts.Memory)
+	}
+}
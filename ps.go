@@ -0,0 +1,127 @@
+package tinybox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Process is a process of a container as seen from the host.
+type Process struct {
+	Pid     int    // pid on the host
+	NSPid   int    // pid in the container's pid namespace, 0 if unknown
+	PPid    int    // parent pid on the host
+	User    string // name of the real uid, or the uid if it has no name
+	Command string
+}
+
+// ContainerPids returns the host pids in the cgroup of the running
+// container name under home, sorted.
+func ContainerPids(home, name string) ([]int, error) {
+	if !filepath.IsAbs(home) {
+		return nil, fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	c, err := loadContainer(home, name)
+	if err != nil {
+		return nil, err
+	}
+	if !processAlive(c.Pid) {
+		return nil, fmt.Errorf("%w: %s", ErrNotRunning, name)
+	}
+
+	if c.CgOpts == nil {
+		return nil, fmt.Errorf("%w: no cgroup options of %s", ErrCgroupUnsupported, name)
+	}
+	cg, err := newCGroup(c.CgOpts.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	// The container is in all managed subsystems, any of them is enough.
+	for _, sub := range []string{subsysMEM, subsysCPU, subsysCA, subsysCS, subsysDEV} {
+		dir, err := cg.groupPath(sub, c)
+		if err != nil {
+			continue
+		}
+		pids, err := readCgroupPids(dir)
+		if err != nil {
+			continue
+		}
+		sort.Ints(pids)
+		return pids, nil
+	}
+	return nil, fmt.Errorf("%w: not found the cgroup of %s", ErrCgroupUnsupported, name)
+}
+
+// Processes returns the processes of the running container name under
+// home, a process exited during the scan is skipped.
+func Processes(home, name string) ([]Process, error) {
+	pids, err := ContainerPids(home, name)
+	if err != nil {
+		return nil, err
+	}
+
+	procs := make([]Process, 0, len(pids))
+	for _, pid := range pids {
+		p, err := readProcess(pid)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+// readProcess reads the process pid from /proc/<pid>/status and cmdline.
+func readProcess(pid int) (Process, error) {
+	p := Process{Pid: pid}
+
+	status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return p, err
+	}
+	var uid, name string
+	for _, line := range strings.Split(string(status), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Name:":
+			name = fields[1]
+		case "PPid:":
+			p.PPid, _ = strconv.Atoi(fields[1])
+		case "Uid:":
+			uid = fields[1]
+		case "NSpid:":
+			// The last one is the pid in the innermost namespace.
+			p.NSPid, _ = strconv.Atoi(fields[len(fields)-1])
+		}
+	}
+
+	p.User = uid
+	if u, err := user.LookupId(uid); err == nil {
+		p.User = u.Username
+	}
+
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return p, err
+	}
+	p.Command = string(bytes.TrimRight(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1), " "))
+	if p.Command == "" {
+		// A kernel thread or a zombie has no cmdline.
+		p.Command = "[" + name + "]"
+	}
+	return p, nil
+}
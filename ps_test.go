@@ -0,0 +1,155 @@
+package tinybox
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestNoCgroupOptions loads a container.json written without cgroup
+// options, gc and ps must not panic on it.
+func TestNoCgroupOptions(t *testing.T) {
+	home := t.TempDir()
+	c := &Container{Name: "old", Dir: filepath.Join(home, "old"), Pid: os.Getpid()}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ContainerPids(home, "old"); !errors.Is(err, ErrCgroupUnsupported) {
+		t.Errorf("ContainerPids = %v, want %v", err, ErrCgroupUnsupported)
+	}
+
+	loaded, err := loadContainer(home, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cg, err := newCGroup("")
+	if err != nil {
+		t.Skip("no cgroup mounts")
+	}
+	actions, err := gcContainer(loaded, cg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0] != "remove state "+c.Dir {
+		t.Errorf("actions = %v, want only the state removed", actions)
+	}
+}
+
+// TestProcesses lists a container of a shell and its sleep child in a
+// fake cgroup, a pid exited before the scan is skipped.
+func TestProcesses(t *testing.T) {
+	exited := exec.Command("/bin/true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", "-c", "sleep 30 & echo $!; wait")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	var child int
+	if _, err := fmt.Fscan(out, &child); err != nil {
+		t.Fatal(err)
+	}
+	// The child has exec'd sleep once its cmdline is it.
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+		if cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", child)); strings.HasPrefix(string(cmdline), "sleep") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sleep didn't start")
+		}
+	}
+
+	home := t.TempDir()
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, subsysMEM), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{
+		Name:     "box",
+		Dir:      filepath.Join(home, "box"),
+		Pid:      cmd.Process.Pid,
+		CgPrefix: "tinybox",
+		CgOpts:   &CGroupOptions{Root: root},
+	}
+	cg, err := newCGroup(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := cg.groupPath(subsysMEM, c)
+	if err != nil {
+		t.Skip("no memory cgroup of init")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pids := fmt.Sprintf("%d\n%d\n%d\n", child, exited.Process.Pid, c.Pid)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(pids), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ContainerPids(home, c.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{c.Pid, child, exited.Process.Pid}
+	sort.Ints(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ContainerPids = %v, want %v", got, want)
+	}
+
+	procs, err := Processes(home, c.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strconv.Itoa(os.Getuid())
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	wantProcs := map[int]Process{
+		c.Pid: {Pid: c.Pid, NSPid: c.Pid, PPid: os.Getpid(), User: name, Command: "/bin/sh -c sleep 30 & echo $!; wait"},
+		child: {Pid: child, NSPid: child, PPid: c.Pid, User: name, Command: "sleep 30"},
+	}
+	gotProcs := map[int]Process{}
+	for _, p := range procs {
+		gotProcs[p.Pid] = p
+	}
+	if !reflect.DeepEqual(gotProcs, wantProcs) {
+		t.Errorf("Processes = %+v, want %+v", gotProcs, wantProcs)
+	}
+
+	// Stopped, there's nothing to list.
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	cmd.Wait()
+	if _, err := Processes(home, c.Name); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Processes of a stopped container = %v, want %v", err, ErrNotRunning)
+	}
+}
@@ -0,0 +1,154 @@
+package tinybox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The rlimits not in syscall.
+const (
+	rlimitNproc      = 6
+	rlimitMemlock    = 8
+	rlimitLocks      = 10
+	rlimitSigpending = 11
+	rlimitMsgqueue   = 12
+	rlimitNice       = 13
+	rlimitRtprio     = 14
+)
+
+var rlimits = map[string]int{
+	"as":         syscall.RLIMIT_AS,
+	"core":       syscall.RLIMIT_CORE,
+	"cpu":        syscall.RLIMIT_CPU,
+	"data":       syscall.RLIMIT_DATA,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"locks":      rlimitLocks,
+	"memlock":    rlimitMemlock,
+	"msgqueue":   rlimitMsgqueue,
+	"nice":       rlimitNice,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"nproc":      rlimitNproc,
+	"rtprio":     rlimitRtprio,
+	"sigpending": rlimitSigpending,
+	"stack":      syscall.RLIMIT_STACK,
+}
+
+type Rlimit struct {
+	Name string `json:"name"`
+	Soft uint64 `json:"soft"`
+	Hard uint64 `json:"hard"`
+}
+
+// parseRlimit parses "soft[:hard]" for the named resource, hard is the
+// same as soft if not set.
+func parseRlimit(name, value string) (Rlimit, error) {
+	rl := Rlimit{Name: name}
+	if _, ok := rlimits[name]; !ok {
+		return rl, fmt.Errorf("Unknown rlimit %s", name)
+	}
+
+	parse := func(s string) (uint64, error) {
+		if s == "unlimited" || s == "-1" {
+			return math.MaxUint64, nil
+		}
+		return strconv.ParseUint(s, 10, 64)
+	}
+
+	fields := strings.SplitN(value, ":", 2)
+
+	var err error
+	if rl.Soft, err = parse(fields[0]); err != nil {
+		return rl, fmt.Errorf("Invalid rlimit %s=%s", name, value)
+	}
+	rl.Hard = rl.Soft
+	if len(fields) == 2 {
+		if rl.Hard, err = parse(fields[1]); err != nil {
+			return rl, fmt.Errorf("Invalid rlimit %s=%s", name, value)
+		}
+	}
+
+	if rl.Soft > rl.Hard {
+		return rl, fmt.Errorf("Rlimit %s soft limit is greater than hard limit", name)
+	}
+	return rl, nil
+}
+
+// parseCoreDump parses --core-dump, "0" disables core dumps, otherwise
+// it's a size like 1g or "unlimited".
+func parseCoreDump(value string) (Rlimit, error) {
+	if value == "unlimited" {
+		return parseRlimit("core", value)
+	}
+
+	size, err := ParseSize(value)
+	if err != nil {
+		return Rlimit{}, err
+	}
+	return Rlimit{Name: "core", Soft: uint64(size), Hard: uint64(size)}, nil
+}
+
+// setRlimits sets the container's rlimits for the current process, they
+// are inherited by the exec. A later rlimit of the same name wins.
+//
+// nproc counts all processes of the real uid, including the ones on the
+// host. Without a private user namespace the container's uid is the
+// host's, so it's warned. It must be set after any uid switch, it's the
+// last step before exec here.
+func setRlimits(c *Container) error {
+	for _, rl := range c.Rlimits {
+		if rl.Name == "nproc" && !privateUserNamespace() {
+			log.Printf("Warning: rlimit nproc counts the host processes of uid %d too \n", os.Getuid())
+		}
+
+		limit := &syscall.Rlimit{Cur: rl.Soft, Max: rl.Hard}
+		if err := syscall.Setrlimit(rlimits[rl.Name], limit); err != nil {
+			return fmt.Errorf("Set rlimit %s: %v", rl.Name, err)
+		}
+	}
+	return nil
+}
+
+// privateUserNamespace reports if the process is in a user namespace other
+// than the initial one, whose uid map is the identity of all uids.
+func privateUserNamespace() bool {
+	b, err := ioutil.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	return strings.Join(strings.Fields(string(b)), " ") != "0 0 4294967295"
+}
+
+// parseUlimit parses --ulimit name=soft[:hard].
+func parseUlimit(s string) (Rlimit, error) {
+	name, value, err := parseKV(s)
+	if err != nil {
+		return Rlimit{}, fmt.Errorf("Invalid ulimit %s, expect name=soft[:hard]", s)
+	}
+	return parseRlimit(name, value)
+}
+
+// ulimitValue is the --ulimit flag.
+type ulimitValue []Rlimit
+
+func (v *ulimitValue) String() string {
+	var names []string
+	for _, rl := range *v {
+		names = append(names, rl.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *ulimitValue) Set(s string) error {
+	rl, err := parseUlimit(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, rl)
+	return nil
+}
@@ -0,0 +1,138 @@
+package tinybox
+
+import (
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseRlimit(t *testing.T) {
+	tests := []struct {
+		name, value string
+		want        Rlimit
+		ok          bool
+	}{
+		{"nofile", "1024", Rlimit{"nofile", 1024, 1024}, true},
+		{"nofile", "1024:4096", Rlimit{"nofile", 1024, 4096}, true},
+		{"nofile", "1024:unlimited", Rlimit{"nofile", 1024, math.MaxUint64}, true},
+		{"core", "-1", Rlimit{"core", math.MaxUint64, math.MaxUint64}, true},
+		{"nofile", "4096:1024", Rlimit{}, false},
+		{"nofile", "", Rlimit{}, false},
+		{"nofile", "1k", Rlimit{}, false},
+		{"nofile", "1024:", Rlimit{}, false},
+		{"files", "1024", Rlimit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRlimit(tt.name, tt.value)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("parseRlimit(%s, %q) = %+v, %v, want %+v, ok %v", tt.name, tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestParseCoreDump parses --core-dump, its default 0 disables core
+// dumps.
+func TestParseCoreDump(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"1g", 1 << 30, true},
+		{"4096", 4096, true},
+		{"unlimited", math.MaxUint64, true},
+		{"-1", 0, false},
+		{"big", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseCoreDump(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseCoreDump(%q) = %v, want ok %v", tt.value, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got != Rlimit{"core", tt.want, tt.want}) {
+			t.Errorf("parseCoreDump(%q) = %+v, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestSetRlimits applies the rlimits to the process, a later one of the
+// same name wins.
+func TestSetRlimits(t *testing.T) {
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &old); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_CORE, &old)
+	if old.Max < 8192 {
+		t.Skip("hard core limit too low")
+	}
+
+	tests := []struct {
+		rlimits []Rlimit
+		want    uint64
+	}{
+		{[]Rlimit{{"core", 0, old.Max}}, 0},
+		{[]Rlimit{{"core", 4096, old.Max}}, 4096},
+		{[]Rlimit{{"core", 4096, old.Max}, {"core", 8192, old.Max}}, 8192},
+	}
+	for _, tt := range tests {
+		if err := setRlimits(&Container{Rlimits: tt.rlimits}); err != nil {
+			t.Fatal(err)
+		}
+		var got syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Cur != tt.want {
+			t.Errorf("setRlimits(%+v) set core %d, want %d", tt.rlimits, got.Cur, tt.want)
+		}
+	}
+
+	if err := setRlimits(&Container{Rlimits: []Rlimit{{"core", 1, 0}}}); err == nil {
+		t.Error("setRlimits with soft over hard succeeded")
+	}
+}
+
+// TestRlimitNproc sets nproc in a child of the test after it switches to
+// a uid with no other processes, like the init process would before exec.
+// The shell it execs can then fork only up to the limit.
+func TestRlimitNproc(t *testing.T) {
+	const uid = 54321
+	if os.Getenv("TINYBOX_TEST_NPROC") != "" {
+		if err := syscall.Setgid(uid); err != nil {
+			os.Exit(100)
+		}
+		if err := syscall.Setuid(uid); err != nil {
+			os.Exit(100)
+		}
+		if err := setRlimits(&Container{Rlimits: []Rlimit{{"nproc", 4, 4}}}); err != nil {
+			os.Exit(100)
+		}
+		// The shell exits once a fork fails.
+		script := "for i in 1 2 3 4 5 6; do sleep 2 >/dev/null & echo $i; done"
+		syscall.Exec("/bin/sh", []string{"sh", "-c", script}, nil)
+		os.Exit(100)
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to switch the uid")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRlimitNproc$")
+	cmd.Env = append(os.Environ(), "TINYBOX_TEST_NPROC=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	out, err := cmd.Output()
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() == 100 {
+		t.Fatalf("the shell = %v, want it to fail to fork", err)
+	}
+	// The shell is one of the 4 processes.
+	if got := strings.Fields(string(out)); len(got) != 3 {
+		t.Errorf("forked %d processes, want 3: %q", len(got), out)
+	}
+}
@@ -1,41 +1,535 @@
 package tinybox
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type rootFs struct{}
 
+// tmpfsDirs are mounted as tmpfs with --tmp-as-tmpfs.
+var tmpfsDirs = []struct {
+	dir  string
+	data string
+}{
+	{"tmp", "mode=1777,size=65536k"},
+	{"run", "mode=755,size=65536k"},
+	{"var/run", "mode=755,size=65536k"},
+}
+
+// Retry of a mount failed with a transient error, the delay doubles on
+// each attempt.
+var (
+	mountAttempts = 5
+	mountDelay    = time.Millisecond * 20
+)
+
+// mountFunc is the mount syscall.
+var mountFunc = syscall.Mount
+
+// mount calls mountFunc, and retries it if the target is busy or the
+// kernel is short of resources. Permanent errors like EPERM and EINVAL
+// fail at once.
+func mount(source, target, fstype string, flags uintptr, data string) error {
+	delay := mountDelay
+	for i := 1; ; i++ {
+		err := mountFunc(source, target, fstype, flags, data)
+		retry := err == syscall.EBUSY || err == syscall.EAGAIN || err == syscall.EINTR
+		if err == nil || i >= mountAttempts || !retry {
+			trace("mount", err, source, target, fstype, fmt.Sprintf("%#x", flags), data)
+			return err
+		}
+
+		log.Printf("Mount %s on %s: %v, retry in %s \n", source, target, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Propagations of the mounts of the container's root.
+const (
+	propSlave   = "slave"   // host mounts propagate in, none propagates out
+	propPrivate = "private" // no mount propagates in or out
+)
+
 func (fs *rootFs) Mount(c *Container) error {
+	// Without a rootfs the container is in the host's mount namespace and
+	// has the host's /dev, nothing is mounted or created there.
+	if c.Rootfs == "" {
+		return nil
+	}
+
+	// It's set before any mount of the container, which would propagate
+	// out to the host otherwise.
 	flag := syscall.MS_SLAVE | syscall.MS_REC
+	if c.Propagation == propPrivate {
+		flag = syscall.MS_PRIVATE | syscall.MS_REC
+	}
+
+	if err := mount("", "/", "", uintptr(flag), ""); err != nil {
+		return err
+	}
 
-	if err := syscall.Mount("", "/", "", uintptr(flag), ""); err != nil {
+	if err := mount(c.Rootfs, c.Rootfs, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 		return err
 	}
 
-	if err := syscall.Mount(c.Rootfs, c.Rootfs, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+	if err := fs.mountProc(c); err != nil {
 		return err
 	}
 
-	if err := syscall.Mount("proc", path.Join(c.Rootfs, "proc"), "proc", 0, ""); err != nil {
+	if err := fs.mountDev(c); err != nil {
 		return err
 	}
 
+	if err := fs.mountShm(c); err != nil {
+		return err
+	}
+
+	if err := fs.mountKernelIfaces(c); err != nil {
+		return err
+	}
+
+	for _, l := range fs.layers(c) {
+		if err := l.mount(); err != nil {
+			return err
+		}
+	}
+
+	if err := fs.mountSecrets(c); err != nil {
+		return err
+	}
+
+	if err := fs.localtime(c); err != nil {
+		return err
+	}
+
+	if err := fs.mountResolvConf(c); err != nil {
+		return err
+	}
+
+	if err := fs.mountHostname(c); err != nil {
+		return err
+	}
+
+	return fs.linkMtab(c)
+}
+
+const (
+	procMasked = "masked"
+	procRW     = "rw"
+	procRO     = "ro"
+)
+
+// procMaskedPaths and procReadonlyPaths are handled in "masked" proc mode,
+// so /proc stays writable except the sensitive entries.
+var (
+	procMaskedPaths = []string{
+		"acpi",
+		"kcore",
+		"keys",
+		"latency_stats",
+		"sched_debug",
+		"scsi",
+		"sysrq-trigger",
+		"timer_list",
+		"timer_stats",
+	}
+	procReadonlyPaths = []string{
+		"bus",
+		"fs",
+		"irq",
+		"sys",
+	}
+)
+
+// mountProc mounts /proc of the rootfs by c.ProcMode.
+func (fs *rootFs) mountProc(c *Container) error {
+	proc := path.Join(c.Rootfs, "proc")
+
+	var flag uintptr
+	if c.ProcMode == procRO {
+		flag = syscall.MS_RDONLY
+	}
+	flag |= syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	if err := mount("proc", proc, "proc", flag, ""); err != nil {
+		return err
+	}
+
+	if c.ProcMode != procMasked {
+		return nil
+	}
+
+	for _, name := range procMaskedPaths {
+		p := path.Join(proc, name)
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+
+		// Hide a dir by an empty read-only tmpfs, and a file by /dev/null.
+		if info.IsDir() {
+			err = mount("tmpfs", p, "tmpfs", syscall.MS_RDONLY, "size=0")
+		} else {
+			err = mount("/dev/null", p, "bind", syscall.MS_BIND, "")
+		}
+		if err != nil {
+			return fmt.Errorf("Mask %s: %v", p, err)
+		}
+	}
+
+	for _, name := range procReadonlyPaths {
+		p := path.Join(proc, name)
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if err := mount(p, p, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("Bind %s: %v", p, err)
+		}
+		flag := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+		if err := mount(p, p, "", uintptr(flag), ""); err != nil {
+			return fmt.Errorf("Remount %s read-only: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// mountDev mounts a tmpfs on /dev and creates the nodes of the container
+// in it, /dev of the image is covered and left untouched.
+func (fs *rootFs) mountDev(c *Container) error {
+	target, err := openInRoot(c.Rootfs, "dev", true)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	flag := syscall.MS_NOSUID | syscall.MS_NOEXEC
+	if err := mount("tmpfs", procPath(target), "tmpfs", uintptr(flag), "mode=755"); err != nil {
+		return fmt.Errorf("Mount tmpfs on /dev: %v", err)
+	}
+
+	// Opened again, the path now leads to the tmpfs.
+	dev, err := openInRoot(c.Rootfs, "dev", false)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	for _, d := range containerDevices(c.CgOpts) {
+		if err := d.Mknod(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountShm mounts a private tmpfs of c.ShmSize on /dev/shm, in the tmpfs
+// of mountDev.
+func (fs *rootFs) mountShm(c *Container) error {
+	size, err := ParseSize(c.ShmSize)
+	if err != nil {
+		return err
+	}
+
+	shm, err := openInRoot(c.Rootfs, "dev/shm", true)
+	if err != nil {
+		return err
+	}
+	defer shm.Close()
+
+	flag := syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	data := fmt.Sprintf("mode=1777,size=%d", size)
+	return mount("shm", procPath(shm), "tmpfs", uintptr(flag), data)
+}
+
+// layer is a mount of the tmpfs dirs and volumes, which may nest in each
+// other.
+type layer struct {
+	dest  string
+	order int
+	mount func() error
+}
+
+// layers returns the tmpfs dirs and volumes sorted by the depth of dest,
+// then by order, so a nested mount is never shadowed by a later mount of
+// its parent. At the same dest a volume is mounted over the tmpfs.
+func (fs *rootFs) layers(c *Container) []layer {
+	var layers []layer
+	if c.TmpAsTmpfs {
+		for _, tmp := range tmpfsDirs {
+			tmp := tmp
+			layers = append(layers, layer{
+				dest:  "/" + tmp.dir,
+				mount: func() error { return fs.mountTmpfs(c, tmp.dir, tmp.data) },
+			})
+		}
+	}
+	for _, v := range c.Volumes {
+		v := v
+		layers = append(layers, layer{
+			dest:  v.Dest,
+			order: v.Order,
+			mount: func() error { return fs.mountVolume(c, v) },
+		})
+	}
+
+	sort.SliceStable(layers, func(i, j int) bool {
+		di, dj := strings.Count(layers[i].dest, "/"), strings.Count(layers[j].dest, "/")
+		if di != dj {
+			return di < dj
+		}
+		return layers[i].order < layers[j].order
+	})
+	return layers
+}
+
+// mountTmpfs mounts a tmpfs on dir of the rootfs, a dir that's a symlink
+// (like /var/run -> /run) or under one is skipped.
+func (fs *rootFs) mountTmpfs(c *Container, dir, data string) error {
+	target, err := openInRoot(c.Rootfs, dir, true)
+	if errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	if info, err := target.Stat(); err != nil || !info.IsDir() {
+		return nil
+	}
+
+	flag := syscall.MS_NOSUID | syscall.MS_NODEV
+	if err := mount("tmpfs", procPath(target), "tmpfs", uintptr(flag), data); err != nil {
+		return fmt.Errorf("Mount tmpfs on %s: %v", dir, err)
+	}
+	return nil
+}
+
+// localtime binds the configured zoneinfo file of the rootfs, or the
+// host's /etc/localtime, read-only over <rootfs>/etc/localtime. The rootfs
+// itself is left untouched: a symlink is covered, not followed, and
+// without a localtime there's nothing to bind over.
+func (fs *rootFs) localtime(c *Container) error {
+	source := "/etc/localtime"
+	if c.Timezone != "" {
+		zone := filepath.Join("/usr/share/zoneinfo", c.Timezone)
+		if !strings.HasPrefix(zone, "/usr/share/zoneinfo/") {
+			return fmt.Errorf("Invalid timezone %s", c.Timezone)
+		}
+		var err error
+		if source, err = resolveInRoot(c.Rootfs, zone); err != nil {
+			return fmt.Errorf("Not found timezone %s in rootfs: %v", c.Timezone, err)
+		}
+		if info, err := os.Stat(source); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("Not found timezone %s in rootfs", c.Timezone)
+		}
+	} else if !c.Localtime {
+		return nil
+	}
+
+	target, err := openInRoot(c.Rootfs, "etc/localtime", false)
+	if err != nil {
+		return fmt.Errorf("Bind over /etc/localtime of rootfs: %v", err)
+	}
+	defer target.Close()
+	if info, err := target.Stat(); err != nil || info.IsDir() {
+		return fmt.Errorf("Bind over /etc/localtime of rootfs: not a file")
+	}
+	if err := mount(source, procPath(target), "bind", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+
+	bind, err := openInRoot(c.Rootfs, "etc/localtime", false)
+	if err != nil {
+		return err
+	}
+	defer bind.Close()
+	flag := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+	return mount("", procPath(bind), "", uintptr(flag), "")
+}
+
+func (c *Container) HostnameFile() string {
+	return filepath.Join(c.Dir, "hostname")
+}
+
+// mountHostname binds a file of c.Hostname over <rootfs>/etc/hostname,
+// an empty one is created first if the rootfs has none and is writable.
+// Anything else is left as it is with a warning: a symlink isn't followed
+// to the host, nor is a symlinked etc.
+func (fs *rootFs) mountHostname(c *Container) error {
+	if c.Hostname == "" {
+		return nil
+	}
+
+	etc, err := openInRoot(c.Rootfs, "etc", false)
+	if err != nil {
+		log.Printf("Warning: skip hostname, no etc dir in rootfs: %v \n", err)
+		return nil
+	}
+	defer etc.Close()
+	if info, err := etc.Stat(); err != nil || !info.IsDir() {
+		log.Printf("Warning: skip hostname, etc of rootfs is a symlink or not a dir \n")
+		return nil
+	}
+
+	target, err := openInRoot(procPath(etc), "hostname", false)
+	if errors.Is(err, syscall.ENOENT) {
+		flag := syscall.O_WRONLY | syscall.O_CREAT | syscall.O_EXCL | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+		var fd int
+		fd, err = syscall.Openat(int(etc.Fd()), "hostname", flag, 0644)
+		if err == syscall.EROFS {
+			log.Printf("Warning: skip hostname, no /etc/hostname in the read-only rootfs \n")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Create /etc/hostname of rootfs: %v", err)
+		}
+		syscall.Close(fd)
+		target, err = openInRoot(procPath(etc), "hostname", false)
+	}
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	if info, err := target.Stat(); err != nil || !info.Mode().IsRegular() {
+		log.Printf("Warning: skip hostname, /etc/hostname of rootfs is not a file \n")
+		return nil
+	}
+
+	if err := WriteFileStr(c.HostnameFile(), c.Hostname+"\n"); err != nil {
+		return err
+	}
+	return mount(c.HostnameFile(), procPath(target), "bind", syscall.MS_BIND, "")
+}
+
+// linkMtab links a missing <rootfs>/etc/mtab to /proc/self/mounts, so
+// the tools reading it see the mounts of their own process. An existing
+// mtab is never replaced, and a read-only rootfs is left without one.
+func (fs *rootFs) linkMtab(c *Container) error {
+	if c.NoMtab {
+		return nil
+	}
+
+	// A symlinked etc would resolve against the host's root.
+	etc := path.Join(c.Rootfs, "etc")
+	if info, err := os.Lstat(etc); err != nil || !info.IsDir() {
+		return nil
+	}
+
+	target := path.Join(etc, "mtab")
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink("/proc/self/mounts", target); err != nil && !errors.Is(err, syscall.EROFS) {
+		return err
+	}
 	return nil
 }
 
 func (fs *rootFs) Unmount(c *Container) error {
+	if c.Rootfs == "" {
+		return nil
+	}
+	if c.Hostname != "" {
+		syscall.Unmount(path.Join(c.Rootfs, "etc", "hostname"), 0)
+	}
+	if c.hasResolvConf() {
+		syscall.Unmount(path.Join(c.Rootfs, "etc", "resolv.conf"), 0)
+	}
+	if c.Localtime || c.Timezone != "" {
+		syscall.Unmount(path.Join(c.Rootfs, "etc", "localtime"), 0)
+	}
+	if len(c.Secrets) > 0 {
+		syscall.Unmount(path.Join(c.Rootfs, secretsDir), 0)
+	}
+	layers := fs.layers(c)
+	for i := len(layers); i > 0; i-- {
+		syscall.Unmount(path.Join(c.Rootfs, layers[i-1].dest), 0)
+	}
+	for i := len(c.KernelIfaces); i > 0; i-- {
+		syscall.Unmount(path.Join(c.Rootfs, c.KernelIfaces[i-1]), 0)
+	}
+	syscall.Unmount(path.Join(c.Rootfs, "dev", "shm"), 0)
+	syscall.Unmount(path.Join(c.Rootfs, "dev"), 0)
 	syscall.Unmount(path.Join(c.Rootfs, "proc"), 0)
 	return nil
 }
 
+// Methods to switch the root to the rootfs.
+const (
+	switchAuto  = "auto"
+	switchPivot = "pivot"
+	switchMove  = "move"
+)
+
+// pivotRootFunc is the pivot_root syscall.
+var pivotRootFunc = syscall.PivotRoot
+
+// Chroot switches the root to the rootfs by c.RootfsSwitch, pivot_root is
+// tried first in auto mode.
 func (fs *rootFs) Chroot(c *Container) error {
 	if err := syscall.Chdir(c.Rootfs); err != nil {
 		return err
 	}
 
-	if err := syscall.Mount(c.Rootfs, "/", "", syscall.MS_MOVE, ""); err != nil {
+	if c.RootfsSwitch == switchMove {
+		return moveRoot(c.Rootfs)
+	}
+
+	err := pivotRoot()
+	if !switchFallback(c.RootfsSwitch, err) {
+		return err
+	}
+	log.Printf("Warning: pivot_root %s: %v, fall back to MS_MOVE and chroot, the host's root stays reachable by a chroot escape \n", c.Rootfs, err)
+	return moveRoot(c.Rootfs)
+}
+
+// switchFallback reports whether a failed pivot_root falls back to move,
+// only in auto mode and for EINVAL, which pivot_root returns if the root
+// is a ramfs like in an initramfs.
+func switchFallback(method string, err error) bool {
+	return method == switchAuto && err == syscall.EINVAL
+}
+
+// pivotRoot makes the current dir the root and detaches the old root, the
+// old root is stacked under the new one by pivot_root(".", "."), so it
+// needs no dir in the rootfs.
+func pivotRoot() error {
+	oldroot, err := syscall.Open("/", syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(oldroot)
+
+	if err := pivotRootFunc(".", "."); err != nil {
+		return err
+	}
+
+	// The old root is now stacked on the new one, its unmount mustn't
+	// propagate to the host.
+	if err := syscall.Fchdir(oldroot); err != nil {
+		return err
+	}
+	if err := mount("", ".", "", syscall.MS_SLAVE|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("Unmount old root: %v", err)
+	}
+	return syscall.Chdir("/")
+}
+
+// moveRoot moves the rootfs mount over / and chroots into it, the current
+// dir must be rootfs.
+func moveRoot(rootfs string) error {
+	if err := mount(rootfs, "/", "", syscall.MS_MOVE, ""); err != nil {
 		return err
 	}
 
@@ -0,0 +1,904 @@
+package tinybox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tmpfsMagic is the statfs type of a tmpfs.
+const tmpfsMagic = 0x01021994
+
+// TestLocaltime binds a time zone over /etc/localtime of a rootfs, the
+// file or link of the rootfs must be left as it was.
+func TestLocaltime(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+	host, err := ioutil.ReadFile("/etc/localtime")
+	if err != nil {
+		t.Skip("no /etc/localtime on the host")
+	}
+
+	tests := []struct {
+		name      string
+		link      string // etc/localtime is a symlink to it if set
+		noFile    bool
+		localtime bool
+		timezone  string
+		want      string // content seen at etc/localtime, an error if ""
+	}{
+		{"timezone over file", "", false, false, "Asia/Shanghai", "CST"},
+		{"timezone over symlink", "/usr/share/zoneinfo/UTC", false, false, "Asia/Shanghai", "CST"},
+		{"timezone over dangling symlink", "/nonexistent", false, false, "Asia/Shanghai", "CST"},
+		{"timezone symlinked in rootfs", "", false, false, "UTC", "UTC"},
+		{"localtime over file", "", false, true, "", string(host)},
+		{"localtime over symlink", "/usr/share/zoneinfo/UTC", false, true, "", string(host)},
+		{"no localtime to bind over", "", true, false, "Asia/Shanghai", ""},
+		{"missing timezone", "", false, false, "Europe/Nowhere", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			zoneinfo := filepath.Join(rootfs, "usr/share/zoneinfo")
+			for _, dir := range []string{filepath.Join(rootfs, "etc"), filepath.Join(zoneinfo, "Asia"), filepath.Join(zoneinfo, "Etc")} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			files := map[string]string{
+				filepath.Join(zoneinfo, "Asia/Shanghai"): "CST",
+				filepath.Join(zoneinfo, "Etc/UTC"):       "UTC",
+			}
+			for name, data := range files {
+				if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink("/usr/share/zoneinfo/Etc/UTC", filepath.Join(zoneinfo, "UTC")); err != nil {
+				t.Fatal(err)
+			}
+
+			localtime := filepath.Join(rootfs, "etc/localtime")
+			switch {
+			case tt.noFile:
+			case tt.link != "":
+				err = os.Symlink(tt.link, localtime)
+			default:
+				err = ioutil.WriteFile(localtime, []byte("rootfs"), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, _ := os.Lstat(localtime)
+
+			c := &Container{Rootfs: rootfs, Localtime: tt.localtime, Timezone: tt.timezone}
+			err := (&rootFs{}).localtime(c)
+			if err == nil {
+				defer syscall.Unmount(localtime, syscall.MNT_DETACH)
+			}
+			if tt.want == "" {
+				if err == nil {
+					t.Fatal("localtime succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if data, err := ioutil.ReadFile(localtime); err != nil || string(data) != tt.want {
+				t.Errorf("etc/localtime = %q, %v, want %q", data, err, tt.want)
+			}
+			if err := ioutil.WriteFile(localtime, nil, 0644); err == nil {
+				t.Error("etc/localtime is writable")
+			}
+
+			syscall.Unmount(localtime, syscall.MNT_DETACH)
+			after, err := os.Lstat(localtime)
+			if err != nil || after.Mode() != before.Mode() || after.Size() != before.Size() {
+				t.Errorf("etc/localtime of the rootfs changed")
+			}
+			if tt.link != "" {
+				if link, _ := os.Readlink(localtime); link != tt.link {
+					t.Errorf("etc/localtime links to %s, want %s", link, tt.link)
+				}
+			}
+			for name, want := range files {
+				if data, _ := ioutil.ReadFile(name); string(data) != want {
+					t.Errorf("%s = %q, want %q", name, data, want)
+				}
+			}
+		})
+	}
+}
+
+// TestMountDev mounts a tmpfs with the nodes of the container on /dev of
+// a rootfs, /dev of the image is covered, not changed. A symlinked /dev
+// fails, and the host dir it leads to is left alone.
+func TestMountDev(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	tests := []struct {
+		name string
+		dev  string // "dir" with files of the image, "link" to a host dir, "" for none
+		ok   bool
+	}{
+		{"image dev", "dir", true},
+		{"no dev", "", true},
+		{"symlinked dev", "link", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs, host := t.TempDir(), t.TempDir()
+			dev := filepath.Join(rootfs, "dev")
+			image := filepath.Join(dev, "null")
+			switch tt.dev {
+			case "dir":
+				if err := os.Mkdir(dev, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(image, []byte("image"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			case "link":
+				if err := os.Symlink(host, dev); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := &Container{Rootfs: rootfs, CgOpts: &CGroupOptions{}}
+			err := (&rootFs{}).mountDev(c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("mountDev = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				if names, _ := readDirNames(host); len(names) > 0 {
+					t.Errorf("the host dir has %q, want it empty", names)
+				}
+				return
+			}
+			defer syscall.Unmount(dev, syscall.MNT_DETACH)
+
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(dev, &fs); err != nil || fs.Type != tmpfsMagic {
+				t.Errorf("/dev is not a tmpfs: %v", err)
+			}
+			for _, d := range defaultDevices {
+				if d.Path == "" {
+					continue
+				}
+				var st syscall.Stat_t
+				if err := syscall.Lstat(filepath.Join(rootfs, d.Path), &st); err != nil {
+					t.Errorf("no node %s: %v", d.Path, err)
+				} else if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || int64(devMajor(st.Rdev)) != d.Major || int64(devMinor(st.Rdev)) != d.Minor {
+					t.Errorf("node %s isn't %s", d.Path, d.Rule())
+				}
+			}
+
+			syscall.Unmount(dev, syscall.MNT_DETACH)
+			if tt.dev == "dir" {
+				if data, err := ioutil.ReadFile(image); err != nil || string(data) != "image" {
+					t.Errorf("dev/null of the image = %q, %v, want it left as it was", data, err)
+				}
+			}
+		})
+	}
+}
+
+// TestMountShm writes into the /dev/shm of a rootfs up to its size, the
+// files stay off the host's /dev/shm and dev/shm is only in the tmpfs of
+// /dev.
+func TestMountShm(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	tests := []struct {
+		size  string
+		write int
+		ok    bool
+	}{
+		{"64k", 32 << 10, true},
+		{"64k", 64 << 10, true},
+		{"64k", 65 << 10, false},
+		{"1m", 512 << 10, true},
+	}
+	for _, tt := range tests {
+		c := &Container{Rootfs: t.TempDir(), ShmSize: tt.size, CgOpts: &CGroupOptions{}}
+		if err := (&rootFs{}).mountDev(c); err != nil {
+			t.Fatal(err)
+		}
+		dev := filepath.Join(c.Rootfs, "dev")
+		if err := (&rootFs{}).mountShm(c); err != nil {
+			syscall.Unmount(dev, syscall.MNT_DETACH)
+			t.Fatal(err)
+		}
+		shm := filepath.Join(dev, "shm")
+
+		name := filepath.Base(c.Rootfs)
+		err := ioutil.WriteFile(filepath.Join(shm, name), make([]byte, tt.write), 0644)
+		if (err == nil) != tt.ok {
+			t.Errorf("write %d bytes into a %s shm = %v, want ok %v", tt.write, tt.size, err, tt.ok)
+		}
+		if _, err := os.Stat(filepath.Join("/dev/shm", name)); err == nil {
+			t.Errorf("the file of the container is on the host's /dev/shm")
+		}
+		syscall.Unmount(shm, syscall.MNT_DETACH)
+		syscall.Unmount(dev, syscall.MNT_DETACH)
+		if _, err := os.Stat(shm); err == nil {
+			t.Errorf("dev/shm was created in the rootfs")
+		}
+	}
+}
+
+// TestMountTmpfs mounts the tmpfs dirs on a read-only rootfs, they're
+// writable while the root isn't. A symlinked dir is skipped.
+func TestMountTmpfs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	host := t.TempDir()
+	rootfs := t.TempDir()
+	for _, dir := range []string{"tmp", "run", "srv"} {
+		if err := os.Mkdir(filepath.Join(rootfs, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{"var": "/srv", "srv/run": "/run", "opt": host}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(rootfs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mount(rootfs, rootfs, "bind", syscall.MS_BIND, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(rootfs, syscall.MNT_DETACH)
+	if err := syscall.Mount("", rootfs, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir     string
+		mounted bool
+	}{
+		{"tmp", true},
+		{"run", true},
+		{"var/run", false}, // under the symlink var
+		{"opt/tmp", false}, // the symlink leads to the host
+	}
+	c := &Container{Rootfs: rootfs}
+	for _, tt := range tests {
+		before, _ := ioutil.ReadFile("/proc/self/mountinfo")
+		if err := (&rootFs{}).mountTmpfs(c, tt.dir, "size=64k"); err != nil {
+			t.Errorf("mountTmpfs(%s) = %v", tt.dir, err)
+			continue
+		}
+		if !tt.mounted {
+			if after, _ := ioutil.ReadFile("/proc/self/mountinfo"); string(after) != string(before) {
+				t.Errorf("mountTmpfs(%s) mounted through a symlink", tt.dir)
+			}
+			continue
+		}
+
+		target := filepath.Join(rootfs, tt.dir)
+		if err := ioutil.WriteFile(filepath.Join(target, "f"), nil, 0644); err != nil {
+			t.Errorf("write in the tmpfs %s = %v", tt.dir, err)
+		}
+		syscall.Unmount(target, syscall.MNT_DETACH)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "f"), nil, 0644); err == nil {
+		t.Error("write in the read-only root succeeded")
+	}
+	if entries, _ := ioutil.ReadDir(host); len(entries) > 0 {
+		t.Errorf("created %s on the host", entries[0].Name())
+	}
+}
+
+// TestMountProc mounts /proc of a rootfs in each mode, a process can write
+// its own oom_score_adj unless ro, while the masked entries like
+// sysrq-trigger are covered.
+func TestMountProc(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	tests := []struct {
+		mode     string
+		writable bool // oom_score_adj can be written
+		masked   bool // sysrq-trigger is /dev/null and sys read-only
+	}{
+		{procMasked, true, true},
+		{procRW, true, false},
+		{procRO, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			c := &Container{Rootfs: t.TempDir(), ProcMode: tt.mode}
+			proc := filepath.Join(c.Rootfs, "proc")
+			if err := os.Mkdir(proc, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := (&rootFs{}).mountProc(c); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Unmount(proc, syscall.MNT_DETACH)
+
+			oom := filepath.Join(proc, "self/oom_score_adj")
+			adj, err := ioutil.ReadFile(oom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(oom, adj, 0); (err == nil) != tt.writable {
+				t.Errorf("write oom_score_adj = %v, want ok %v", err, tt.writable)
+			}
+
+			// Not every kernel has all of them, like sysrq-trigger.
+			for _, name := range procMaskedPaths {
+				var st syscall.Stat_t
+				if err := syscall.Stat(filepath.Join(proc, name), &st); err != nil {
+					continue
+				}
+				var covered bool
+				if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+					var fs syscall.Statfs_t
+					covered = syscall.Statfs(filepath.Join(proc, name), &fs) == nil && fs.Type == tmpfsMagic
+				} else {
+					covered = st.Mode&syscall.S_IFMT == syscall.S_IFCHR && devMajor(st.Rdev) == 1 && devMinor(st.Rdev) == 3
+				}
+				if covered != tt.masked {
+					t.Errorf("%s masked %v, want %v", name, covered, tt.masked)
+				}
+			}
+
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(filepath.Join(proc, "sys"), &fs); err != nil {
+				t.Fatal(err)
+			}
+			const stRdonly = 1
+			if ro := fs.Flags&stRdonly != 0; ro != (tt.masked || !tt.writable) {
+				t.Errorf("sys read-only %v, want %v", ro, tt.masked || !tt.writable)
+			}
+		})
+	}
+}
+
+// TestMountHostname binds the hostname over /etc/hostname of a rootfs,
+// read-only or not. A missing one is created on a writable rootfs, else
+// the rootfs is left without the bind, and so is a symlinked one or etc.
+func TestMountHostname(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	tests := []struct {
+		name     string
+		existing string // "file", "link", "etc link" or "" for none
+		readonly bool
+		bound    bool
+		image    string // etc/hostname of the rootfs after the unmount
+	}{
+		{"file", "file", false, true, "image\n"},
+		{"read-only rootfs", "file", true, true, "image\n"},
+		{"symlink", "link", false, false, ""},
+		{"symlinked etc", "etc link", false, false, ""},
+		{"missing", "", false, true, ""},
+		{"missing in read-only rootfs", "", true, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Name: "box", Dir: t.TempDir(), Rootfs: t.TempDir(), Hostname: "box-1"}
+			host := t.TempDir()
+			etc := filepath.Join(c.Rootfs, "etc")
+			target := filepath.Join(etc, "hostname")
+			if tt.existing == "etc link" {
+				os.Symlink(host, etc)
+			} else {
+				os.Mkdir(etc, 0755)
+			}
+			switch tt.existing {
+			case "file":
+				ioutil.WriteFile(target, []byte("image\n"), 0644)
+			case "link":
+				os.Symlink(filepath.Join(host, "hostname"), target)
+			}
+			if tt.readonly {
+				if err := syscall.Mount(c.Rootfs, c.Rootfs, "bind", syscall.MS_BIND, ""); err != nil {
+					t.Fatal(err)
+				}
+				defer syscall.Unmount(c.Rootfs, syscall.MNT_DETACH)
+				if err := syscall.Mount("", c.Rootfs, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			before, _ := ioutil.ReadFile("/proc/self/mountinfo")
+			if err := (&rootFs{}).mountHostname(c); err != nil {
+				t.Fatal(err)
+			}
+			if names, _ := readDirNames(host); len(names) > 0 {
+				t.Errorf("the host dir has %q, want it empty", names)
+			}
+			if !tt.bound {
+				if after, _ := ioutil.ReadFile("/proc/self/mountinfo"); string(after) != string(before) {
+					t.Error("mounted over a missing or symlinked hostname")
+				}
+				if _, err := os.Stat(target); tt.existing == "" && !os.IsNotExist(err) {
+					t.Error("etc/hostname created in the read-only rootfs")
+				}
+				return
+			}
+
+			if data, err := ioutil.ReadFile(target); err != nil || string(data) != "box-1\n" {
+				t.Errorf("etc/hostname = %q, %v, want %q", data, err, "box-1\n")
+			}
+			(&rootFs{}).Unmount(c)
+			if data, err := ioutil.ReadFile(target); err != nil || string(data) != tt.image {
+				t.Errorf("etc/hostname of the rootfs = %q, %v, want %q", data, err, tt.image)
+			}
+		})
+	}
+}
+
+// TestMountRetry fails the mount syscall with the errors in turn, a
+// transient one is retried until mountAttempts, another fails at once.
+func TestMountRetry(t *testing.T) {
+	defer func(f func(string, string, string, uintptr, string) error) { mountFunc = f }(mountFunc)
+	defer func(n int, d time.Duration) { mountAttempts, mountDelay = n, d }(mountAttempts, mountDelay)
+	mountAttempts, mountDelay = 3, time.Millisecond
+
+	tests := []struct {
+		name  string
+		errs  []error // of each call, nil after the last
+		calls int
+		err   error
+	}{
+		{"ok", nil, 1, nil},
+		{"busy twice", []error{syscall.EBUSY, syscall.EBUSY}, 3, nil},
+		{"again", []error{syscall.EAGAIN}, 2, nil},
+		{"interrupted", []error{syscall.EINTR}, 2, nil},
+		{"busy too long", []error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY}, 3, syscall.EBUSY},
+		{"permission", []error{syscall.EPERM}, 1, syscall.EPERM},
+		{"invalid", []error{syscall.EINVAL}, 1, syscall.EINVAL},
+		{"busy then permission", []error{syscall.EBUSY, syscall.EPERM}, 2, syscall.EPERM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			calls := 0
+			mountFunc = func(source, target, fstype string, flags uintptr, data string) error {
+				if target != "/target" || fstype != "bind" || flags != syscall.MS_BIND {
+					t.Errorf("mount(%q, %q, %q, %#x, %q)", source, target, fstype, flags, data)
+				}
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			}
+
+			err := mount("/source", "/target", "bind", syscall.MS_BIND, "")
+			if err != tt.err {
+				t.Errorf("mount = %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("called %d times, want %d", calls, tt.calls)
+			}
+			if retries := strings.Count(buf.String(), "retry in"); retries != tt.calls-1 {
+				t.Errorf("logged %d retries, want %d: %s", retries, tt.calls-1, buf.String())
+			}
+		})
+	}
+}
+
+// TestMountLayers mounts volumes nested in the tmpfs dirs and the other
+// way round, each given deeper first, every one must be visible.
+func TestMountLayers(t *testing.T) {
+	home := t.TempDir()
+	c := newVolumeContainer(t, home, "c", []Volume{
+		{Dest: "/tmp/cache"},
+		{Dest: "/var"},
+		{Dest: "/data/a", Order: 1},
+		{Dest: "/data/b"},
+		{Dest: "/data"},
+	})
+	c.TmpAsTmpfs = true
+	c.Rootfs = filepath.Join(home, "rootfs")
+
+	fs := &rootFs{}
+	var dests []string
+	for _, l := range fs.layers(c) {
+		dests = append(dests, l.dest)
+	}
+	want := []string{"/tmp", "/run", "/var", "/data", "/var/run", "/tmp/cache", "/data/b", "/data/a"}
+	if !reflect.DeepEqual(dests, want) {
+		t.Errorf("layers %v, want %v", dests, want)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+	if err := os.Mkdir(c.Rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range fs.layers(c) {
+		if err := l.mount(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer fs.Unmount(c)
+
+	// A file of the volume is seen through its source, below a tmpfs too.
+	for _, v := range c.Volumes {
+		if err := ioutil.WriteFile(filepath.Join(v.Source, "v"), []byte(v.Dest), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(c.Rootfs, v.Dest, "v")); err != nil || string(data) != v.Dest {
+			t.Errorf("volume %s in the rootfs = %q, %v", v.Dest, data, err)
+		}
+	}
+	for _, dir := range []string{"tmp", "run", "var/run"} {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(filepath.Join(c.Rootfs, dir), &st); err != nil || st.Type != tmpfsMagic {
+			t.Errorf("%s isn't a tmpfs: %#x, %v", dir, st.Type, err)
+		}
+	}
+
+	if err := fs.Unmount(c); err != nil {
+		t.Fatal(err)
+	}
+	if mounts, err := mountsUnder(c.Rootfs, true); err != nil || len(mounts) > 0 {
+		t.Errorf("mounts left after unmount: %v, %v", mounts, err)
+	}
+}
+
+func TestSwitchFallback(t *testing.T) {
+	tests := []struct {
+		method string
+		err    error
+		want   bool
+	}{
+		{switchAuto, syscall.EINVAL, true},
+		{switchAuto, nil, false},
+		{switchAuto, syscall.EPERM, false},
+		{switchPivot, syscall.EINVAL, false},
+		{switchMove, syscall.EINVAL, false},
+	}
+	for _, tt := range tests {
+		if got := switchFallback(tt.method, tt.err); got != tt.want {
+			t.Errorf("switchFallback(%s, %v) = %v, want %v", tt.method, tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestChroot switches the root of a child of the test in its own mount
+// namespace, a pivot_root failed with EINVAL like on a ramfs root falls
+// back to MS_MOVE in auto mode only. The child prints the file at the new
+// root.
+func TestChroot(t *testing.T) {
+	if env := os.Getenv("TINYBOX_TEST_CHROOT"); env != "" {
+		method, fail := env, false
+		if i := strings.IndexByte(env, ':'); i >= 0 {
+			method, fail = env[:i], true
+		}
+		if fail {
+			pivotRootFunc = func(string, string) error { return syscall.EINVAL }
+		}
+
+		rootfs := os.Getenv("TINYBOX_TEST_CHROOT_DIR")
+		err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, "")
+		if err == nil {
+			err = syscall.Mount("tmpfs", rootfs, "tmpfs", 0, "size=64k")
+		}
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(rootfs, "marker"), []byte("new root"), 0644)
+		}
+		if err == nil {
+			err = (&rootFs{}).Chroot(&Container{Rootfs: rootfs, RootfsSwitch: method})
+		}
+		if err != nil {
+			fmt.Println("chroot:", err)
+			os.Exit(100)
+		}
+		data, _ := ioutil.ReadFile("/marker")
+		fmt.Printf("%s\n", data)
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to unshare the mount namespace")
+	}
+
+	tests := []struct {
+		env      string // method[:pivot_root fails]
+		ok       bool
+		fallback bool
+	}{
+		{switchAuto, true, false},
+		{switchAuto + ":einval", true, true},
+		{switchPivot, true, false},
+		{switchPivot + ":einval", false, false},
+		{switchMove, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestChroot$")
+			cmd.Env = append(os.Environ(), "TINYBOX_TEST_CHROOT="+tt.env, "TINYBOX_TEST_CHROOT_DIR="+t.TempDir())
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+			out, err := cmd.CombinedOutput()
+			if (err == nil) != tt.ok {
+				t.Fatalf("child = %v, want ok %v: %s", err, tt.ok, out)
+			}
+			if !tt.ok {
+				if !strings.Contains(string(out), "chroot: invalid argument") {
+					t.Errorf("child printed %q, want the EINVAL of pivot_root", out)
+				}
+				return
+			}
+			if !strings.Contains(string(out), "new root\n") {
+				t.Errorf("child printed %q, want the marker of the new root", out)
+			}
+			if warned := strings.Contains(string(out), "fall back to MS_MOVE"); warned != tt.fallback {
+				t.Errorf("warned of the fallback %v, want %v: %s", warned, tt.fallback, out)
+			}
+		})
+	}
+}
+
+// TestLinkMtab links a missing /etc/mtab of a rootfs to /proc/self/mounts,
+// an existing mtab, --no-mtab and a rootfs without etc are left alone.
+func TestLinkMtab(t *testing.T) {
+	tests := []struct {
+		name   string
+		etc    bool   // the rootfs has etc
+		mtab   string // content of the existing mtab, "" for none
+		noMtab bool
+		want   string // the link, "" for no link
+	}{
+		{"missing", true, "", false, "/proc/self/mounts"},
+		{"existing", true, "rootfs / rootfs rw 0 0\n", false, ""},
+		{"no-mtab", true, "", true, ""},
+		{"no etc", false, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Container{Rootfs: t.TempDir(), NoMtab: tt.noMtab}
+			mtab := filepath.Join(c.Rootfs, "etc/mtab")
+			if tt.etc {
+				if err := os.Mkdir(filepath.Join(c.Rootfs, "etc"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.mtab != "" {
+				if err := ioutil.WriteFile(mtab, []byte(tt.mtab), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := (&rootFs{}).linkMtab(c); err != nil {
+				t.Fatal(err)
+			}
+
+			link, _ := os.Readlink(mtab)
+			if link != tt.want {
+				t.Errorf("mtab links to %q, want %q", link, tt.want)
+			}
+			if tt.mtab != "" {
+				if data, _ := ioutil.ReadFile(mtab); string(data) != tt.mtab {
+					t.Errorf("existing mtab changed to %q", data)
+				}
+			}
+		})
+	}
+}
+
+// TestMtabMounts mounts a rootfs in a child of the test in its own mount
+// namespace and switches to it, /etc/mtab in there must show the tmpfs of
+// the container and none of the host's mounts. A read-only rootfs is left
+// without an mtab.
+func TestMtabMounts(t *testing.T) {
+	if env := os.Getenv("TINYBOX_TEST_MTAB"); env != "" {
+		rootfs := os.Getenv("TINYBOX_TEST_MTAB_DIR")
+		c := &Container{Rootfs: rootfs}
+		err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, "")
+		if err == nil {
+			err = syscall.Mount("tmpfs", rootfs, "tmpfs", 0, "size=64k")
+		}
+		for _, dir := range []string{"etc", "proc", "tmp"} {
+			if err == nil {
+				err = os.Mkdir(filepath.Join(rootfs, dir), 0755)
+			}
+		}
+		if err == nil && env == "ro" {
+			err = syscall.Mount("", rootfs, "", syscall.MS_REMOUNT|syscall.MS_RDONLY, "")
+		}
+		if err == nil {
+			err = (&rootFs{}).linkMtab(c)
+		}
+		if err == nil {
+			err = syscall.Mount("proc", filepath.Join(rootfs, "proc"), "proc", 0, "")
+		}
+		if err == nil {
+			err = syscall.Mount("tmpfs", filepath.Join(rootfs, "tmp"), "tmpfs", 0, "size=64k")
+		}
+		if err == nil {
+			err = (&rootFs{}).Chroot(c)
+		}
+		if err != nil {
+			fmt.Println("mtab:", err)
+			os.Exit(100)
+		}
+		data, err := ioutil.ReadFile("/etc/mtab")
+		if err != nil {
+			fmt.Println("no mtab:", err)
+			os.Exit(0)
+		}
+		fmt.Printf("%s", data)
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to unshare the mount namespace")
+	}
+
+	tests := []struct {
+		env  string
+		mtab bool
+	}{
+		{"rw", true},
+		{"ro", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestMtabMounts$")
+			cmd.Env = append(os.Environ(), "TINYBOX_TEST_MTAB="+tt.env, "TINYBOX_TEST_MTAB_DIR="+t.TempDir())
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("child = %v: %s", err, out)
+			}
+			if !tt.mtab {
+				if !strings.Contains(string(out), "no mtab:") {
+					t.Errorf("read-only rootfs has an mtab: %s", out)
+				}
+				return
+			}
+
+			points := map[string]string{}
+			for _, line := range strings.Split(string(out), "\n") {
+				if f := strings.Fields(line); len(f) >= 3 {
+					points[f[1]] = f[2]
+				}
+			}
+			if points["/tmp"] != "tmpfs" || points["/proc"] != "proc" {
+				t.Errorf("mtab misses the container's mounts: %s", out)
+			}
+			for _, host := range []string{"/sys", "/sys/fs/cgroup", "/dev"} {
+				if _, ok := points[host]; ok {
+					t.Errorf("mtab shows the host mount %s: %s", host, out)
+				}
+			}
+		})
+	}
+}
+
+// TestPropagation mounts the rootfs of a container in a child of the test
+// in its own mount namespace, the rootfs is a shared mount of the host. A
+// host mount after the start must show in a slave container only, and a
+// mount of the container never shows on the host.
+func TestPropagation(t *testing.T) {
+	if prop := os.Getenv("TINYBOX_TEST_PROPAGATION"); prop != "" {
+		c := &Container{Rootfs: os.Getenv("TINYBOX_TEST_PROPAGATION_DIR"), Propagation: prop, ProcMode: procRW, ShmSize: "64k", CgOpts: &CGroupOptions{}}
+		if err := (&rootFs{}).Mount(c); err != nil {
+			fmt.Println("mount:", err)
+			os.Exit(100)
+		}
+		in := bufio.NewScanner(os.Stdin)
+		fmt.Println("mounted")
+		in.Scan() // the host mounted
+
+		var fs syscall.Statfs_t
+		fmt.Println("host mount seen:", syscall.Statfs(filepath.Join(c.Rootfs, "host"), &fs) == nil && fs.Type == tmpfsMagic)
+		if err := syscall.Mount("tmpfs", filepath.Join(c.Rootfs, "inner"), "tmpfs", 0, "size=64k"); err != nil {
+			fmt.Println("mount inner:", err)
+			os.Exit(100)
+		}
+		fmt.Println("inner mounted")
+		in.Scan() // the host checked
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	tests := []struct {
+		prop string
+		seen bool // the host mount shows in the container
+	}{
+		{propSlave, true},
+		{propPrivate, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prop, func(t *testing.T) {
+			rootfs := t.TempDir()
+			for _, dir := range []string{"proc", "dev", "host", "inner"} {
+				if err := os.Mkdir(filepath.Join(rootfs, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := syscall.Mount(rootfs, rootfs, "bind", syscall.MS_BIND, ""); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Unmount(rootfs, syscall.MNT_DETACH)
+			if err := syscall.Mount("", rootfs, "", syscall.MS_SHARED, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestPropagation$")
+			cmd.Env = append(os.Environ(), "TINYBOX_TEST_PROPAGATION="+tt.prop, "TINYBOX_TEST_PROPAGATION_DIR="+rootfs)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+			cmd.Stderr = os.Stderr
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Wait()
+			defer stdin.Close()
+			out := bufio.NewScanner(stdout)
+			next := func() string {
+				if !out.Scan() {
+					t.Fatal("child exited")
+				}
+				return out.Text()
+			}
+
+			if line := next(); line != "mounted" {
+				t.Fatalf("child: %s", line)
+			}
+			host := filepath.Join(rootfs, "host")
+			if err := syscall.Mount("tmpfs", host, "tmpfs", 0, "size=64k"); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Unmount(host, syscall.MNT_DETACH)
+			fmt.Fprintln(stdin, "host mounted")
+
+			if line, want := next(), fmt.Sprintf("host mount seen: %v", tt.seen); line != want {
+				t.Errorf("child: %s, want %s", line, want)
+			}
+			if line := next(); line != "inner mounted" {
+				t.Fatalf("child: %s", line)
+			}
+			var fs syscall.Statfs_t
+			if err := syscall.Statfs(filepath.Join(rootfs, "inner"), &fs); err != nil || fs.Type == tmpfsMagic {
+				syscall.Unmount(filepath.Join(rootfs, "inner"), syscall.MNT_DETACH)
+				t.Errorf("the container's mount shows on the host")
+			}
+			fmt.Fprintln(stdin, "checked")
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package tinybox
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// oPath is O_PATH, which package syscall doesn't define.
+const oPath = 0x200000
+
+// openInRoot opens the path name under root with O_PATH. No component is
+// followed if it's a symlink, so the path can't lead out of root to the
+// host, the last one is opened as is, a symlink included. With mkdir the
+// missing dirs are created, the last one too. A symlink or file on the
+// way fails with ENOTDIR.
+func openInRoot(root, name string, mkdir bool) (*os.File, error) {
+	fd, err := syscall.Open(root, oPath|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: root, Err: err}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path.Clean("/"+name), "/"), "/")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		flag := oPath | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+		if i < len(parts)-1 {
+			flag |= syscall.O_DIRECTORY
+		}
+
+		next, err := syscall.Openat(fd, part, flag, 0)
+		if err == syscall.ENOENT && mkdir {
+			if err = syscall.Mkdirat(fd, part, 0755); err == nil || err == syscall.EEXIST {
+				next, err = syscall.Openat(fd, part, flag, 0)
+			}
+		}
+		syscall.Close(fd)
+
+		dir := "/" + path.Join(parts[:i+1]...)
+		if err == syscall.ENOTDIR {
+			return nil, fmt.Errorf("%s of the rootfs is a symlink or not a dir: %w", dir, err)
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "open", Path: path.Join(root, dir), Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), path.Join(root, name)), nil
+}
+
+// maxSymlinks is how many symlinks resolveInRoot follows, like the
+// kernel's limit of a path lookup.
+const maxSymlinks = 40
+
+// resolveInRoot resolves the symlinks of the path name as if root were
+// the root, an absolute link or a ".." can't lead out of it. The returned
+// path under root has no symlink left.
+func resolveInRoot(root, name string) (string, error) {
+	resolved, rest := "/", name
+	for links := 0; rest != ""; {
+		part := rest
+		rest = ""
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			part, rest = part[:i], part[i+1:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", &os.PathError{Op: "resolve", Path: path.Join(root, name), Err: syscall.ELOOP}
+		}
+		link, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = "/"
+		}
+		rest = link + "/" + rest
+	}
+	return path.Join(root, resolved), nil
+}
+
+// procPath is the path of f in /proc. A mount on it is on the file f is
+// opened on, even a symlink, the path isn't resolved again.
+func procPath(f *os.File) string {
+	return "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+}
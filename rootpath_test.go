@@ -0,0 +1,117 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenInRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		dirs  []string
+		links map[string]string
+		path  string
+		mkdir bool
+		mode  os.FileMode // type of the opened file, an error if 0
+	}{
+		{"root", nil, nil, "/", false, os.ModeDir},
+		{"dir", []string{"a/b"}, nil, "/a/b", false, os.ModeDir},
+		{"missing", nil, nil, "/a/b", false, 0},
+		{"created", []string{"a"}, nil, "/a/b/c", true, os.ModeDir},
+		{"last symlink opened as is", []string{"etc"}, map[string]string{"etc/localtime": "/nonexistent"}, "/etc/localtime", false, os.ModeSymlink},
+		{"dir symlink", nil, map[string]string{"a": "/"}, "/a/b", false, 0},
+		{"dir symlink not created through", nil, map[string]string{"a": "/nonexistent"}, "/a/b", true, 0},
+		{"relative dir symlink", []string{"b"}, map[string]string{"a": "b"}, "/a/c", true, 0},
+		{"dotdot stays in root", []string{"a"}, nil, "/../../a", false, os.ModeDir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range tt.links {
+				if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			f, err := openInRoot(root, tt.path, tt.mkdir)
+			if tt.mode == 0 {
+				if err == nil {
+					f.Close()
+					t.Fatal("openInRoot succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Type() != tt.mode {
+				t.Errorf("opened a %v, want %v", info.Mode().Type(), tt.mode)
+			}
+		})
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		links map[string]string
+		path  string
+		want  string // under root, an error if ""
+	}{
+		{"plain", nil, "/usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/UTC"},
+		{"relative", map[string]string{"usr/share/zoneinfo/UTC": "Etc/UTC"}, "/usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/Etc/UTC"},
+		{"absolute", map[string]string{"etc/localtime": "/usr/share/zoneinfo/UTC"}, "/etc/localtime", "/usr/share/zoneinfo/UTC"},
+		{"dir", map[string]string{"zone": "/usr/share/zoneinfo"}, "/zone/UTC", "/usr/share/zoneinfo/UTC"},
+		{"dotdot past root", map[string]string{"etc/localtime": "../../../../usr/share/zoneinfo/UTC"}, "/etc/localtime", "/usr/share/zoneinfo/UTC"},
+		{"dangling", map[string]string{"etc/localtime": "/nonexistent"}, "/etc/localtime", ""},
+		{"loop", map[string]string{"etc/a": "b", "etc/b": "a"}, "/etc/a", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range []string{"etc", "usr/share/zoneinfo/Etc"} {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, file := range []string{"usr/share/zoneinfo/UTC", "usr/share/zoneinfo/Etc/UTC"} {
+				if err := ioutil.WriteFile(filepath.Join(root, file), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range tt.links {
+				os.Remove(filepath.Join(root, name))
+				if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := resolveInRoot(root, tt.path)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("resolveInRoot = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("resolveInRoot = %s, want %s", got, want)
+			}
+		})
+	}
+}
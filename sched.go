@@ -0,0 +1,70 @@
+package tinybox
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var schedPolicies = map[string]int{
+	"SCHED_OTHER": 0,
+	"SCHED_FIFO":  1,
+	"SCHED_RR":    2,
+	"SCHED_BATCH": 3,
+	"SCHED_IDLE":  5,
+}
+
+func isRtPolicy(policy string) bool {
+	return policy == "SCHED_FIFO" || policy == "SCHED_RR"
+}
+
+// validateSched checks the scheduling options, a real-time policy needs a
+// real-time budget in the cpu cgroup, or it can't run at all.
+func validateSched(nice int, policy string, priority int, opt *CGroupOptions) error {
+	if nice < -20 || nice > 19 {
+		return fmt.Errorf("Invalid nice %d, must be in [-20, 19]", nice)
+	}
+	if policy == "" {
+		return nil
+	}
+
+	if _, ok := schedPolicies[policy]; !ok {
+		return fmt.Errorf("Unknown sched policy %s", policy)
+	}
+
+	if isRtPolicy(policy) {
+		if priority < 1 || priority > 99 {
+			return fmt.Errorf("Sched policy %s needs a priority in [1, 99]", policy)
+		}
+		if opt.CpuRtRuntime == "0" {
+			return fmt.Errorf("Sched policy %s needs --cpu-rt-runtime", policy)
+		}
+	} else if priority != 0 {
+		return fmt.Errorf("Sched policy %s must have priority 0", policy)
+	}
+	return nil
+}
+
+// setSched sets the nice value and scheduling policy of the calling
+// thread, they are kept by the exec.
+func setSched(c *Container) error {
+	if c.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, c.Nice); err != nil {
+			return fmt.Errorf("Set nice %d: %v", c.Nice, err)
+		}
+	}
+
+	if c.SchedPolicy == "" {
+		return nil
+	}
+
+	param := struct {
+		priority int32
+	}{int32(c.SchedPriority)}
+	policy := schedPolicies[c.SchedPolicy]
+	_, _, e := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, uintptr(policy), uintptr(unsafe.Pointer(&param)))
+	if e != 0 {
+		return fmt.Errorf("Set sched policy %s: %v", c.SchedPolicy, e)
+	}
+	return nil
+}
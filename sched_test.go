@@ -0,0 +1,87 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateSched(t *testing.T) {
+	budget := &CGroupOptions{CpuRtRuntime: "10000"}
+	noBudget := &CGroupOptions{CpuRtRuntime: "0"}
+	tests := []struct {
+		name     string
+		nice     int
+		policy   string
+		priority int
+		opt      *CGroupOptions
+		ok       bool
+	}{
+		{"default", 0, "", 0, noBudget, true},
+		{"nice", 10, "", 0, noBudget, true},
+		{"nice too low", -21, "", 0, noBudget, false},
+		{"nice too high", 20, "", 0, noBudget, false},
+		{"batch", 0, "SCHED_BATCH", 0, noBudget, true},
+		{"batch with priority", 0, "SCHED_BATCH", 1, noBudget, false},
+		{"unknown", 0, "SCHED_DEADLINE", 0, noBudget, false},
+		{"fifo", 0, "SCHED_FIFO", 10, budget, true},
+		{"fifo without budget", 0, "SCHED_FIFO", 10, noBudget, false},
+		{"rr without priority", 0, "SCHED_RR", 0, budget, false},
+		{"rr priority too high", 0, "SCHED_RR", 100, budget, false},
+	}
+	for _, tt := range tests {
+		err := validateSched(tt.nice, tt.policy, tt.priority, tt.opt)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: validateSched = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// TestSetSched sets the nice and policy of a thread, and reads them back
+// from its stat. The thread exits with its goroutine.
+func TestSetSched(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to set a negative nice")
+	}
+
+	tests := []struct {
+		nice   int
+		policy string
+		want   int // the policy number in stat
+	}{
+		{5, "", 0},
+		{-5, "", 0},
+		{0, "SCHED_BATCH", 3},
+		{3, "SCHED_IDLE", 5},
+	}
+	for _, tt := range tests {
+		done := make(chan []string)
+		go func() {
+			runtime.LockOSThread()
+			c := &Container{Nice: tt.nice, SchedPolicy: tt.policy}
+			if err := setSched(c); err != nil {
+				t.Error(err)
+				done <- nil
+				return
+			}
+			b, _ := ioutil.ReadFile("/proc/thread-self/stat")
+			// The fields after the command, which is in parentheses.
+			done <- strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+2:]))
+		}()
+
+		fields := <-done
+		if len(fields) < 39 {
+			continue
+		}
+		// nice is field 19 and policy 41 of stat, counted from pid.
+		if nice, _ := strconv.Atoi(fields[16]); nice != tt.nice {
+			t.Errorf("nice %d, want %d", nice, tt.nice)
+		}
+		if policy, _ := strconv.Atoi(fields[38]); policy != tt.want {
+			t.Errorf("policy %d, want %d (%s)", policy, tt.want, tt.policy)
+		}
+	}
+}
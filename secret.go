@@ -0,0 +1,123 @@
+package tinybox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// secretsDir holds the secrets in the container, on a tmpfs.
+const secretsDir = "/run/secrets"
+
+// Secret is a file put into the container's secretsDir. Its data is read
+// on the host at create time and only sent to the init process through
+// the pipe, it's never written to disk.
+type Secret struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// parseSecret parses --secret name=source.
+func parseSecret(s string) (Secret, error) {
+	name, source, err := parseKV(s)
+	if err != nil || source == "" {
+		return Secret{}, fmt.Errorf("Invalid secret %s, expect name=source", s)
+	}
+	return Secret{Name: name, Source: source}, nil
+}
+
+// String hides the data of the secret from logs.
+func (s Secret) String() string {
+	return fmt.Sprintf("{Name:%s Source:%s}", s.Name, s.Source)
+}
+
+func (s *Secret) Validate() error {
+	if s.Name == "." || s.Name == ".." || strings.ContainsAny(s.Name, "/\x00") {
+		return fmt.Errorf("Invalid secret name %s", s.Name)
+	}
+	return nil
+}
+
+// readSecrets reads the data of secrets from their sources.
+func readSecrets(secrets []Secret) ([]Secret, error) {
+	result := make([]Secret, 0, len(secrets))
+	for _, s := range secrets {
+		data, err := ioutil.ReadFile(s.Source)
+		if err != nil {
+			return nil, fmt.Errorf("Read secret %s: %v", s.Name, err)
+		}
+		s.Data = data
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// mountSecrets mounts a tmpfs on secretsDir of the rootfs and writes the
+// secrets into it, readable by root only. The dir is opened in the rootfs
+// and written through its fd, a symlink can't lead the secrets out.
+func (fs *rootFs) mountSecrets(c *Container) error {
+	if len(c.Secrets) == 0 {
+		return nil
+	}
+
+	target, err := openInRoot(c.Rootfs, secretsDir, true)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	flag := syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+	if err := mount("tmpfs", procPath(target), "tmpfs", uintptr(flag), "mode=755,size=1m"); err != nil {
+		return fmt.Errorf("Mount tmpfs on %s: %v", secretsDir, err)
+	}
+
+	// Opened again, the path now leads to the tmpfs.
+	dir, err := openInRoot(c.Rootfs, secretsDir, false)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	for _, s := range c.Secrets {
+		if err := writeSecret(dir, s); err != nil {
+			return fmt.Errorf("Write secret %s: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+func writeSecret(dir *os.File, s Secret) error {
+	flag := syscall.O_WRONLY | syscall.O_CREAT | syscall.O_TRUNC | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+	fd, err := syscall.Openat(int(dir.Fd()), s.Name, flag, 0400)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), s.Name)
+	if _, err := f.Write(s.Data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// secretValue is the --secret flag.
+type secretValue []Secret
+
+func (v *secretValue) String() string {
+	var names []string
+	for _, s := range *v {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *secretValue) Set(s string) error {
+	secret, err := parseSecret(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, secret)
+	return nil
+}
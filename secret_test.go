@@ -0,0 +1,112 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseSecret(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"db=/etc/db.pass", true},
+		{"db=", false},
+		{"db", false},
+		{"../db=/etc/db.pass", false},
+		{"a/b=/etc/db.pass", false},
+		{"..=/etc/db.pass", false},
+	}
+	for _, tt := range tests {
+		s, err := parseSecret(tt.in)
+		if err == nil {
+			err = s.Validate()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSecret(%q) = %v, want ok %v", tt.in, err, tt.ok)
+		}
+	}
+}
+
+// TestMountSecrets puts two secrets into a rootfs, they're only readable
+// by root in it and never on the rootfs itself, nor on the host through
+// a symlinked /run.
+func TestMountSecrets(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	host := t.TempDir()
+	sources := map[string]string{"db": "hunter2", "token": "abc"}
+	var secrets []Secret
+	for name, data := range sources {
+		source := filepath.Join(host, name)
+		ioutil.WriteFile(source, []byte(data), 0600)
+		secrets = append(secrets, Secret{Name: name, Source: source})
+	}
+	secrets, err := readSecrets(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range secrets {
+		if strings.Contains(s.String(), string(s.Data)) {
+			t.Errorf("String of secret %s shows the data", s.Name)
+		}
+	}
+
+	c := &Container{Rootfs: t.TempDir(), Secrets: secrets}
+	dir := filepath.Join(c.Rootfs, secretsDir)
+	if err := (&rootFs{}).mountSecrets(c); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(dir, syscall.MNT_DETACH)
+
+	for name, data := range sources {
+		file := filepath.Join(dir, name)
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); info.Mode().Perm() != 0400 || st.Uid != 0 {
+			t.Errorf("secret %s has mode %v and uid %d, want 0400 root", name, info.Mode().Perm(), st.Uid)
+		}
+		if b, err := ioutil.ReadFile(file); err != nil || string(b) != data {
+			t.Errorf("secret %s = %q, %v, want %q", name, b, err, data)
+		}
+
+		cat := exec.Command("/bin/cat", file)
+		cat.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+		if out, err := cat.Output(); err == nil {
+			t.Errorf("secret %s read by another user: %q", name, out)
+		}
+	}
+
+	if err := syscall.Unmount(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := readDirNames(dir); len(names) > 0 {
+		t.Errorf("secrets on the rootfs: %v", names)
+	}
+
+	// A symlinked /run fails and the host dir it leads to stays empty.
+	run := filepath.Join(host, "run")
+	if err := os.Mkdir(run, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.Rootfs = t.TempDir()
+	if err := os.Symlink(run, filepath.Join(c.Rootfs, "run")); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&rootFs{}).mountSecrets(c); err == nil {
+		syscall.Unmount(filepath.Join(run, "secrets"), syscall.MNT_DETACH)
+		t.Error("mountSecrets through a symlinked /run succeeded")
+	}
+	if names, _ := readDirNames(run); len(names) > 0 {
+		t.Errorf("secrets on the host: %v", names)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !amd64 && !386
+// +build !amd64,!386
+
+package tinybox
+
+import "syscall"
+
+// sysSetns is the setns syscall.
+const sysSetns = syscall.SYS_SETNS
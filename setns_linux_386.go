@@ -0,0 +1,4 @@
+package tinybox
+
+// sysSetns is the setns syscall, syscall has no name for it on 386.
+const sysSetns = 346
@@ -0,0 +1,42 @@
+package tinybox
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// startSlotRetry is the delay before trying the start slots again.
+const startSlotRetry = time.Millisecond * 100
+
+// startLockEnv passes the fd of the start slot to the init process.
+const startLockEnv = "__TINYBOX_START_LOCK__"
+
+// acquireStartSlot takes one of the n slots of the start semaphore shared
+// by all tinybox processes of home, it blocks until a slot is free. A slot
+// is a locked file, it's freed when all fds on it are closed.
+func acquireStartSlot(home string, n int) (*os.File, error) {
+	logged := false
+	for {
+		for i := 0; i < n; i++ {
+			name := filepath.Join(home, fmt.Sprintf(".start.%d", i))
+			f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+				return f, nil
+			}
+			f.Close()
+		}
+
+		if !logged {
+			log.Printf("Wait for a start slot, %d starts are running \n", n)
+			logged = true
+		}
+		time.Sleep(startSlotRetry)
+	}
+}
@@ -0,0 +1,96 @@
+package tinybox
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStartSlots starts more containers at once than the slots, no more
+// than the slots may be in the setup at the same time.
+func TestStartSlots(t *testing.T) {
+	tests := []struct {
+		slots, starts int
+	}{
+		{1, 4},
+		{2, 6},
+		{3, 3},
+	}
+	for _, tt := range tests {
+		home := t.TempDir()
+		var (
+			mu           sync.Mutex
+			active, peak int
+			wg           sync.WaitGroup
+			errs         = make(chan error, tt.starts)
+		)
+		for i := 0; i < tt.starts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				slot, err := acquireStartSlot(home, tt.slots)
+				if err != nil {
+					errs <- err
+					return
+				}
+				mu.Lock()
+				if active++; active > peak {
+					peak = active
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond * 150)
+
+				mu.Lock()
+				active--
+				mu.Unlock()
+				slot.Close()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		if peak > tt.slots {
+			t.Errorf("%d of %d slots used at once", peak, tt.slots)
+		}
+		// The starts are longer than a retry, all slots fill up.
+		want := tt.slots
+		if tt.starts < want {
+			want = tt.starts
+		}
+		if peak < want {
+			t.Errorf("only %d of %d slots used at once", peak, tt.slots)
+		}
+	}
+}
+
+// TestStartSlotInherited passes a slot to a child like the init process,
+// it's held until the child exits even once the parent closes it.
+func TestStartSlotInherited(t *testing.T) {
+	home := t.TempDir()
+	slot, err := acquireStartSlot(home, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sleep", "0.5")
+	cmd.ExtraFiles = []*os.File{slot}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	start := time.Now()
+	slot.Close()
+
+	slot, err = acquireStartSlot(home, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slot.Close()
+	if elapsed := time.Since(start); elapsed < time.Millisecond*400 {
+		t.Errorf("took the slot after %s, while the child still had it", elapsed)
+	}
+}
@@ -0,0 +1,152 @@
+package tinybox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// syncChannel sends the json of Container from the master to the init
+// process, the init process blocks until it's received.
+type syncChannel interface {
+	send(c *Container) error
+	receive(c *Container) error
+	// abort releases a send blocked on the init process.
+	abort()
+}
+
+// syncChannel returns the channel of the container, the named pipe, or
+// the unix socket if the filesystem of the dir can't hold a FIFO.
+func (c *Container) syncChannel() syncChannel {
+	if info, err := os.Lstat(c.PipeFile()); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		return fifoChannel(c.PipeFile())
+	}
+	return &socketChannel{name: c.SockFile()}
+}
+
+func (c *Container) SockFile() string {
+	return filepath.Join(c.Dir, "sync.sock")
+}
+
+// mkfifoFunc is the mkfifo syscall.
+var mkfifoFunc = syscall.Mkfifo
+
+// createPipe creates the named pipe of the container. If the filesystem
+// doesn't support FIFOs, no pipe is created and the socket is used.
+func (c *Container) createPipe() error {
+	err := ensureFile(c.PipeFile(), os.ModeNamedPipe, func(name string) error {
+		return mkfifoFunc(name, 0)
+	})
+	switch err {
+	case nil:
+		return nil
+	case syscall.EPERM, syscall.ENOSYS, syscall.EOPNOTSUPP, syscall.EINVAL:
+		return nil
+	}
+	return fmt.Errorf("Create %s, TINYBOX_HOME must be on a filesystem supporting FIFOs or unix sockets, like a tmpfs: %v", c.PipeFile(), err)
+}
+
+type fifoChannel string
+
+func (f fifoChannel) send(c *Container) error {
+	pipe, err := os.OpenFile(string(f), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Write container pipe: %v", err)
+	}
+	defer pipe.Close()
+
+	return json.NewEncoder(pipe).Encode(c)
+}
+
+// abort opens the read end, which unblocks the open of the writer, its
+// write then fails without a reader.
+func (f fifoChannel) abort() {
+	if pipe, err := os.OpenFile(string(f), os.O_RDONLY|syscall.O_NONBLOCK, 0); err == nil {
+		pipe.Close()
+	}
+}
+
+func (f fifoChannel) receive(c *Container) error {
+	pipe, err := os.OpenFile(string(f), os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("Read container pipe: %v", err)
+	}
+	defer pipe.Close()
+
+	return json.NewDecoder(pipe).Decode(c)
+}
+
+// socketDialRetry is the delay between the dials of the init process
+// before the master listens.
+const socketDialRetry = time.Millisecond * 50
+
+// socketChannel is the unix socket at name, the master listens on it.
+type socketChannel struct {
+	name string
+
+	mu      sync.Mutex
+	ln      net.Listener
+	aborted bool
+}
+
+func (s *socketChannel) send(c *Container) error {
+	if err := os.Remove(s.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.aborted {
+		s.mu.Unlock()
+		return fmt.Errorf("Listen container socket: aborted")
+	}
+	ln, err := net.Listen("unix", s.name)
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("Listen container socket: %v", err)
+	}
+	s.ln = ln
+	s.mu.Unlock()
+	defer os.Remove(s.name)
+	defer ln.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return fmt.Errorf("Accept container socket: %v", err)
+	}
+	defer conn.Close()
+
+	return json.NewEncoder(conn).Encode(c)
+}
+
+// abort closes the listener, which fails the accept of send. A send that
+// hasn't listened yet doesn't listen at all.
+func (s *socketChannel) abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+}
+
+// receive dials until the master listens, like the open of a FIFO blocks
+// until the other end opens it.
+func (s *socketChannel) receive(c *Container) error {
+	for {
+		conn, err := net.Dial("unix", s.name)
+		if err == nil {
+			defer conn.Close()
+			return json.NewDecoder(conn).Decode(c)
+		}
+		if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) {
+			return fmt.Errorf("Read container socket: %v", err)
+		}
+		time.Sleep(socketDialRetry)
+	}
+}
@@ -0,0 +1,136 @@
+package tinybox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSocketChannelAbort aborts a send before and after it listens, the
+// send must return either way.
+func TestSocketChannelAbort(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen bool // abort once send listens
+	}{
+		{"before listen", false},
+		{"while accepting", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := &socketChannel{name: filepath.Join(t.TempDir(), "sync.sock")}
+			if !tt.listen {
+				ch.abort()
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- ch.send(&Container{Name: "test"})
+			}()
+			if tt.listen {
+				for deadline := time.Now().Add(time.Second * 5); ; {
+					ch.mu.Lock()
+					listening := ch.ln != nil
+					ch.mu.Unlock()
+					if listening {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("send didn't listen")
+					}
+					time.Sleep(time.Millisecond)
+				}
+				ch.abort()
+			}
+
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("send succeeded without a receiver")
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("send blocked after abort")
+			}
+		})
+	}
+}
+
+func TestSocketChannel(t *testing.T) {
+	ch := &socketChannel{name: filepath.Join(t.TempDir(), "sync.sock")}
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.send(&Container{Name: "test"})
+	}()
+
+	var c Container
+	if err := ch.receive(&c); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "test" {
+		t.Errorf("received %q, want %q", c.Name, "test")
+	}
+}
+
+// TestCreatePipe fails the mkfifo of the container's pipe, a filesystem
+// without FIFOs falls back to the socket, another error is explained.
+func TestCreatePipe(t *testing.T) {
+	defer func(f func(string, uint32) error) { mkfifoFunc = f }(mkfifoFunc)
+
+	tests := []struct {
+		name string
+		err  error // of mkfifo, nil for the real one
+		fifo bool  // the channel is the pipe, the socket otherwise
+		ok   bool
+	}{
+		{"fifo", nil, true, true},
+		{"no fifo support", syscall.EPERM, false, true},
+		{"not supported", syscall.EOPNOTSUPP, false, true},
+		{"other error", syscall.EIO, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mkfifoFunc = syscall.Mkfifo
+			if tt.err != nil {
+				err := tt.err
+				mkfifoFunc = func(string, uint32) error { return err }
+			}
+
+			c := &Container{Name: "pipe", Dir: t.TempDir()}
+			err := c.createPipe()
+			if (err == nil) != tt.ok {
+				t.Fatalf("createPipe = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "TINYBOX_HOME must be on a filesystem supporting FIFOs") {
+					t.Errorf("unclear error: %v", err)
+				}
+				return
+			}
+
+			ch := c.syncChannel()
+			if _, fifo := ch.(fifoChannel); fifo != tt.fifo {
+				t.Fatalf("sync channel %T, want the fifo %v", ch, tt.fifo)
+			}
+			if _, err := os.Lstat(c.PipeFile()); os.IsNotExist(err) == tt.fifo {
+				t.Errorf("pipe file exists %v, want %v", !os.IsNotExist(err), tt.fifo)
+			}
+
+			// Either channel carries the config to the init process.
+			done := make(chan error, 1)
+			go func() { done <- ch.send(&Container{Name: "sent"}) }()
+			var got Container
+			if err := c.syncChannel().receive(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-done; err != nil || got.Name != "sent" {
+				t.Errorf("received %q, send %v", got.Name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package tinybox
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// extractTar extracts the tarball file (optionally gzipped) into dest. As
+// root, the ownership and device nodes are kept, device nodes are skipped
+// when it's not run as root. Entries escaping dest are rejected.
+func extractTar(file, dest string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return untar(f, dest, false)
+}
+
+// Whiteouts of an image layer, a .wh.<name> entry removes name of the
+// lower layers, and an opaque one empties its dir.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// untar extracts the tarball read from in into dest like extractTar, with
+// whiteouts the whiteout entries of an image layer are applied.
+func untar(in io.Reader, dest string, whiteouts bool) error {
+	var r io.Reader = bufio.NewReader(in)
+	if magic, err := r.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	root := os.Geteuid() == 0
+
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	// The paths of this layer and their parents, an opaque whiteout only
+	// hides what the lower layers have.
+	layer := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := tarTarget(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if target == dest {
+			continue
+		}
+		if base := filepath.Base(target); whiteouts && strings.HasPrefix(base, whiteoutPrefix) {
+			if err := applyWhiteout(target, layer); err != nil {
+				return fmt.Errorf("Whiteout %s: %v", hdr.Name, err)
+			}
+			continue
+		}
+		mode := hdr.FileInfo().Mode()
+		for p := target; p != dest && !layer[p]; p = filepath.Dir(p) {
+			layer[p] = true
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+				return fmt.Errorf("Invalid tar entry %s, not a dir in rootfs", hdr.Name)
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, tarMode(mode)})
+
+		case tar.TypeReg:
+			if err := removeTarget(target); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := removeTarget(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			link, err := tarTarget(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := removeTarget(target); err != nil {
+				return err
+			}
+			if err := os.Link(link, target); err != nil {
+				return err
+			}
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if !root && hdr.Typeflag != tar.TypeFifo {
+				continue
+			}
+			if err := removeTarget(target); err != nil {
+				return err
+			}
+			m := uint32(mode.Perm())
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				m |= syscall.S_IFCHR
+			case tar.TypeBlock:
+				m |= syscall.S_IFBLK
+			default:
+				m |= syscall.S_IFIFO
+			}
+			dev := devMkdev(uint64(hdr.Devmajor), uint64(hdr.Devminor))
+			if err := syscall.Mknod(target, m, int(dev)); err != nil {
+				return fmt.Errorf("Mknod %s: %v", hdr.Name, err)
+			}
+
+		default:
+			continue
+		}
+
+		// A hard link is the inode of its target, chown would clear the
+		// setuid and setgid bits it already has.
+		if root && hdr.Typeflag != tar.TypeLink {
+			if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag != tar.TypeSymlink && hdr.Typeflag != tar.TypeLink && hdr.Typeflag != tar.TypeDir {
+			if err := os.Chmod(target, tarMode(mode)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Set dir modes at last, a read-only dir can't have entries added.
+	for i := len(dirs); i > 0; i-- {
+		if err := os.Chmod(dirs[i-1].path, dirs[i-1].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWhiteout removes what the whiteout entry at target hides, the
+// paths of the current layer are kept.
+func applyWhiteout(target string, layer map[string]bool) error {
+	dir, base := filepath.Split(target)
+	if base == whiteoutOpaque {
+		return removeLower(filepath.Clean(dir), layer)
+	}
+
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("Invalid whiteout")
+	}
+	return os.RemoveAll(filepath.Join(dir, name))
+}
+
+// removeLower removes the entries under dir which aren't in layer, the
+// dirs of layer may still have entries of the lower layers.
+func removeLower(dir string, layer map[string]bool) error {
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		if !layer[p] {
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if info, err := os.Lstat(p); err == nil && info.IsDir() {
+			if err := removeLower(p, layer); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarMode returns the permission and special bits of mode.
+func tarMode(mode os.FileMode) os.FileMode {
+	return mode.Perm() | mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+}
+
+// tarTarget returns the path of a tar entry under dest, it fails if the
+// entry escapes dest by "..", or a parent of it in dest is a symlink.
+func tarTarget(dest, name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid tar entry %s, escapes the rootfs", name)
+	}
+	if clean == "." {
+		return dest, nil
+	}
+
+	target := filepath.Join(dest, clean)
+
+	dir := dest
+	parts := strings.Split(clean, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("Invalid tar entry %s, its parent is a symlink", name)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// removeTarget removes what's at target before it's replaced, except a
+// dir.
+func removeTarget(target string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("Can't replace dir %s", target)
+	}
+	return os.Remove(target)
+}
@@ -0,0 +1,239 @@
+package tinybox
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// layerTar makes a tar of the entries, a name ending with / is a dir.
+func layerTar(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// treeFiles lists the paths under dir, dirs end with /.
+func treeFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		if info.IsDir() {
+			rel += "/"
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestUntarWhiteouts(t *testing.T) {
+	lower := []string{"etc/", "etc/a", "etc/b", "etc/sub/", "etc/sub/x", "usr/", "usr/bin"}
+
+	tests := []struct {
+		name  string
+		upper []string
+		want  []string
+	}{
+		{
+			name:  "whiteout a file",
+			upper: []string{"etc/.wh.a"},
+			want:  []string{"etc/", "etc/b", "etc/sub/", "etc/sub/x", "usr/", "usr/bin"},
+		},
+		{
+			name:  "whiteout a dir",
+			upper: []string{"etc/.wh.sub"},
+			want:  []string{"etc/", "etc/a", "etc/b", "usr/", "usr/bin"},
+		},
+		{
+			name:  "opaque hides the lower layers",
+			upper: []string{"etc/", "etc/.wh..wh..opq"},
+			want:  []string{"etc/", "usr/", "usr/bin"},
+		},
+		{
+			name:  "opaque keeps the entries of its layer before it",
+			upper: []string{"etc/", "etc/c", "etc/a", "etc/.wh..wh..opq"},
+			want:  []string{"etc/", "etc/a", "etc/c", "usr/", "usr/bin"},
+		},
+		{
+			name:  "opaque keeps the entries of its layer after it",
+			upper: []string{"etc/", "etc/.wh..wh..opq", "etc/c"},
+			want:  []string{"etc/", "etc/c", "usr/", "usr/bin"},
+		},
+		{
+			name:  "opaque hides lower entries of a dir of its layer",
+			upper: []string{"etc/", "etc/sub/", "etc/sub/y", "etc/.wh..wh..opq"},
+			want:  []string{"etc/", "etc/sub/", "etc/sub/y", "usr/", "usr/bin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			if err := untar(layerTar(t, lower...), dest, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := untar(layerTar(t, tt.upper...), dest, true); err != nil {
+				t.Fatal(err)
+			}
+			if got := treeFiles(t, dest); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tree = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUntarNoWhiteouts(t *testing.T) {
+	// A plain rootfs tarball keeps the whiteout names as files.
+	dest := t.TempDir()
+	if err := untar(layerTar(t, "etc/", "etc/a", "etc/.wh.a"), dest, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"etc/", "etc/.wh.a", "etc/a"}
+	if got := treeFiles(t, dest); !reflect.DeepEqual(got, want) {
+		t.Errorf("tree = %v, want %v", got, want)
+	}
+}
+
+// tarFile writes a tarball of hdrs to a file, a regular file has its
+// name as the content.
+func tarFile(t *testing.T, hdrs ...*tar.Header) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(hdr.Name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "rootfs.tar")
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestExtractTar(t *testing.T) {
+	file := tarFile(t,
+		&tar.Header{Name: "usr/", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "usr/bin/", Mode: 0750, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "usr/bin/app", Mode: 04755, Typeflag: tar.TypeReg, Uid: 1000, Gid: 1000},
+		&tar.Header{Name: "bin", Linkname: "usr/bin", Typeflag: tar.TypeSymlink},
+		&tar.Header{Name: "usr/bin/app2", Linkname: "usr/bin/app", Typeflag: tar.TypeLink},
+		&tar.Header{Name: "dev/null", Mode: 0666, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+	)
+	dest := filepath.Join(t.TempDir(), "rootfs")
+	if err := extractTar(file, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"bin", "usr/", "usr/bin/", "usr/bin/app", "usr/bin/app2"}
+	if os.Geteuid() == 0 {
+		want = append([]string{"bin", "dev/", "dev/null"}, want[1:]...)
+	}
+	if got := treeFiles(t, dest); !reflect.DeepEqual(got, want) {
+		t.Errorf("tree = %v, want %v", got, want)
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dest, "bin/app")); err != nil || string(data) != "usr/bin/app" {
+		t.Errorf("bin/app = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "bin")); err != nil || link != "usr/bin" {
+		t.Errorf("symlink bin = %q, %v", link, err)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "usr/bin")); err != nil || info.Mode().Perm() != 0750 {
+		t.Errorf("mode of usr/bin = %v, %v", info.Mode(), err)
+	}
+	info, err := os.Stat(filepath.Join(dest, "usr/bin/app"))
+	if err != nil || info.Mode()&os.ModeSetuid == 0 || info.Mode().Perm() != 0755 {
+		t.Fatalf("mode of usr/bin/app = %v, %v", info.Mode(), err)
+	}
+	if app2, err := os.Stat(filepath.Join(dest, "usr/bin/app2")); err != nil || !os.SameFile(info, app2) {
+		t.Errorf("usr/bin/app2 isn't a hard link of usr/bin/app: %v", err)
+	}
+	if os.Geteuid() == 0 {
+		if st := info.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 {
+			t.Errorf("owner of usr/bin/app = %d:%d, want 1000:1000", st.Uid, st.Gid)
+		}
+		null, err := os.Stat(filepath.Join(dest, "dev/null"))
+		if err != nil || null.Mode()&os.ModeCharDevice == 0 {
+			t.Fatalf("dev/null = %v, %v", null.Mode(), err)
+		}
+		if rdev := null.Sys().(*syscall.Stat_t).Rdev; devMajor(rdev) != 1 || devMinor(rdev) != 3 {
+			t.Errorf("dev/null is %d:%d, want 1:3", devMajor(rdev), devMinor(rdev))
+		}
+	}
+}
+
+func TestExtractTarEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		hdrs []*tar.Header
+	}{
+		{"dotdot", []*tar.Header{
+			{Name: "../evil", Mode: 0644, Typeflag: tar.TypeReg},
+		}},
+		{"dotdot inside", []*tar.Header{
+			{Name: "etc/../../evil", Mode: 0644, Typeflag: tar.TypeReg},
+		}},
+		{"through a symlink", []*tar.Header{
+			{Name: "out", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: "out/evil", Mode: 0644, Typeflag: tar.TypeReg},
+		}},
+		{"hard link out", []*tar.Header{
+			{Name: "evil", Linkname: "../secret", Typeflag: tar.TypeLink},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tarFile(t, tt.hdrs...)
+			parent := t.TempDir()
+			ioutil.WriteFile(filepath.Join(parent, "secret"), nil, 0600)
+			dest := filepath.Join(parent, "rootfs")
+
+			if err := extractTar(file, dest); err == nil {
+				t.Fatal("extracted an entry escaping the rootfs")
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "evil")); !os.IsNotExist(err) {
+				t.Errorf("evil written out of the rootfs: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package tinybox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cloneNewTime is CLONE_NEWTIME, it can only be used by unshare, as it's
+// in the exit signal bits of clone.
+const cloneNewTime = 0x80
+
+// timeClocks are the clocks a time namespace can offset.
+var timeClocks = map[string]bool{
+	"monotonic": true,
+	"boottime":  true,
+}
+
+// parseTimeOffset parses --time-offset clock=SECS.
+func parseTimeOffset(s string) (string, int64, error) {
+	clock, value, err := parseKV(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("Invalid time offset %s, expect monotonic=SECS or boottime=SECS", s)
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || !timeClocks[clock] {
+		return "", 0, fmt.Errorf("Invalid time offset %s, expect monotonic=SECS or boottime=SECS", s)
+	}
+	return clock, secs, nil
+}
+
+func validateTimeOffsets(offsets map[string]int64) error {
+	for clock := range offsets {
+		if !timeClocks[clock] {
+			return fmt.Errorf("Invalid time offset clock %s", clock)
+		}
+	}
+	return nil
+}
+
+// setTimens unshares a time namespace with c.TimeOffsets for the calling
+// thread, the offsets must be written before any process is in it. The
+// process enters it on exec, as the kernel switches to the time namespace
+// for children then. Without kernel support it's skipped with a warning.
+func setTimens(c *Container) error {
+	if len(c.TimeOffsets) == 0 {
+		return nil
+	}
+
+	if _, err := os.Lstat("/proc/self/ns/time"); err != nil {
+		log.Printf("Warning: time namespace unsupported, skip time offsets \n")
+		return nil
+	}
+
+	if err := syscall.Unshare(cloneNewTime); err != nil {
+		return err
+	}
+
+	var clocks []string
+	for clock := range c.TimeOffsets {
+		clocks = append(clocks, clock)
+	}
+	sort.Strings(clocks)
+
+	var buf bytes.Buffer
+	for _, clock := range clocks {
+		fmt.Fprintf(&buf, "%s %d 0\n", clock, c.TimeOffsets[clock])
+	}
+
+	// The offsets belong to the thread which has unshared, thread-self has
+	// no timens_offsets, but the tid works as a pid.
+	file := fmt.Sprintf("/proc/%d/timens_offsets", syscall.Gettid())
+	return ioutil.WriteFile(file, buf.Bytes(), 0)
+}
+
+// timeOffsetValue is the --time-offset flag.
+type timeOffsetValue map[string]int64
+
+func (v *timeOffsetValue) String() string {
+	var offsets []string
+	for clock, secs := range *v {
+		offsets = append(offsets, fmt.Sprintf("%s=%d", clock, secs))
+	}
+	return strings.Join(offsets, ",")
+}
+
+func (v *timeOffsetValue) Set(s string) error {
+	clock, secs, err := parseTimeOffset(s)
+	if err != nil {
+		return err
+	}
+	if *v == nil {
+		*v = make(timeOffsetValue)
+	}
+	(*v)[clock] = secs
+	return nil
+}
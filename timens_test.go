@@ -0,0 +1,93 @@
+package tinybox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseTimeOffset(t *testing.T) {
+	tests := []struct {
+		in    string
+		clock string
+		secs  int64
+		ok    bool
+	}{
+		{"monotonic=86400", "monotonic", 86400, true},
+		{"boottime=-60", "boottime", -60, true},
+		{"realtime=10", "", 0, false},
+		{"monotonic=1.5", "", 0, false},
+		{"monotonic", "", 0, false},
+	}
+	for _, tt := range tests {
+		clock, secs, err := parseTimeOffset(tt.in)
+		if (err == nil) != tt.ok || clock != tt.clock || secs != tt.secs {
+			t.Errorf("parseTimeOffset(%q) = %s, %d, %v, want %s, %d, ok %v", tt.in, clock, secs, err, tt.clock, tt.secs, tt.ok)
+		}
+	}
+}
+
+// clockSecs reads the clock id by the syscall, which applies the offsets
+// of the time namespace.
+func clockSecs(id int) int64 {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, uintptr(id), uintptr(unsafe.Pointer(&ts)), 0)
+	return ts.Sec
+}
+
+// TestTimens sets the offsets in a child of the test like the init
+// process, the program it execs must see its clocks offset by them.
+func TestTimens(t *testing.T) {
+	const (
+		clockMonotonic = 1
+		clockBoottime  = 7
+	)
+	switch os.Getenv("TINYBOX_TEST_TIMENS") {
+	case "set":
+		runtime.LockOSThread()
+		c := &Container{TimeOffsets: map[string]int64{"monotonic": 86400, "boottime": 3600}}
+		if err := setTimens(c); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		env := mergeEnv(os.Environ(), []string{"TINYBOX_TEST_TIMENS=print"}, nil)
+		err := syscall.Exec(os.Args[0], []string{os.Args[0], "-test.run=^TestTimens$"}, env)
+		fmt.Println(err)
+		os.Exit(1)
+	case "print":
+		fmt.Printf("clocks %d %d\n", clockSecs(clockMonotonic), clockSecs(clockBoottime))
+		os.Exit(0)
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to unshare a time namespace")
+	}
+	if _, err := os.Lstat("/proc/self/ns/time"); err != nil {
+		t.Skip("no time namespace in the kernel")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTimens$")
+	cmd.Env = append(os.Environ(), "TINYBOX_TEST_TIMENS=set")
+	monotonic, boottime := clockSecs(clockMonotonic), clockSecs(clockBoottime)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	var gotMonotonic, gotBoottime int64
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(out)), "clocks %d %d", &gotMonotonic, &gotBoottime); err != nil {
+		t.Fatalf("child printed %q", out)
+	}
+	// The child runs for a few seconds at most.
+	if d := gotMonotonic - monotonic - 86400; d < 0 || d > 5 {
+		t.Errorf("monotonic %d, want %d + 86400", gotMonotonic, monotonic)
+	}
+	if d := gotBoottime - boottime - 3600; d < 0 || d > 5 {
+		t.Errorf("boottime %d, want %d + 3600", gotBoottime, boottime)
+	}
+}
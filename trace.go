@@ -0,0 +1,127 @@
+package tinybox
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceRecord is a setup call recorded with --trace-setup, a line of the
+// trace file.
+type TraceRecord struct {
+	Time    time.Time `json:"time"`
+	Pid     int       `json:"pid"`
+	Process string    `json:"process"` // master or init
+	Call    string    `json:"call"`    // like mount, mkdir, write, clone or setns
+	Args    []string  `json:"args,omitempty"`
+	Err     string    `json:"err,omitempty"`
+}
+
+// setupTrace is the trace of this process, nil if it's not traced.
+var setupTrace struct {
+	sync.Mutex
+	file    *os.File
+	process string
+	redact  *strings.Replacer
+}
+
+func (c *Container) TraceFile() string {
+	return filepath.Join(c.Dir, "trace")
+}
+
+// startTrace starts tracing the setup calls of the process into the
+// trace file of c, the master starts a new one. The file stays open, so
+// the init process traces after chroot too.
+func startTrace(c *Container, process string) {
+	if !c.TraceSetup {
+		return
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if process == "master" {
+		flag |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(c.TraceFile(), flag, 0644)
+	if err != nil {
+		log.Printf("Open trace error: %v \n", err)
+		return
+	}
+
+	setupTrace.Lock()
+	defer setupTrace.Unlock()
+	setupTrace.file = file
+	setupTrace.process = process
+	if c.TraceRedact {
+		var pairs []string
+		if c.Rootfs != "" {
+			pairs = append(pairs, c.Rootfs, "<rootfs>")
+		}
+		pairs = append(pairs, c.Dir, "<dir>")
+		setupTrace.redact = strings.NewReplacer(pairs...)
+	}
+}
+
+// stopTrace stops tracing once the setup is done.
+func stopTrace() {
+	setupTrace.Lock()
+	defer setupTrace.Unlock()
+	if setupTrace.file != nil {
+		setupTrace.file.Close()
+		setupTrace.file = nil
+	}
+}
+
+// trace records a call with its args and result, if the process is traced.
+func trace(call string, err error, args ...string) {
+	setupTrace.Lock()
+	defer setupTrace.Unlock()
+	if setupTrace.file == nil {
+		return
+	}
+
+	rec := TraceRecord{Time: time.Now(), Pid: os.Getpid(), Process: setupTrace.process, Call: call, Args: args}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	if r := setupTrace.redact; r != nil {
+		for i := range rec.Args {
+			rec.Args[i] = r.Replace(rec.Args[i])
+		}
+		rec.Err = r.Replace(rec.Err)
+	}
+	enc := json.NewEncoder(setupTrace.file)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(&rec); err != nil {
+		log.Printf("Write trace error: %v \n", err)
+	}
+}
+
+// ReadTrace reads the setup trace of the container name under home.
+func ReadTrace(home, name string) ([]TraceRecord, error) {
+	if !filepath.IsAbs(home) {
+		return nil, fmt.Errorf("Invalid home %s, must be an absolute path", home)
+	}
+
+	file, err := os.Open(filepath.Join(home, name, "trace"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var recs []TraceRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return recs, fmt.Errorf("Invalid trace of %s: %v", name, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, scanner.Err()
+}
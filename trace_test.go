@@ -0,0 +1,108 @@
+package tinybox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestTrace traces the cgroup and mount calls of a setup with a fake
+// cgroup root and mount, each call is in the trace with its result.
+func TestTrace(t *testing.T) {
+	defer func(f func(string, string, string, uintptr, string) error) { mountFunc = f }(mountFunc)
+	mountFunc = func(source, target, fstype string, flags uintptr, data string) error {
+		if fstype == "proc" {
+			return syscall.EPERM
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		traced bool
+		redact bool
+	}{
+		{"traced", true, false},
+		{"redacted", true, true},
+		{"not traced", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.Mkdir(filepath.Join(root, subsysMEM), 0755); err != nil {
+				t.Fatal(err)
+			}
+			cg, err := newCGroup(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cg.roots[subsysMEM] = "/"
+
+			home := t.TempDir()
+			c := &Container{
+				Name:        "traced",
+				Dir:         filepath.Join(home, "traced"),
+				Rootfs:      "/srv/rootfs",
+				Pid:         os.Getpid(),
+				TraceSetup:  tt.traced,
+				TraceRedact: tt.redact,
+				CgPrefix:    "tinybox",
+				CgOpts:      &CGroupOptions{Memory: "64m"},
+			}
+			if err := os.Mkdir(c.Dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			startTrace(c, "master")
+			err = cg.Memory(c)
+			if err == nil {
+				mount(c.Rootfs, c.Rootfs, "bind", syscall.MS_BIND, "")
+				mount("proc", filepath.Join(c.Rootfs, "proc"), "proc", 0, "")
+			}
+			stopTrace()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Not traced once the setup is done.
+			mount("tmpfs", "/tmp", "tmpfs", 0, "")
+
+			recs, err := ReadTrace(home, c.Name)
+			if !tt.traced {
+				if !os.IsNotExist(err) {
+					t.Errorf("ReadTrace of an untraced container = %d records, %v", len(recs), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			group := filepath.Join(root, subsysMEM, "tinybox", "traced")
+			rootfs := c.Rootfs
+			if tt.redact {
+				rootfs = "<rootfs>"
+			}
+			want := []TraceRecord{
+				{Call: "mkdir", Args: []string{group}},
+				{Call: "write", Args: []string{filepath.Join(group, "cgroup.procs"), "0"}},
+				{Call: "write", Args: []string{filepath.Join(group, "memory.limit_in_bytes"), "67108864"}},
+				{Call: "mount", Args: []string{rootfs, rootfs, "bind", "0x1000", ""}},
+				{Call: "mount", Args: []string{"proc", rootfs + "/proc", "proc", "0x0", ""}, Err: "operation not permitted"},
+			}
+			want[1].Args[1] = strconv.Itoa(c.Pid)
+			var got []TraceRecord
+			for _, rec := range recs {
+				if rec.Pid != os.Getpid() || rec.Process != "master" || rec.Time.IsZero() {
+					t.Errorf("record %+v, want of the master", rec)
+				}
+				got = append(got, TraceRecord{Call: rec.Call, Args: rec.Args, Err: rec.Err})
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("trace\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package tinybox
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); e != 0 {
+		return e
+	}
+	return nil
+}
+
+// openPty opens a new pty pair, the slave is for the init process.
+func openPty() (ptm, pts *os.File, err error) {
+	ptm, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(ptm.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		ptm.Close()
+		return nil, nil, fmt.Errorf("Unlock pty: %v", err)
+	}
+	var n uint32
+	if err := ioctl(ptm.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		ptm.Close()
+		return nil, nil, fmt.Errorf("Get pty number: %v", err)
+	}
+
+	pts, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	return ptm, pts, nil
+}
+
+// makeRaw puts the terminal fd in raw mode like cfmakeraw, the old state
+// is returned to restore it.
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); err != nil {
+		return nil, err
+	}
+
+	raw := old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+// copyWinsize sets the window size of the terminal to from the one of
+// from.
+func copyWinsize(from, to uintptr) error {
+	var ws struct{ row, col, x, y uint16 }
+	if err := ioctl(from, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		return err
+	}
+	return ioctl(to, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// attachTTY puts the host terminal in raw mode and copies it to and from
+// the pty of the container, the output is drained into p.ptyDone.
+func (p *masterProcess) attachTTY(ptm *os.File) {
+	p.pty = ptm
+	if isTerminal(0) {
+		term, err := makeRaw(0)
+		if err != nil {
+			log.Printf("Raw terminal error: %v \n", err)
+		}
+		p.term = term
+		if err := copyWinsize(0, ptm.Fd()); err != nil {
+			log.Printf("Copy window size error: %v \n", err)
+		}
+	}
+
+	p.ptyDone = make(chan struct{})
+	go func() {
+		io.Copy(ptm, os.Stdin)
+	}()
+	go func() {
+		defer close(p.ptyDone)
+		// It ends with EIO once the container closed all its slave fds.
+		io.Copy(os.Stdout, ptm)
+	}()
+}
+
+// restoreTerminal restores the host terminal from raw mode.
+func (p *masterProcess) restoreTerminal() {
+	if p.term == nil {
+		return
+	}
+	if err := ioctl(0, syscall.TCSETS, uintptr(unsafe.Pointer(p.term))); err != nil {
+		log.Printf("Restore terminal error: %v \n", err)
+	}
+	p.term = nil
+}
+
+// resizeHandle forwards a window size change of the host terminal.
+func resizeHandle(sig os.Signal, ec chan event) {
+	ec <- event{action: evResize}
+}
@@ -0,0 +1,91 @@
+package tinybox
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// TestRunTTY runs tinybox like "run -it --rm" on a pty: an interactive
+// shell exits 7, tinybox must exit 7, restore the terminal and leave no
+// state of the container.
+func TestRunTTY(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to run a container")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("needs go to build tinybox")
+	}
+	bin := filepath.Join(t.TempDir(), "tinybox")
+	if out, err := exec.Command("go", "build", "-o", bin, "./cmd").CombinedOutput(); err != nil {
+		t.Skipf("build tinybox: %v: %s", err, out)
+	}
+
+	ptm, pts, err := openPty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ptm.Close()
+	defer pts.Close()
+	var before syscall.Termios
+	if err := ioctl(pts.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&before))); err != nil {
+		t.Fatal(err)
+	}
+
+	home := t.TempDir()
+	cmd := exec.Command(bin, "tty", "--tty", "--rm", "--run", "/bin/sh")
+	cmd.Env = append(os.Environ(), "TINYBOX_HOME="+home)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	var out bytes.Buffer
+	outDone := make(chan struct{})
+	go func() {
+		defer close(outDone)
+		io.Copy(&out, ptm)
+	}()
+
+	// The shell prompts once it reads the pty.
+	time.Sleep(time.Second)
+	if _, err := ptm.Write([]byte("echo in-$((6+1))\rexit 7\r")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(time.Second * 10):
+		t.Fatal("tinybox didn't exit")
+	}
+	var after syscall.Termios
+	if err := ioctl(pts.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&after))); err != nil {
+		t.Fatal(err)
+	}
+	pts.Close()
+	<-outDone
+
+	if code := cmd.ProcessState.ExitCode(); code != 7 {
+		t.Fatalf("tinybox exited %d (%v), want 7: %s", code, err, out.String())
+	}
+	if !strings.Contains(out.String(), "in-7") {
+		t.Errorf("output %q, want the shell's echo", out.String())
+	}
+	if after.Lflag != before.Lflag || after.Iflag != before.Iflag || after.Oflag != before.Oflag {
+		t.Errorf("terminal left %+v, want %+v", after, before)
+	}
+	if _, err := os.Stat(filepath.Join(home, "tty")); !os.IsNotExist(err) {
+		t.Errorf("container dir left with --rm: %v", err)
+	}
+}
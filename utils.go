@@ -1,10 +1,15 @@
 package tinybox
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"unsafe"
 )
 
 func MkdirIfNotExist(name string) error {
@@ -19,6 +24,32 @@ func MkdirIfNotExist(name string) error {
 	return nil
 }
 
+// ensureFile makes sure name exists with the type mode, it's created by
+// create if missing, or removed and created again if it's another type.
+func ensureFile(name string, mode os.FileMode, create func(string) error) error {
+	info, err := os.Lstat(name)
+	if err == nil {
+		if info.Mode()&os.ModeType == mode {
+			return nil
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return create(name)
+}
+
+// processAlive reports whether the process pid exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
 func Flock(path string) (*os.File, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -48,3 +79,136 @@ func WriteFileWithPanic(file string, v string) {
 		panic(err)
 	}
 }
+
+// ParseSize parses a size like "64m" or "1g" into bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return 0, ErrOptInvalidSize
+	}
+
+	var unit int64 = 1
+	switch s[len(s)-1] {
+	case 'k':
+		unit = 1 << 10
+	case 'm':
+		unit = 1 << 20
+	case 'g':
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, ErrOptInvalidSize
+	}
+	return n * unit, nil
+}
+
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"WINCH": syscall.SIGWINCH,
+	"PWR":   syscall.SIGPWR,
+}
+
+// ParseSignal parses a signal name (TERM or SIGTERM) or number.
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("Invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signals[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("Unknown signal %s", s)
+}
+
+// signalName returns the name of sig like SIGKILL, or its description if
+// it's not in signals.
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+const prSetChildSubreaper = 36
+
+// processExited reports if pid is gone or a zombie not waited yet.
+func processExited(pid int) bool {
+	if !processAlive(pid) {
+		return true
+	}
+
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	// The state follows the command name in parentheses.
+	if ix := bytes.LastIndexByte(stat, ')'); ix >= 0 && ix+2 < len(stat) {
+		return stat[ix+2] == 'Z'
+	}
+	return false
+}
+
+// setSubreaper marks the current process as a child subreaper.
+func setSubreaper() error {
+	if _, _, e := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); e != 0 {
+		return fmt.Errorf("Set child subreaper: %v", e)
+	}
+	return nil
+}
+
+// isTerminal reports whether fd is a terminal.
+func isTerminal(fd int) bool {
+	var st syscall.Termios
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(&st)))
+	return e == 0
+}
+
+func fcntl(fd int, cmd int, arg int) (int, error) {
+	r, _, e := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(cmd), uintptr(arg))
+	if e != 0 {
+		return 0, e
+	}
+	return int(r), nil
+}
+
+// writeFileAtomic writes data to a temp file in the dir of name and renames
+// it to name, so a reader never sees a partial file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,77 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"4096", 4096, true},
+		{"64k", 64 << 10, true},
+		{"64m", 64 << 20, true},
+		{"64M", 64 << 20, true},
+		{" 1g ", 1 << 30, true},
+		{"", 0, false},
+		{"m", 0, false},
+		{"-1m", 0, false},
+		{"1.5g", 0, false},
+		{"1t", 0, false},
+		{"64mb", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestEnsureFile reuses a file of the right type, and replaces one of the
+// wrong type.
+func TestEnsureFile(t *testing.T) {
+	mkfifo := func(name string) error { return syscall.Mkfifo(name, 0600) }
+	tests := []struct {
+		name    string
+		existed func(string) error
+		created bool
+	}{
+		{"missing", nil, true},
+		{"fifo", mkfifo, false},
+		{"regular file", func(name string) error { return ioutil.WriteFile(name, nil, 0644) }, true},
+		{"dir", func(name string) error { return os.Mkdir(name, 0755) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "pipe")
+			if tt.existed != nil {
+				if err := tt.existed(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			created := false
+			err := ensureFile(name, os.ModeNamedPipe, func(name string) error {
+				created = true
+				return mkfifo(name)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created != tt.created {
+				t.Errorf("created %v, want %v", created, tt.created)
+			}
+			if info, err := os.Lstat(name); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+				t.Errorf("%s isn't a fifo", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package tinybox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Volume is a container-private dir bind mounted at Dest, it's kept in
+// the container's dir so a restart of the same container reuses the data,
+// and it's removed with the container's state by gc.
+type Volume struct {
+	Dest     string `json:"dest"`
+	Source   string `json:"source,omitempty"`   // set at create time
+	Order    int    `json:"order,omitempty"`    // mount order among the mounts of the same depth
+	From     string `json:"from,omitempty"`     // the container the volume is shared from
+	ReadOnly bool   `json:"readonly,omitempty"` // only for a shared volume
+}
+
+// VolumesFrom shares the volumes of the container Name, at the same paths.
+type VolumesFrom struct {
+	Name     string `json:"name"`
+	ReadOnly bool   `json:"readonly,omitempty"`
+}
+
+// parseVolumesFrom parses --volumes-from name[:ro].
+func parseVolumesFrom(s string) (VolumesFrom, error) {
+	name, mode := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, mode = s[:i], s[i+1:]
+	}
+	switch mode {
+	case "", "ro", "rw":
+	default:
+		return VolumesFrom{}, fmt.Errorf("Invalid volumes from %s, expect name[:ro]", s)
+	}
+	return VolumesFrom{Name: name, ReadOnly: mode == "ro"}, nil
+}
+
+// parseVolume parses --volume dest, only anonymous volumes are supported.
+func parseVolume(s string) (Volume, error) {
+	if strings.Contains(s, ":") {
+		return Volume{}, fmt.Errorf("Invalid volume %s, expect the container path only", s)
+	}
+	return Volume{Dest: s}, nil
+}
+
+func (v *Volume) Validate() error {
+	if !path.IsAbs(v.Dest) || path.Clean(v.Dest) != v.Dest || v.Dest == "/" {
+		return fmt.Errorf("Invalid volume %s, must be a clean absolute path", v.Dest)
+	}
+	return nil
+}
+
+// validateVolumes checks each volume and that no two share a path.
+func validateVolumes(volumes []Volume) error {
+	dests := make(map[string]bool, len(volumes))
+	for i := range volumes {
+		if err := volumes[i].Validate(); err != nil {
+			return err
+		}
+		if dests[volumes[i].Dest] {
+			return fmt.Errorf("Duplicate volume %s", volumes[i].Dest)
+		}
+		dests[volumes[i].Dest] = true
+	}
+	return nil
+}
+
+// volumeDir returns the dir of the volume at dest, it depends on dest only,
+// so the same volume of a restarted container has the same dir.
+func (c *Container) volumeDir(dest string) string {
+	sum := sha256.Sum256([]byte(dest))
+	return filepath.Join(c.Dir, "volumes", hex.EncodeToString(sum[:8]))
+}
+
+// createVolumes makes the dirs of volumes, an existing one is reused.
+func (c *Container) createVolumes(volumes []Volume) ([]Volume, error) {
+	result := make([]Volume, 0, len(volumes))
+	for _, v := range volumes {
+		v.Source = c.volumeDir(v.Dest)
+		if err := os.MkdirAll(v.Source, 0755); err != nil {
+			return nil, fmt.Errorf("Create volume %s: %v", v.Dest, err)
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// sharedVolumes returns the volumes of the containers in from, they must
+// have been created with them.
+func sharedVolumes(home string, from []VolumesFrom) ([]Volume, error) {
+	var result []Volume
+	for _, f := range from {
+		other, err := loadContainer(home, f.Name)
+		if err != nil {
+			return nil, fmt.Errorf("Load container %s of volumes from: %v", f.Name, err)
+		}
+		for _, v := range other.Volumes {
+			if info, err := os.Stat(v.Source); err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("Volume %s of container %s is gone", v.Dest, f.Name)
+			}
+			// A volume shared on again still belongs to its owner.
+			if v.From == "" {
+				v.From = f.Name
+			}
+			v.ReadOnly = v.ReadOnly || f.ReadOnly
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// volumeUsers returns the other containers under home which share the
+// volumes of the container name. Its dir holds those volumes, so it must
+// be kept while they're there.
+func volumeUsers(home, name string) ([]string, error) {
+	entries, err := ioutil.ReadDir(home)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == name {
+			continue
+		}
+		other, err := loadContainer(home, entry.Name())
+		if err != nil {
+			continue
+		}
+		for _, v := range other.Volumes {
+			if v.From == name {
+				users = append(users, other.Name)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// mountVolume binds the volume on its path in the rootfs. A symlink on
+// the path is refused, it would resolve against the host's root.
+func (fs *rootFs) mountVolume(c *Container, v Volume) error {
+	target, err := openInRoot(c.Rootfs, v.Dest, true)
+	if err != nil {
+		return fmt.Errorf("Volume %s: %v", v.Dest, err)
+	}
+	defer target.Close()
+	if info, err := target.Stat(); err != nil || !info.IsDir() {
+		return fmt.Errorf("Volume %s is a symlink or not a dir in the rootfs", v.Dest)
+	}
+
+	if err := mount(v.Source, procPath(target), "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("Mount volume %s: %v", v.Dest, err)
+	}
+	if v.ReadOnly {
+		// Opened again, the path now leads to the root of the bind.
+		bind, err := openInRoot(c.Rootfs, v.Dest, false)
+		if err != nil {
+			return fmt.Errorf("Volume %s: %v", v.Dest, err)
+		}
+		defer bind.Close()
+
+		flag := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+		if err := mount("", procPath(bind), "", uintptr(flag), ""); err != nil {
+			return fmt.Errorf("Remount volume %s read-only: %v", v.Dest, err)
+		}
+	}
+	return nil
+}
+
+// volumeValue is the --volume flag.
+type volumeValue []Volume
+
+func (v *volumeValue) String() string {
+	var dests []string
+	for _, vol := range *v {
+		dests = append(dests, vol.Dest)
+	}
+	return strings.Join(dests, ",")
+}
+
+func (v *volumeValue) Set(s string) error {
+	vol, err := parseVolume(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, vol)
+	return nil
+}
+
+// volumesFromValue is the --volumes-from flag.
+type volumesFromValue []VolumesFrom
+
+func (v *volumesFromValue) String() string {
+	var names []string
+	for _, f := range *v {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (v *volumesFromValue) Set(s string) error {
+	f, err := parseVolumesFrom(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, f)
+	return nil
+}
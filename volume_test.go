@@ -0,0 +1,333 @@
+package tinybox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseVolumesFrom(t *testing.T) {
+	tests := []struct {
+		in   string
+		want VolumesFrom
+		ok   bool
+	}{
+		{"db", VolumesFrom{Name: "db"}, true},
+		{"db:ro", VolumesFrom{Name: "db", ReadOnly: true}, true},
+		{"db:rw", VolumesFrom{Name: "db"}, true},
+		{"db:rx", VolumesFrom{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseVolumesFrom(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseVolumesFrom(%q) = %+v, %v, want %+v, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// newVolumeContainer saves a container under home with the volumes.
+func newVolumeContainer(t *testing.T, home, name string, volumes []Volume) *Container {
+	t.Helper()
+	c := &Container{Name: name, Dir: filepath.Join(home, name)}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if c.Volumes, err = c.createVolumes(volumes); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSharedVolumes(t *testing.T) {
+	home := t.TempDir()
+	db := newVolumeContainer(t, home, "db", []Volume{{Dest: "/data"}, {Dest: "/logs"}})
+
+	tests := []struct {
+		name string
+		from []VolumesFrom
+		ro   bool
+	}{
+		{"rw", []VolumesFrom{{Name: "db"}}, false},
+		{"ro", []VolumesFrom{{Name: "db", ReadOnly: true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared, err := sharedVolumes(home, tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(shared) != len(db.Volumes) {
+				t.Fatalf("shared %d volumes, want %d", len(shared), len(db.Volumes))
+			}
+			for i, v := range shared {
+				if v.Source != db.Volumes[i].Source || v.From != "db" || v.ReadOnly != tt.ro {
+					t.Errorf("shared volume %+v, want source %s from db read-only %v", v, db.Volumes[i].Source, tt.ro)
+				}
+			}
+		})
+	}
+
+	// A volume shared on again is still db's.
+	web := newVolumeContainer(t, home, "web", nil)
+	web.Volumes, _ = sharedVolumes(home, []VolumesFrom{{Name: "db"}})
+	if err := web.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := sharedVolumes(home, []VolumesFrom{{Name: "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range again {
+		if v.From != "db" {
+			t.Errorf("volume %s shared from web is from %s, want db", v.Dest, v.From)
+		}
+	}
+
+	if _, err := sharedVolumes(home, []VolumesFrom{{Name: "none"}}); err == nil {
+		t.Error("volumes from a missing container succeeded")
+	}
+}
+
+// TestVolumeSharedMount binds a volume into the rootfs of its container
+// and of one sharing it, a write in one is visible in the other.
+func TestVolumeSharedMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	home := t.TempDir()
+	db := newVolumeContainer(t, home, "db", []Volume{{Dest: "/data"}})
+	db.Rootfs = filepath.Join(home, "rootfs-db")
+	shared, err := sharedVolumes(home, []VolumesFrom{{Name: "db", ReadOnly: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := &Container{Name: "web", Rootfs: filepath.Join(home, "rootfs-web"), Volumes: shared}
+
+	fs := &rootFs{}
+	for _, c := range []*Container{db, web} {
+		if err := os.Mkdir(c.Rootfs, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.mountVolume(c, c.Volumes[0]); err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Unmount(filepath.Join(c.Rootfs, "data"), syscall.MNT_DETACH)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(db.Rootfs, "data", "f"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(web.Rootfs, "data", "f"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("read the write of db in web = %q, %v", data, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(web.Rootfs, "data", "g"), nil, 0644); err == nil {
+		t.Error("write in the read-only shared volume succeeded")
+	}
+}
+
+// TestGCKeepsSharedVolumes checks gc keeps the dir of a container while
+// another one shares its volumes.
+func TestGCKeepsSharedVolumes(t *testing.T) {
+	home := t.TempDir()
+	db := newVolumeContainer(t, home, "db", []Volume{{Dest: "/data"}})
+	web := newVolumeContainer(t, home, "web", nil)
+	web.Volumes, _ = sharedVolumes(home, []VolumesFrom{{Name: "db"}})
+	if err := web.saveJson(); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := volumeUsers(home, "db")
+	if err != nil || !reflect.DeepEqual(users, []string{"web"}) {
+		t.Fatalf("volumeUsers = %v, %v, want [web]", users, err)
+	}
+
+	if _, err := gcContainer(db, &CGroup{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(db.Volumes[0].Source); err != nil {
+		t.Fatalf("gc removed the shared volume: %v", err)
+	}
+
+	if err := os.RemoveAll(web.Dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcContainer(db, &CGroup{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(db.Dir); !os.IsNotExist(err) {
+		t.Errorf("gc kept %s without a user of its volumes", db.Dir)
+	}
+}
+
+// TestMountVolumeSymlink mounts volumes on paths with a symlink in the
+// rootfs, the bind must never land outside of it.
+func TestMountVolumeSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	tests := []struct {
+		name  string
+		links map[string]string // rootfs path to the link target
+		dest  string
+		ok    bool
+	}{
+		{"plain", nil, "/data", true},
+		{"created dirs", nil, "/var/lib/data", true},
+		{"last is a symlink", map[string]string{"data": "HOST"}, "/data", false},
+		{"dir is a symlink", map[string]string{"var": "HOST"}, "/var/data", false},
+		{"dir is a relative symlink", map[string]string{"var": "../../host"}, "/var/data", false},
+		{"deep dir is a symlink", map[string]string{"var/lib": "HOST"}, "/var/lib/data", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			host := filepath.Join(home, "host")
+			c := newVolumeContainer(t, home, "c", []Volume{{Dest: tt.dest}})
+			c.Rootfs = filepath.Join(home, "rootfs", "c")
+			for _, dir := range []string{host, c.Rootfs} {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for name, target := range tt.links {
+				if target == "HOST" {
+					target = host
+				}
+				link := filepath.Join(c.Rootfs, name)
+				if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(target, link); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := (&rootFs{}).mountVolume(c, c.Volumes[0])
+			if err == nil {
+				defer syscall.Unmount(filepath.Join(c.Rootfs, tt.dest), syscall.MNT_DETACH)
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("mountVolume = %v, want ok %v", err, tt.ok)
+			}
+			if entries, _ := ioutil.ReadDir(host); len(entries) > 0 {
+				t.Errorf("the volume created %s on the host", entries[0].Name())
+			}
+			if !tt.ok {
+				return
+			}
+			if err := ioutil.WriteFile(filepath.Join(c.Rootfs, tt.dest, "f"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(c.Volumes[0].Source, "f")); err != nil {
+				t.Errorf("the write isn't in the volume: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"/data", true},
+		{"/var/lib/data", true},
+		{"/host:/data", false},
+		{"data", false},
+		{"/data/", false},
+		{"/var/../data", false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		v, err := parseVolume(tt.in)
+		if err == nil {
+			err = validateVolumes([]Volume{v})
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("volume %q = %v, want ok %v", tt.in, err, tt.ok)
+		}
+	}
+	if err := validateVolumes([]Volume{{Dest: "/data"}, {Dest: "/data"}}); err == nil {
+		t.Error("duplicate volumes are valid")
+	}
+}
+
+// TestVolumeRestart writes into a volume, stops the container and starts
+// it again under the same name, the data must still be there.
+func TestVolumeRestart(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to mount")
+	}
+
+	home := t.TempDir()
+	rootfs := filepath.Join(home, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	volumes := []Volume{{Dest: "/data"}, {Dest: "/var/cache"}}
+
+	fs := &rootFs{}
+	var sources []string
+	for run := 0; run < 2; run++ {
+		c := newVolumeContainer(t, home, "box", volumes)
+		c.Rootfs = rootfs
+		for i, v := range c.Volumes {
+			if run == 0 {
+				sources = append(sources, v.Source)
+			} else if v.Source != sources[i] {
+				t.Errorf("volume %s of the restart at %s, was %s", v.Dest, v.Source, sources[i])
+			}
+			if err := fs.mountVolume(c, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		file := filepath.Join(rootfs, "data", "counter")
+		data, err := ioutil.ReadFile(file)
+		if run == 0 && !os.IsNotExist(err) {
+			t.Errorf("new volume has data %q, %v", data, err)
+		}
+		if run == 1 && string(data) != "1" {
+			t.Errorf("data after the restart = %q, %v, want 1", data, err)
+		}
+		if run == 0 {
+			if err := ioutil.WriteFile(file, []byte("1"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Stopped, the mounts of the container are gone.
+		for _, v := range c.Volumes {
+			if err := syscall.Unmount(filepath.Join(rootfs, v.Dest), syscall.MNT_DETACH); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Fatalf("volume data left in the rootfs: %v", err)
+		}
+	}
+
+	// Removed with the container.
+	c, err := loadContainer(home, "box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gcContainer(c, &CGroup{}, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, source := range sources {
+		if _, err := os.Stat(source); !os.IsNotExist(err) {
+			t.Errorf("volume %s left after the removal: %v", source, err)
+		}
+	}
+}